@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alerts
+//
+// Alerts are sent by email through a local SMTP relay, and/or POSTed
+// as JSON to a webhook.  Each alert about a receiver goes to the
+// addresses in AlertEmailTo, and to the recipients for the project
+// which deployed the receiver.  These are the motus users who belong
+// to that project, as motus.org reported when they last logged in to
+// this server, and any addresses listed for it in AlertProjectEmails.
+// The motus API gives us no way to list a project's members, so a
+// project whose members may never log in here should be listed in
+// AlertProjectEmails.  Alerts raised during quiet hours are held until
+// quiet hours end.
+
+// kinds of alert
+const (
+	AlertOffline    = "offline"    // receiver has been disconnected or silent for too long
+	AlertRecovered  = "recovered"  // receiver is back after an AlertOffline
+	AlertMislocated = "mislocated" // receiver's GPS fix disagrees with its motus deployment
+	AlertClock      = "clock"      // receiver's clock is wrong
+	AlertBootLoop   = "bootloop"   // receiver keeps rebooting
+	AlertNoTags     = "notags"     // receiver has stopped detecting tags
+)
+
+// an alert about a receiver
+type Alert struct {
+	Serno     Serno
+	Kind      string    // one of the Alert... constants
+	Ts        time.Time // when the alert was raised
+	SiteName  string    // motus deployment site name, if known
+	ProjectID int       // motus project ID, if known
+	Text      string    // human-readable description
+}
+
+// create an alert about a receiver, filling in its motus deployment
+func NewAlert(serno Serno, kind string, text string) *Alert {
+	a := &Alert{Serno: serno, Kind: kind, Ts: time.Now(), Text: text}
+	if dep, known := MotusInfo.Dep(serno); known {
+		a.SiteName = dep.SiteName
+		a.ProjectID = dep.ProjectID
+	}
+	return a
+}
+
+// subject line for an alert
+func (a *Alert) Subject() string {
+	s := fmt.Sprintf("[sensorgnome] %s %s", a.Serno, a.Kind)
+	if a.SiteName != "" {
+		s += " (" + a.SiteName + ")"
+	}
+	return s
+}
+
+// alerts held during quiet hours
+var heldAlerts struct {
+	alerts []*Alert
+	lock   sync.Mutex
+}
+
+// are we in quiet hours at time t?
+func inQuietHours(t time.Time) bool {
+	h := t.Hour()
+	switch {
+	case AlertQuietHoursStart == AlertQuietHoursEnd:
+		return false
+	case AlertQuietHoursStart < AlertQuietHoursEnd:
+		return h >= AlertQuietHoursStart && h < AlertQuietHoursEnd
+	default:
+		return h >= AlertQuietHoursStart || h < AlertQuietHoursEnd
+	}
+}
+
+// send an alert, or hold it until the end of quiet hours
+func SendAlert(a *Alert) {
+	if inQuietHours(a.Ts) {
+		heldAlerts.lock.Lock()
+		heldAlerts.alerts = append(heldAlerts.alerts, a)
+		heldAlerts.lock.Unlock()
+		return
+	}
+	go deliverAlert(a)
+}
+
+// send any alerts held during quiet hours, if these have ended
+//
+// An AlertOffline followed by an AlertRecovered for the same receiver
+// cancel each other, so nobody is told about an outage that is already
+// over.
+func FlushAlerts(now time.Time) {
+	if inQuietHours(now) {
+		return
+	}
+	heldAlerts.lock.Lock()
+	alerts := heldAlerts.alerts
+	heldAlerts.alerts = nil
+	heldAlerts.lock.Unlock()
+	offline := make(map[Serno]int) // index of held AlertOffline by serno
+	drop := make(map[int]bool)
+	for i, a := range alerts {
+		switch a.Kind {
+		case AlertOffline:
+			offline[a.Serno] = i
+		case AlertRecovered:
+			if j, have := offline[a.Serno]; have {
+				drop[i], drop[j] = true, true
+				delete(offline, a.Serno)
+			}
+		}
+	}
+	for i, a := range alerts {
+		if !drop[i] {
+			go deliverAlert(a)
+		}
+	}
+}
+
+// split a comma-separated list of email addresses
+func splitEmails(s string) (addrs []string) {
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return
+}
+
+// parse a semicolon-separated list of PROJECTID:ADDR,ADDR,... entries
+// into addresses by motus project ID
+func parseProjectEmails(s string) (map[int][]string, error) {
+	emails := make(map[int][]string)
+	for _, f := range strings.Split(s, ";") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		parts := strings.SplitN(f, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("missing project ID in %q", f)
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid project ID in %q", f)
+		}
+		addrs := splitEmails(parts[1])
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses in %q", f)
+		}
+		emails[id] = append(emails[id], addrs...)
+	}
+	return emails, nil
+}
+
+// parse a list of addresses by project ID, exiting if it is invalid
+func mustParseProjectEmails(s string) map[int][]string {
+	emails, err := parseProjectEmails(s)
+	if err != nil {
+		log.Fatalf("invalid project email list %q: %s", s, err.Error())
+	}
+	return emails
+}
+
+// email addresses to which an alert should be sent
+func alertRecipients(a *Alert) (to []string) {
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if key := strings.ToLower(addr); !seen[key] {
+			seen[key] = true
+			to = append(to, addr)
+		}
+	}
+	for _, addr := range splitEmails(AlertEmailTo) {
+		add(addr)
+	}
+	if a.ProjectID != 0 {
+		for _, addr := range AlertProjectTo[a.ProjectID] {
+			add(addr)
+		}
+		for _, addr := range DB.ProjectEmails(a.ProjectID) {
+			add(addr)
+		}
+	}
+	return
+}
+
+// deliver an alert by email and webhook, as configured
+func deliverAlert(a *Alert) {
+	if to := alertRecipients(a); AlertSMTPRelay != "" && len(to) > 0 {
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n%s\r\n",
+			AlertEmailFrom, strings.Join(to, ", "), a.Subject(), a.Ts.Format(time.RFC1123Z), a.Text)
+		if err := smtp.SendMail(AlertSMTPRelay, nil, AlertEmailFrom, to, []byte(msg)); err != nil {
+			log.Printf("unable to email alert %q: %s\n", a.Subject(), err.Error())
+		}
+	}
+	if AlertWebhookURL != "" {
+		js, _ := json.Marshal(a)
+		client := &http.Client{Timeout: 30 * time.Second}
+		res, err := client.Post(AlertWebhookURL, "application/json", bytes.NewReader(js))
+		if err != nil {
+			log.Printf("unable to post alert %q: %s\n", a.Subject(), err.Error())
+			return
+		}
+		res.Body.Close()
+	}
+}
+
+// is a message topic synthetic, i.e. generated by this server rather
+// than sent by an SG?  Topics from SGs are letters.
+func isSyntheticTopic(t string) bool {
+	return len(t) == 1 && !(t[0] >= 'A' && t[0] <= 'Z' || t[0] >= 'a' && t[0] <= 'z')
+}
+
+// goroutine to alert people about receivers which go offline
+//
+// Also relays MsgSGMislocated, MsgSGClockBad, MsgSGBootLoop and
+// MsgSGNoTags messages as alerts.
+//
+// A receiver is offline if it has been disconnected, or has sent no
+// messages (see LivenessMonitor), for longer than `threshold`.
+// Receivers are checked every `interval`, and a recovery alert is
+// sent once an offline receiver connects or sends a message.
+func AlertManager(threshold, interval time.Duration) {
+	evt := Bus.Sub("*")
+	go func() {
+		defer evt.Unsub("*")
+		alerted := make(map[Serno]bool) // has an AlertOffline been sent?
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case msg, ok := <-evt.Msgs():
+				if !ok {
+					return
+				}
+				if msg.Msg == nil {
+					continue
+				}
+				t := string(msg.Topic)
+				m := msg.Msg.(SGMsg)
+				serno := Serno(m.sender)
+				switch t {
+				case MsgSGMislocated:
+					SendAlert(NewAlert(serno, AlertMislocated, strings.TrimPrefix(m.text, MsgSGMislocated+" ")))
+					continue
+				case MsgSGClockBad:
+					SendAlert(NewAlert(serno, AlertClock, string(serno)+" "+strings.TrimPrefix(m.text, MsgSGClockBad+" ")))
+					continue
+				case MsgSGBootLoop:
+					SendAlert(NewAlert(serno, AlertBootLoop, strings.TrimPrefix(m.text, MsgSGBootLoop+" ")))
+					continue
+				case MsgSGNoTags:
+					SendAlert(NewAlert(serno, AlertNoTags, strings.TrimPrefix(m.text, MsgSGNoTags+" ")))
+					continue
+				}
+				if t != MsgSGConnect && isSyntheticTopic(t) {
+					continue
+				}
+				ts := m.ts
+				if ts.IsZero() {
+					ts = time.Now()
+				}
+				if alerted[serno] {
+					delete(alerted, serno)
+					SendAlert(NewAlert(serno, AlertRecovered, fmt.Sprintf("%s is back online as of %s", serno, ts.Format(time.RFC1123))))
+				}
+			case now := <-tick.C:
+				activeSGs.Range(func(sno interface{}, sgp interface{}) bool {
+					serno := sno.(Serno)
+					if alerted[serno] {
+						return true
+					}
+					sg := sgp.(*ActiveSG)
+					sg.lock.Lock()
+					connected, tsDisConn, last := sg.Connected, sg.TsDisConn, sg.lastHeard()
+					sg.lock.Unlock()
+					var text string
+					if !connected && now.Sub(tsDisConn) > threshold {
+						text = fmt.Sprintf("%s has been disconnected since %s", serno, tsDisConn.Format(time.RFC1123))
+					} else if connected && now.Sub(last) > threshold {
+						text = fmt.Sprintf("%s is connected but has sent no messages since %s", serno, last.Format(time.RFC1123))
+					}
+					if text != "" {
+						alerted[serno] = true
+						SendAlert(NewAlert(serno, AlertOffline, text))
+					}
+					return true
+				})
+				FlushAlerts(now)
+			}
+		}
+	}()
+}
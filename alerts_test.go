@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseProjectEmails(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[int][]string
+		ok   bool
+	}{
+		{"", map[int][]string{}, true},
+		{"123:a@b.org", map[int][]string{123: {"a@b.org"}}, true},
+		{" 123 : a@b.org , c@d.org ; 456:e@f.org; ", map[int][]string{123: {"a@b.org", "c@d.org"}, 456: {"e@f.org"}}, true},
+		{"123:a@b.org;123:c@d.org", map[int][]string{123: {"a@b.org", "c@d.org"}}, true},
+		{"a@b.org", nil, false},
+		{"abc:a@b.org", nil, false},
+		{"0:a@b.org", nil, false},
+		{"123:", nil, false},
+		{"123: , ", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseProjectEmails(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseProjectEmails(%q): error %v, want ok=%v", tt.s, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseProjectEmails(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestAlertRecipients(t *testing.T) {
+	testDB(t)
+	saved := AlertProjectTo
+	defer func() { AlertProjectTo = saved }()
+	AlertProjectTo = mustParseProjectEmails("123:a@b.org,c@d.org;456:e@f.org")
+	expiry := time.Now().Add(time.Hour)
+	for i, u := range []*MotusUser{
+		{UserID: 1, Email: "C@D.org", ProjectIDs: map[int]bool{123: true}},
+		{UserID: 2, Email: "g@h.org", ProjectIDs: map[int]bool{123: true, 789: true}},
+		{UserID: 3, ProjectIDs: map[int]bool{789: true}},
+		{UserID: 4, Email: "i@j.org", ProjectIDs: map[int]bool{1234: true}},
+		// a user's projects are those of their last login
+		{UserID: 4, Email: "i@j.org", ProjectIDs: map[int]bool{12: true}},
+	} {
+		if err := DB.SaveSession(&UserToken{Token: fmt.Sprintf("token%d", i), UserID: u.UserID, Expiry: expiry}, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// users are still sent alerts once they have logged out
+	DB.DeleteSession("token1")
+	tests := []struct {
+		project int
+		want    []string
+	}{
+		{123, []string{"a@b.org", "c@d.org", "g@h.org"}},
+		{456, []string{"e@f.org"}},
+		{789, []string{"g@h.org"}},
+		{12, []string{"i@j.org"}},
+		{1234, nil},
+		{999, nil},
+		{0, nil},
+	}
+	for _, tt := range tests {
+		got := alertRecipients(&Alert{ProjectID: tt.project})
+		// AlertEmailTo comes first
+		got = got[len(splitEmails(AlertEmailTo)):]
+		if len(got) > 0 || len(tt.want) > 0 {
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("project %d: recipients %v, want %v", tt.project, got, tt.want)
+			}
+		}
+	}
+}
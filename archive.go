@@ -0,0 +1,277 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Archival
+//
+// DBRecorder keeps every message in the messages table, which would
+// otherwise grow without bound.  Messages of each topic listed in
+// MessageRetention are deleted once they are older than its retention
+// period, after being appended to a gzipped CSV file for the month in
+// which they were received, in ArchiveDir.  Topics not listed are kept
+// forever.  Tables derived from messages (gps_fixes, device_history,
+// machine_info, det_hourly) are not affected.
+//
+// MessageRetention is DefaultMessageRetention with the overrides in
+// MessageRetentionDays, or in the -retention option if given.
+
+const day = time.Hour * 24
+
+// how long messages of each topic are kept in the messages table,
+// unless overridden
+//
+// Connection and disconnection events are kept forever, since uptime
+// reports need them, as are deregistrations.
+var DefaultMessageRetention = map[string]time.Duration{
+	MsgSGSync:        day * 365,
+	MsgSGSyncPending: day * 30,
+	MsgSGActivate:    day * 90,
+	MsgSGSilent:      day * 365,
+	MsgSGMoved:       day * 365,
+	MsgSGMislocated:  day * 365,
+	MsgSGClockBad:    day * 365,
+	MsgSGReboot:      day * 365,
+	MsgSGBootLoop:    day * 365,
+	MsgSGNoTags:      day * 365,
+	MsgSGNewKey:      day * 365,
+	MsgGPS:           day * 90,
+	MsgMachineInfo:   day * 365,
+	MsgTimeSync:      day * 90,
+	MsgDeviceSetting: day * 180,
+	MsgDevAdded:      day * 365,
+	MsgDevRemoved:    day * 365,
+	MsgTag:           day * 180,
+}
+
+// parse a comma-separated list of TOPIC=DAYS overrides of
+// DefaultMessageRetention into retention periods by topic
+//
+// DAYS of 0 keeps messages of the topic forever.
+func parseRetention(s string) (map[string]time.Duration, error) {
+	keep := make(map[string]time.Duration, len(DefaultMessageRetention))
+	for topic, d := range DefaultMessageRetention {
+		keep[topic] = d
+	}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) != 1 {
+			return nil, fmt.Errorf("invalid retention %q; must be TOPIC=DAYS", f)
+		}
+		topic := strings.TrimSpace(parts[0])
+		days, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid number of days in %q", f)
+		}
+		if days == 0 {
+			delete(keep, topic)
+		} else {
+			keep[topic] = day * time.Duration(days)
+		}
+	}
+	return keep, nil
+}
+
+// parse a list of retention overrides, exiting if it is invalid
+func mustParseRetention(s string) map[string]time.Duration {
+	keep, err := parseRetention(s)
+	if err != nil {
+		log.Fatalf("invalid message retention %q: %s", s, err.Error())
+	}
+	return keep
+}
+
+// path to the archive file for messages received in the month
+// containing t
+func archivePath(dir string, t time.Time) string {
+	return filepath.Join(dir, "messages-"+t.UTC().Format("2006-01")+".csv.gz")
+}
+
+// append messages of one topic received in [from, to) to the archive
+// file for that month, and return the number archived
+//
+// from and to must be in the same month.  Each call appends a
+// separate gzip member to the file; gzip readers (and zcat) treat
+// these as a single stream.  The header line is only written when the
+// file is created, and the file is only created if there are messages
+// to archive.
+func archiveMessages(dir, topic string, from, to time.Time) (n int, err error) {
+	rows, err := SQLRows(DBQGetMsgsToArchive, c{topic, unixtime(from), unixtime(to)})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var (
+		f  *os.File
+		zw *gzip.Writer
+		cw *csv.Writer
+	)
+	for rows.Next() {
+		var (
+			ts     float64
+			sender string
+			msg    string
+		)
+		if err = rows.Scan(&ts, &sender, &msg); err != nil {
+			return 0, err
+		}
+		if f == nil {
+			path := archivePath(dir, from)
+			_, err = os.Stat(path)
+			isNew := os.IsNotExist(err)
+			if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640); err != nil {
+				return 0, err
+			}
+			defer f.Close()
+			zw = gzip.NewWriter(f)
+			cw = csv.NewWriter(zw)
+			if isNew {
+				cw.Write([]string{"ts", "sender", "message"})
+			}
+		}
+		cw.Write([]string{strconv.FormatFloat(ts, 'f', -1, 64), sender, msg})
+		n++
+	}
+	if err = rows.Err(); err != nil || f == nil {
+		return 0, err
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return 0, err
+	}
+	if err = zw.Close(); err != nil {
+		return 0, err
+	}
+	return n, f.Sync()
+}
+
+// archive and delete expired messages
+//
+// Messages are handled one topic and one month at a time, and are only
+// deleted once they have been written to the archive.  If deletion
+// fails, they will be archived again on the next run.
+func ArchiveExpiredMessages(dir string, now time.Time) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		log.Printf("unable to create archive directory: %s\n", err.Error())
+		return
+	}
+	total := 0
+	for topic, keep := range MessageRetention {
+		cutoff := now.Add(-keep)
+		var oldest float64
+		if !SQL(DBQGetOldestMsgOfType, c{topic}, c{&oldest}) || oldest == 0 || oldest >= unixtime(cutoff) {
+			continue
+		}
+		t := fromUnixtime(oldest).UTC()
+		from := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		for from.Before(cutoff) {
+			to := from.AddDate(0, 1, 0)
+			if to.After(cutoff) {
+				to = cutoff
+			}
+			n, err := archiveMessages(dir, topic, from, to)
+			if err != nil {
+				log.Printf("unable to archive messages of type %s from %s: %s\n", topic, from.Format("2006-01"), err.Error())
+				break
+			}
+			if n > 0 && !SQL(DBQDeleteArchived, c{topic, unixtime(from), unixtime(to)}, c{}) {
+				log.Printf("unable to delete archived messages of type %s from %s\n", topic, from.Format("2006-01"))
+				break
+			}
+			total += n
+			from = to
+		}
+	}
+	if total > 0 {
+		log.Printf("archived %d expired messages to %s\n", total, dir)
+	}
+	// return freed pages to the filesystem; PostgreSQL's autovacuum
+	// daemon does this by itself
+	if v, ok := DB.(vacuumStore); ok && !v.Vacuum() && total > 0 {
+		log.Printf("database is not in incremental auto_vacuum mode, so space freed by archiving is only reused, not returned; stop the server and run it once with -vacuum\n")
+	}
+}
+
+// return pages freed by deleting messages to the filesystem
+//
+// This only works if the database was created, or converted by
+// ConvertAutoVacuum(), in incremental auto_vacuum mode; returns false
+// if it wasn't.
+func (s *sqliteStore) Vacuum() bool {
+	var mode int
+	if s.db.QueryRow("PRAGMA auto_vacuum").Scan(&mode) != nil || mode != 2 {
+		return false
+	}
+	// incremental_vacuum frees pages as it is stepped, so read it to
+	// completion
+	if rows, err := s.db.Query("PRAGMA incremental_vacuum"); err == nil {
+		for rows.Next() {
+		}
+		rows.Close()
+	}
+	return true
+}
+
+// convert the sqlite database at `path` to incremental auto_vacuum
+// mode, so that ArchiveExpiredMessages can return the space it frees
+//
+// This must only be run while the server is stopped.  It rewrites the
+// whole database, which takes a while and needs as much free space
+// again, and does nothing to a database already in that mode.
+func ConvertAutoVacuum(path string) error {
+	s, err := openSQLStore(path)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// the pragma only applies to the connection VACUUM runs on
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var mode int
+	if err = conn.QueryRowContext(context.Background(), "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	if mode == 2 {
+		log.Printf("%s is already in incremental auto_vacuum mode\n", path)
+		return nil
+	}
+	for _, st := range []string{"PRAGMA auto_vacuum = INCREMENTAL", "VACUUM"} {
+		if _, err = conn.ExecContext(context.Background(), st); err != nil {
+			return fmt.Errorf("unable to convert %s: %s: %s", path, st, err.Error())
+		}
+	}
+	if err = conn.QueryRowContext(context.Background(), "PRAGMA auto_vacuum").Scan(&mode); err != nil || mode != 2 {
+		return fmt.Errorf("unable to convert %s: auto_vacuum mode is %d after vacuuming", path, mode)
+	}
+	log.Printf("converted %s to incremental auto_vacuum mode\n", path)
+	return nil
+}
+
+// goroutine to archive expired messages every `interval`
+func MessageArchiver(dir string, interval time.Duration) {
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			ArchiveExpiredMessages(dir, time.Now())
+			<-tick.C
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[string]time.Duration // differences from DefaultMessageRetention; 0 means not kept
+		ok   bool
+	}{
+		{"", nil, true},
+		{"p=365", map[string]time.Duration{MsgTag: 365 * day}, true},
+		{" p = 365 , G=30 ", map[string]time.Duration{MsgTag: 365 * day, MsgGPS: 30 * day}, true},
+		{"p=0", map[string]time.Duration{MsgTag: 0}, true},
+		{"1=10", map[string]time.Duration{MsgSGConnect: 10 * day}, true},
+		{"p", nil, false},
+		{"p=", nil, false},
+		{"p=-1", nil, false},
+		{"p=1.5", nil, false},
+		{"pp=30", nil, false},
+		{"=30", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRetention(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRetention(%q): error %v, want ok=%v", tt.s, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		want := make(map[string]time.Duration)
+		for topic, d := range DefaultMessageRetention {
+			want[topic] = d
+		}
+		for topic, d := range tt.want {
+			if d == 0 {
+				delete(want, topic)
+			} else {
+				want[topic] = d
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("parseRetention(%q) has %d topics, want %d", tt.s, len(got), len(want))
+		}
+		for topic, d := range want {
+			if got[topic] != d {
+				t.Errorf("parseRetention(%q)[%q] = %s, want %s", tt.s, topic, got[topic], d)
+			}
+		}
+	}
+	if _, err := parseRetention("p=1"); err != nil || DefaultMessageRetention[MsgTag] != 180*day {
+		t.Errorf("parseRetention changed DefaultMessageRetention")
+	}
+}
+
+func TestConvertAutoVacuum(t *testing.T) {
+	// a database created before incremental auto_vacuum mode was set
+	path := filepath.Join(t.TempDir(), "sg_remote.sqlite")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []string{
+		"CREATE TABLE messages (ts DOUBLE, sender TEXT, message TEXT)",
+		"INSERT INTO messages VALUES (1, 'SG-1234BBBK5678', 'p3,1441318337.5,TAG#1')",
+	} {
+		if _, err = db.Exec(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	s, err := openSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (&sqliteStore{s}).Vacuum() {
+		t.Error("vacuumed a database not in incremental auto_vacuum mode")
+	}
+	s.Close()
+	for i := 0; i < 2; i++ {
+		if err = ConvertAutoVacuum(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, err = openSQLStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if !(&sqliteStore{s}).Vacuum() {
+		t.Error("converted database not vacuumed")
+	}
+	s.Close()
+	if db, err = sql.Open("sqlite3", path); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mode, n int
+	db.QueryRow("PRAGMA auto_vacuum").Scan(&mode)
+	if mode != 2 {
+		t.Errorf("auto_vacuum mode %d after converting, want 2", mode)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&n)
+	if n != 1 {
+		t.Errorf("%d messages after converting, want 1", n)
+	}
+}
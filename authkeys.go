@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// authorized_keys
+//
+// sshd lets a receiver log in with its key only if the key has a line
+// in CryptoAuthKeysPath.  The line's options restrict the key to
+// mapping the receiver's own ports, and name the semaphore which sshd
+// holds while the receiver is connected (see ConnectionWatcher).
+// Edits to the file are serialized by authKeysLock, and are made by
+// writing a new file and renaming it over the old one, so sshd never
+// sees a partial file.
+//
+// Receivers' lines are kept in a managed block between authKeysBegin
+// and authKeysEnd; other lines, such as keys for people who
+// administer the server, are left alone.  ReconcileAuthKeys rewrites
+// the managed block from the receivers table, reporting any drift
+// between the two; this is done at startup, and by the status server's
+// `reconcile` command.
+
+// where receivers' public keys and authorized_keys are kept; these
+// are CryptoKeyPath and CryptoAuthKeysPath, except in tests
+var (
+	keyDir       = CryptoKeyPath
+	authKeysPath = CryptoAuthKeysPath
+)
+
+// guards authKeysPath
+var authKeysLock sync.Mutex
+
+// path to the PEM-encoded public key with which a receiver's datagram
+// signatures are verified
+func pemPath(serno Serno) string {
+	return filepath.Join(keyDir, "id_"+CryptoKeyType+"_"+string(serno)+".openssl.pub")
+}
+
+// lines marking the managed block
+const (
+	authKeysBegin = "# BEGIN sensorgnome receivers: managed by sensorgnomeServer; do not edit"
+	authKeysEnd   = "# END sensorgnome receivers"
+)
+
+// matches the serial number in a receiver's authorized_keys line
+var authKeySernoRE = regexp.MustCompile(`environment="SG_SERNO=([^"]*)"`)
+
+// the authorized_keys line for a receiver's key
+//
+// `semName` is the name of the connection semaphore; normally the
+// serial number.  `pubKey` is an OpenSSH public key, as stored in the
+// receivers table.  The key of a receiver which has not been verified
+// can't map its web port; it can still map its tunnel port, since an
+// authorized_keys line with no permitlisten option allows any, but the
+// server doesn't sync it.
+func authKeyLine(serno Serno, tunnelPort int, verified bool, pubKey, semName string) string {
+	listen := fmt.Sprintf(`permitlisten="localhost:%d"`, tunnelPort)
+	if verified {
+		listen += fmt.Sprintf(`,permitlisten="localhost:%d"`, webPortFromTunnelPort(tunnelPort))
+	}
+	return fmt.Sprintf(`command="/bin/true",no-pty,no-X11-forwarding,%s,permitopen="localhost:%s",environment="SG_SERNO=%s",environment="SG_PORT=%d",connection-semname="%s" %s`,
+		listen, TrustedStreamPort, string(serno), tunnelPort, semName, strings.TrimSuffix(pubKey, "\n")) + "\n"
+}
+
+// the base64 part of an OpenSSH public key, which identifies it in
+// authorized_keys lines regardless of options and comment
+func keyBlob(pubKey string) string {
+	if f := strings.Fields(pubKey); len(f) >= 2 {
+		return f[1]
+	}
+	return ""
+}
+
+// whether an authorized_keys line is for a public key
+func authKeyLineHasKey(line, pubKey string) bool {
+	blob := keyBlob(pubKey)
+	return blob != "" && strings.Contains(line, " "+blob)
+}
+
+// add a line to the managed block of authorized_keys, unless it is
+// already there
+func appendAuthKey(line string) error {
+	authKeysLock.Lock()
+	defer authKeysLock.Unlock()
+	lines, err := readAuthKeys()
+	if err != nil {
+		return err
+	}
+	before, managed, after := splitAuthKeys(lines)
+	line = strings.TrimSuffix(line, "\n")
+	for _, l := range managed {
+		if l == line {
+			return nil
+		}
+	}
+	managed = append(managed, line)
+	return replaceAuthKeys(joinAuthKeys(before, managed, after))
+}
+
+// read the lines of authorized_keys, without newlines; a missing file
+// has no lines
+//
+// Must be called with authKeysLock held.
+func readAuthKeys() (lines []string, err error) {
+	f, err := os.Open(authKeysPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	// lines with RSA keys and all their options are long
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scan.Scan() {
+		lines = append(lines, scan.Text())
+	}
+	return lines, scan.Err()
+}
+
+// split the lines of authorized_keys into those before, inside and
+// after the managed block; the markers are dropped
+//
+// If there is no managed block, all lines are before it.
+func splitAuthKeys(lines []string) (before, managed, after []string) {
+	i := 0
+	for ; i < len(lines) && lines[i] != authKeysBegin; i++ {
+		before = append(before, lines[i])
+	}
+	for i++; i < len(lines) && lines[i] != authKeysEnd; i++ {
+		managed = append(managed, lines[i])
+	}
+	if i < len(lines) {
+		after = lines[i+1:]
+	}
+	return
+}
+
+// join lines split by splitAuthKeys, restoring the markers
+func joinAuthKeys(before, managed, after []string) string {
+	var b strings.Builder
+	for _, ls := range [][]string{before, {authKeysBegin}, managed, {authKeysEnd}, after} {
+		for _, l := range ls {
+			b.WriteString(l + "\n")
+		}
+	}
+	return b.String()
+}
+
+// rewrite authorized_keys, line by line
+//
+// `edit` gets each line without its newline, and returns the
+// replacement, or "" to drop the line.  Returns the number of lines
+// changed or dropped.
+func editAuthKeys(edit func(line string) string) (n int, err error) {
+	authKeysLock.Lock()
+	defer authKeysLock.Unlock()
+	lines, err := readAuthKeys()
+	if err != nil {
+		return 0, err
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		out := edit(line)
+		if out != line {
+			n++
+		}
+		if out != "" {
+			b.WriteString(out + "\n")
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, replaceAuthKeys(b.String())
+}
+
+// atomically replace the contents of authorized_keys
+//
+// Must be called with authKeysLock held.
+func replaceAuthKeys(text string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(authKeysPath), ".authorized_keys")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.WriteString(text); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), authKeysPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// differences between authorized_keys and the receivers table
+type AuthKeysDrift struct {
+	Missing []Serno // receivers with keys in the database but no line
+	Changed []Serno // receivers whose lines have the wrong key or options
+	Extra   []Serno // receivers with lines but no keys in the database
+	Strays  int     // receivers' lines outside the managed block, or duplicated
+	Unknown int     // lines in the managed block which are not for any receiver
+}
+
+// whether there is any drift
+func (d *AuthKeysDrift) Any() bool {
+	return len(d.Missing)+len(d.Changed)+len(d.Extra)+d.Strays+d.Unknown > 0
+}
+
+// summarize drift, one line per kind
+func (d *AuthKeysDrift) String() string {
+	var b strings.Builder
+	for _, k := range []struct {
+		what   string
+		sernos []Serno
+	}{{"missing", d.Missing}, {"changed", d.Changed}, {"extra", d.Extra}} {
+		if len(k.sernos) > 0 {
+			fmt.Fprintf(&b, "%s: %d:", k.what, len(k.sernos))
+			for _, s := range k.sernos {
+				b.WriteString(" " + string(s))
+			}
+			b.WriteString("\n")
+		}
+	}
+	if d.Strays > 0 {
+		fmt.Fprintf(&b, "stray: %d receiver lines outside the managed block or duplicated\n", d.Strays)
+	}
+	if d.Unknown > 0 {
+		fmt.Fprintf(&b, "unknown: %d lines in the managed block not for any receiver\n", d.Unknown)
+	}
+	return b.String()
+}
+
+// the authorized_keys lines for registered receivers, by serial
+// number
+//
+// A receiver with a key rotation in progress has a second line, for
+// its new key.
+func wantedAuthKeys() (want map[Serno][]string, err error) {
+	rows, err := SQLRows(DBQGetAuthKeys, c{})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	want = make(map[Serno][]string)
+	for rows.Next() {
+		var (
+			serno          string
+			port           int
+			pubKey, newPub sql.NullString
+			verified       sql.NullInt64
+		)
+		if err = rows.Scan(&serno, &port, &pubKey, &newPub, &verified); err != nil {
+			return nil, err
+		}
+		if pubKey.String == "" {
+			continue
+		}
+		sn := Serno(serno)
+		want[sn] = append(want[sn], strings.TrimSuffix(authKeyLine(sn, port, verified.Int64 != 0, pubKey.String, serno), "\n"))
+		if newPub.String != "" {
+			want[sn] = append(want[sn], strings.TrimSuffix(authKeyLine(sn, port, verified.Int64 != 0, newPub.String, serno+newKeySemSuffix), "\n"))
+		}
+	}
+	return want, rows.Err()
+}
+
+// rewrite the managed block of authorized_keys from the receivers
+// table, and report how the file differed from it
+//
+// Receivers' lines found outside the managed block (e.g. appended by
+// an older version of this server) are moved into it; other lines
+// outside it are kept as they are.  If `check` is true, only the
+// drift is reported, and the file is not changed.  Refuses to remove
+// every receiver's line when the database has no registrations, since
+// that more likely means the wrong database than no receivers.
+func ReconcileAuthKeys(check bool) (drift AuthKeysDrift, err error) {
+	// the database is read with the lock held, so that a registration
+	// which is not in it yet will add its line after the file is
+	// rewritten
+	authKeysLock.Lock()
+	defer authKeysLock.Unlock()
+	want, err := wantedAuthKeys()
+	if err != nil {
+		return drift, err
+	}
+	lines, err := readAuthKeys()
+	if err != nil {
+		return drift, err
+	}
+	text, drift, err := reconcileAuthKeyLines(want, lines)
+	if err != nil {
+		return drift, err
+	}
+	if drift.Any() {
+		log.Printf("%s differs from the database:\n%s", authKeysPath, drift.String())
+	}
+	if check || text == strings.Join(lines, "\n")+"\n" {
+		return drift, nil
+	}
+	if err = replaceAuthKeys(text); err == nil {
+		log.Printf("rewrote %s from the database; %d receivers\n", authKeysPath, len(want))
+	}
+	return drift, err
+}
+
+// rebuild the lines of authorized_keys with the managed block holding
+// exactly the lines in `want`, and report how they differed from it
+//
+// See ReconcileAuthKeys.
+func reconcileAuthKeyLines(want map[Serno][]string, lines []string) (text string, drift AuthKeysDrift, err error) {
+	before, managed, after := splitAuthKeys(lines)
+
+	// receivers' lines, wherever they are
+	have := make(map[Serno][]string)
+	keep := func(ls []string) (kept []string) {
+		for _, l := range ls {
+			if m := authKeySernoRE.FindStringSubmatch(l); m != nil {
+				have[Serno(m[1])] = append(have[Serno(m[1])], l)
+				drift.Strays++
+			} else {
+				kept = append(kept, l)
+			}
+		}
+		return
+	}
+	before, after = keep(before), keep(after)
+	for _, l := range managed {
+		if m := authKeySernoRE.FindStringSubmatch(l); m != nil {
+			have[Serno(m[1])] = append(have[Serno(m[1])], l)
+		} else if strings.TrimSpace(l) != "" {
+			drift.Unknown++
+		}
+	}
+	if len(want) == 0 && len(have) > 0 {
+		return "", drift, fmt.Errorf("no receivers have keys in the database, but %s has lines for %d; not removing them", authKeysPath, len(have))
+	}
+
+	var sernos []Serno
+	for serno := range want {
+		sernos = append(sernos, serno)
+	}
+	sort.Slice(sernos, func(i, j int) bool { return sernos[i] < sernos[j] })
+	var block []string
+	for _, serno := range sernos {
+		w, h := want[serno], have[serno]
+		block = append(block, w...)
+		switch {
+		case len(h) == 0:
+			drift.Missing = append(drift.Missing, serno)
+		case !sameLines(w, h):
+			if len(h) > len(w) && sameLines(w, dedup(h)) {
+				drift.Strays += len(h) - len(w)
+			} else {
+				drift.Changed = append(drift.Changed, serno)
+			}
+		}
+	}
+	for serno := range have {
+		if _, ok := want[serno]; !ok {
+			drift.Extra = append(drift.Extra, serno)
+		}
+	}
+	sort.Slice(drift.Extra, func(i, j int) bool { return drift.Extra[i] < drift.Extra[j] })
+	return joinAuthKeys(before, block, after), drift, nil
+}
+
+// whether two lists have the same lines, in any order
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	n := make(map[string]int)
+	for _, l := range a {
+		n[l]++
+	}
+	for _, l := range b {
+		if n[l]--; n[l] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// the distinct lines of a list, in order
+func dedup(ls []string) (out []string) {
+	seen := make(map[string]bool)
+	for _, l := range ls {
+		if !seen[l] {
+			seen[l] = true
+			out = append(out, l)
+		}
+	}
+	return
+}
+
+// reply to a status server request to reconcile authorized_keys with
+// the database
+//
+// `words` are the words of the request: "reconcile" rewrites the file;
+// "reconcile check" only reports drift.
+func ReconcileReply(words []string) string {
+	check := len(words) == 2 && words[1] == "check"
+	if len(words) > 1 && !check {
+		return "Error: usage: " + words[0] + " [check]"
+	}
+	drift, err := ReconcileAuthKeys(check)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	switch {
+	case !drift.Any():
+		return "OK: no drift"
+	case check:
+		return drift.String()
+	}
+	return drift.String() + "OK: rewritten"
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyA = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAAAA sg@a"
+	testKeyB = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBBBB sg@b"
+	adminKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIADMN admin@server"
+)
+
+// a receiver's authorized_keys line, without the newline
+func testAuthKeyLine(serno Serno, port int, pubKey string) string {
+	return strings.TrimSuffix(authKeyLine(serno, port, true, pubKey, string(serno)), "\n")
+}
+
+func TestAuthKeyLine(t *testing.T) {
+	line := authKeyLine("SG-1234BBBK5678", 40001, false, testKeyA+"\n", "SG-1234BBBK5678")
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, testKeyA+"\n") {
+		t.Errorf("line doesn't end with the key and one newline: %q", line)
+	}
+	for _, want := range []string{`permitlisten="localhost:40001"`, `environment="SG_SERNO=SG-1234BBBK5678"`,
+		`environment="SG_PORT=40001"`, `connection-semname="SG-1234BBBK5678"`, "no-pty"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("line lacks %s: %q", want, line)
+		}
+	}
+	if strings.Contains(line, `permitlisten="localhost:50001"`) {
+		t.Errorf("unverified receiver may map its web port: %q", line)
+	}
+	if line = authKeyLine("SG-1234BBBK5678", 40001, true, testKeyA, "SG-1234BBBK5678"); !strings.Contains(line, `permitlisten="localhost:50001"`) {
+		t.Errorf("verified receiver may not map its web port: %q", line)
+	}
+	if m := authKeySernoRE.FindStringSubmatch(line); m == nil || m[1] != "SG-1234BBBK5678" {
+		t.Errorf("authKeySernoRE doesn't find the serial number in %q", line)
+	}
+	if !authKeyLineHasKey(line, testKeyA) || authKeyLineHasKey(line, testKeyB) || authKeyLineHasKey(line, "") {
+		t.Errorf("authKeyLineHasKey is wrong for %q", line)
+	}
+}
+
+func TestSplitJoinAuthKeys(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lines                  []string
+		before, managed, after []string
+	}{
+		{"empty", nil, nil, nil, nil},
+		{"no block", []string{"a", "b"}, []string{"a", "b"}, nil, nil},
+		{"block only", []string{authKeysBegin, "x", "y", authKeysEnd}, nil, []string{"x", "y"}, nil},
+		{"block in the middle", []string{"a", authKeysBegin, "x", authKeysEnd, "b", "c"},
+			[]string{"a"}, []string{"x"}, []string{"b", "c"}},
+		{"empty block", []string{"a", authKeysBegin, authKeysEnd}, []string{"a"}, nil, nil},
+		{"unterminated block", []string{"a", authKeysBegin, "x", "y"}, []string{"a"}, []string{"x", "y"}, nil},
+	}
+	for _, tt := range tests {
+		before, managed, after := splitAuthKeys(tt.lines)
+		if !sameSlice(before, tt.before) || !sameSlice(managed, tt.managed) || !sameSlice(after, tt.after) {
+			t.Errorf("%s: split into %q, %q, %q; want %q, %q, %q", tt.name, before, managed, after, tt.before, tt.managed, tt.after)
+			continue
+		}
+		// joining restores a file which had a complete block
+		text := joinAuthKeys(before, managed, after)
+		b2, m2, a2 := splitAuthKeys(strings.Split(strings.TrimSuffix(text, "\n"), "\n"))
+		if !sameSlice(b2, before) || !sameSlice(m2, managed) || !sameSlice(a2, after) {
+			t.Errorf("%s: join then split gives %q, %q, %q", tt.name, b2, m2, a2)
+		}
+	}
+}
+
+// whether two slices have the same elements, treating nil as empty
+func sameSlice(a, b []string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+func TestReconcileAuthKeyLines(t *testing.T) {
+	lineA := testAuthKeyLine("SG-1234BBBK5678", 40001, testKeyA)
+	lineB := testAuthKeyLine("SG-2234BBBK5678", 40002, testKeyB)
+	oldA := testAuthKeyLine("SG-1234BBBK5678", 40009, testKeyA)
+	want := map[Serno][]string{"SG-1234BBBK5678": {lineA}, "SG-2234BBBK5678": {lineB}}
+	clean := []string{adminKey, authKeysBegin, lineA, lineB, authKeysEnd}
+	tests := []struct {
+		name  string
+		want  map[Serno][]string
+		lines []string
+		text  []string // lines of the rewritten file
+		drift AuthKeysDrift
+		ok    bool
+	}{
+		{"in sync", want, clean, clean, AuthKeysDrift{}, true},
+		{"empty file", want, nil,
+			[]string{authKeysBegin, lineA, lineB, authKeysEnd}, AuthKeysDrift{Missing: []Serno{"SG-1234BBBK5678", "SG-2234BBBK5678"}}, true},
+		{"lines appended outside the block are moved into it", want, []string{adminKey, lineB, lineA},
+			[]string{adminKey, authKeysBegin, lineA, lineB, authKeysEnd}, AuthKeysDrift{Strays: 2}, true},
+		{"missing line", want, []string{adminKey, authKeysBegin, lineA, authKeysEnd},
+			clean, AuthKeysDrift{Missing: []Serno{"SG-2234BBBK5678"}}, true},
+		{"changed line", want, []string{adminKey, authKeysBegin, oldA, lineB, authKeysEnd},
+			clean, AuthKeysDrift{Changed: []Serno{"SG-1234BBBK5678"}}, true},
+		{"duplicated line", want, []string{adminKey, authKeysBegin, lineA, lineA, lineB, authKeysEnd},
+			clean, AuthKeysDrift{Strays: 1}, true},
+		{"extra receiver", map[Serno][]string{"SG-1234BBBK5678": {lineA}}, clean,
+			[]string{adminKey, authKeysBegin, lineA, authKeysEnd}, AuthKeysDrift{Extra: []Serno{"SG-2234BBBK5678"}}, true},
+		{"unknown line in the block", want, []string{adminKey, authKeysBegin, lineA, "# note", lineB, authKeysEnd},
+			clean, AuthKeysDrift{Unknown: 1}, true},
+		{"blank lines in the block are dropped", want, []string{adminKey, authKeysBegin, lineA, "", lineB, authKeysEnd},
+			clean, AuthKeysDrift{}, true},
+		{"lines after the block are kept", want, append(clean, "# trailer"),
+			append(clean, "# trailer"), AuthKeysDrift{}, true},
+		{"no receivers in the database", map[Serno][]string{}, clean, nil, AuthKeysDrift{}, false},
+		{"no receivers anywhere", map[Serno][]string{}, []string{adminKey},
+			[]string{adminKey, authKeysBegin, authKeysEnd}, AuthKeysDrift{}, true},
+	}
+	for _, tt := range tests {
+		text, drift, err := reconcileAuthKeyLines(tt.want, tt.lines)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if wantText := strings.Join(tt.text, "\n") + "\n"; text != wantText {
+			t.Errorf("%s: rewrote to\n%s\nwant\n%s", tt.name, text, wantText)
+		}
+		if drift.Any() != tt.drift.Any() || drift.String() != tt.drift.String() {
+			t.Errorf("%s: drift %q, want %q", tt.name, drift.String(), tt.drift.String())
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Backups
+//
+// The database holds every receiver's tunnel port and keys, so losing
+// it would mean re-registering the whole fleet in the field.  Every
+// BackupInterval, DBBackup writes a snapshot of it to BackupDir, using
+// sqlite's online backup API, which gives a consistent copy while the
+// server keeps running.  Snapshots are named by the time they were
+// taken, and all but the newest BackupKeep are deleted.
+//
+// A snapshot is restored with `sensorgnomeServer -restore SNAPSHOT`
+// while the server is stopped; see RestoreDB().
+//
+// PostgreSQL databases are not backed up this way; use pg_dump.
+
+// prefix and suffix of snapshot file names; the time the snapshot was
+// taken goes in between
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".sqlite"
+)
+
+// write a consistent copy of the database to a new file at `path`
+//
+// The whole database is copied in one step, so writers wait (at most
+// the busy timeout) until the copy is done; copying in smaller steps
+// would let them in, but any write restarts the copy, and messages are
+// written every DBBatchInterval.
+func (s *sqliteStore) Backup(path string) error {
+	dst, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	ctx := context.Background()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return dstConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			b, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err = b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// check that a file is a usable snapshot of the database
+//
+// The file must pass sqlite's integrity check, and have a schema no
+// newer than this server's.  Returns the number of registered
+// receivers it holds.
+func validateSnapshot(path string) (nReceivers int, err error) {
+	if _, err = os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var check string
+	if err = db.QueryRow("PRAGMA integrity_check").Scan(&check); err != nil {
+		return 0, err
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("%s fails integrity check: %s", path, check)
+	}
+	s := &sqlStore{db: db, dialect: "sqlite3"}
+	if _, err = s.pendingMigrations(); err != nil {
+		return 0, err
+	}
+	if err = db.QueryRow("SELECT COUNT(*) FROM receivers").Scan(&nReceivers); err != nil {
+		return 0, fmt.Errorf("%s has no receivers table: %s", path, err.Error())
+	}
+	return nReceivers, nil
+}
+
+// write a snapshot of the database to `dir`, then delete all but the
+// newest `keep` snapshots there
+//
+// The snapshot is written to a temporary file, and only given its
+// final name once it has been validated, so an interrupted backup
+// never looks like a good one.  Returns the path to the snapshot.
+func BackupDB(dir string, keep int, now time.Time) (path string, err error) {
+	b, ok := DB.(snapshotStore)
+	if !ok {
+		return "", fmt.Errorf("online backup is only supported for sqlite databases; use pg_dump")
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path = filepath.Join(dir, snapshotPrefix+now.UTC().Format("20060102T150405Z")+snapshotSuffix)
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err = b.Backup(tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	// the snapshot holds private keys
+	os.Chmod(tmp, 0600)
+	if _, err = validateSnapshot(tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	snaps, _ := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"+snapshotSuffix))
+	// names sort in the order the snapshots were taken
+	sort.Strings(snaps)
+	for len(snaps) > keep {
+		if err := os.Remove(snaps[0]); err != nil {
+			log.Printf("unable to delete old snapshot: %s\n", err.Error())
+		}
+		snaps = snaps[1:]
+	}
+	return path, nil
+}
+
+// goroutine to snapshot the database every `interval`, keeping the
+// newest `keep` snapshots in `dir`
+func DBBackup(dir string, interval time.Duration, keep int) {
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			path, err := BackupDB(dir, keep, time.Now())
+			if err != nil {
+				log.Printf("unable to back up database: %s\n", err.Error())
+			} else {
+				log.Printf("backed up database to %s\n", path)
+			}
+			<-tick.C
+		}
+	}()
+}
+
+// copy a file, creating `dst` with permissions `perm`
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// replace the sqlite database at `path` with a snapshot
+//
+// This must only be run while the server is stopped.  The snapshot is
+// validated first, and the database is left untouched if it is not
+// usable.  The database being replaced is kept alongside it, with the
+// suffix .pre-restore-TIMESTAMP.  The restored database has its schema
+// migrated, if necessary, the next time the server starts.
+func RestoreDB(snapshot, path string) error {
+	n, err := validateSnapshot(snapshot)
+	if err != nil {
+		return fmt.Errorf("not restoring: %s", err.Error())
+	}
+	// a journal left by a running or crashed server would be applied
+	// to the restored database, corrupting it
+	for _, j := range []string{path + "-journal", path + "-wal"} {
+		if _, err := os.Stat(j); err == nil {
+			return fmt.Errorf("not restoring: %s exists; stop the server, or if it has crashed, open the database once with sqlite3 to recover it", j)
+		}
+	}
+	tmp := path + ".restoring"
+	if err = copyFile(snapshot, tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if _, err = os.Stat(path); err == nil {
+		old := path + ".pre-restore-" + time.Now().UTC().Format("20060102T150405Z")
+		if err = os.Rename(path, old); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		log.Printf("kept previous database as %s\n", old)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Printf("restored %s from %s, with %d receivers\n", path, snapshot, n)
+	return nil
+}
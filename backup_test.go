@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupDB(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testRegister(t, "SG-1234BBBK5678", true)
+	dir := filepath.Join(t.TempDir(), "backups")
+	t0 := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path, err := BackupDB(dir, 2, t0.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	if filepath.Base(paths[0]) != "snapshot-20190501T000000Z.sqlite" {
+		t.Errorf("snapshot named %s", filepath.Base(paths[0]))
+	}
+	snaps, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(snaps) != 2 || snaps[0] != paths[1] || snaps[1] != paths[2] {
+		t.Errorf("kept %v, want the newest 2 of %v", snaps, paths)
+	}
+	if fi, err := os.Stat(paths[2]); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("snapshot readable by others: %v", err)
+	}
+	if n, err := validateSnapshot(paths[2]); err != nil || n != 1 {
+		t.Errorf("snapshot holds %d receivers (%v), want 1", n, err)
+	}
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := validateSnapshot(filepath.Join(dir, "missing.sqlite")); err == nil {
+		t.Error("missing snapshot validated")
+	}
+	garbage := filepath.Join(dir, "garbage.sqlite")
+	ioutil.WriteFile(garbage, []byte(strings.Repeat("not a database ", 1000)), 0600)
+	if _, err := validateSnapshot(garbage); err == nil {
+		t.Error("garbage snapshot validated")
+	}
+	empty := filepath.Join(dir, "empty.sqlite")
+	s, err := openSQLStore(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.Exec("CREATE TABLE messages (ts DOUBLE)")
+	s.Close()
+	if _, err := validateSnapshot(empty); err == nil {
+		t.Error("snapshot with no receivers table validated")
+	}
+	newer := filepath.Join(dir, "newer.sqlite")
+	s, err = openSQLStore(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	s.db.Exec("INSERT INTO schema_version (version, name, ts) VALUES (?, 'from the future', 0)", dbMigrations[len(dbMigrations)-1].version+1)
+	s.Close()
+	if _, err := validateSnapshot(newer); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("snapshot with a newer schema validated: %v", err)
+	}
+}
+
+func TestRestoreDB(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testRegister(t, "SG-1234BBBK5678", true)
+	testRegister(t, "SG-5678BBBK1234", true)
+	snapshot, err := BackupDB(filepath.Join(t.TempDir(), "backups"), 1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sg_remote.sqlite")
+	ioutil.WriteFile(path, []byte("the old database"), 0600)
+
+	garbage := filepath.Join(dir, "garbage.sqlite")
+	ioutil.WriteFile(garbage, []byte(strings.Repeat("not a database ", 1000)), 0600)
+	if err := RestoreDB(garbage, path); err == nil {
+		t.Error("restored an invalid snapshot")
+	}
+	if buf, _ := ioutil.ReadFile(path); string(buf) != "the old database" {
+		t.Error("database changed by a refused restore")
+	}
+
+	ioutil.WriteFile(path+"-journal", nil, 0600)
+	if err := RestoreDB(snapshot, path); err == nil || !strings.Contains(err.Error(), "-journal exists") {
+		t.Errorf("restored over a journal: %v", err)
+	}
+	os.Remove(path + "-journal")
+
+	if err := RestoreDB(snapshot, path); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := validateSnapshot(path); err != nil || n != 2 {
+		t.Errorf("restored database holds %d receivers (%v), want 2", n, err)
+	}
+	old, _ := filepath.Glob(path + ".pre-restore-*")
+	if len(old) != 1 {
+		t.Fatalf("previous database kept as %v", old)
+	}
+	if buf, _ := ioutil.ReadFile(old[0]); string(buf) != "the old database" {
+		t.Error("previous database not kept")
+	}
+	if _, err := os.Stat(path + ".restoring"); err == nil {
+		t.Error("temporary file left behind")
+	}
+}
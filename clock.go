@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jbrzusto/mbus"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a time sync, parsed from the text of a MsgTimeSync message
+//
+// The SG sends one of these whenever it sets its clock, as a line like
+//
+//	C,1441318337.123,0.000001
+//
+// i.e. the receiver's clock reading (seconds since the epoch) and the
+// estimated precision of the clock (seconds); this is small when the
+// clock has been set from GPS.
+type TimeSync struct {
+	Ts   float64 // receiver clock reading
+	Prec float64 // precision of receiver clock, in seconds
+}
+
+// parse a time sync from the text of a MsgTimeSync message
+//
+// returns false if the message text is not a valid time sync.
+func ParseTimeSync(text string) (t TimeSync, ok bool) {
+	parts := strings.Split(strings.TrimSpace(text), ",")
+	if len(parts) < 3 || parts[0] != MsgTimeSync {
+		return
+	}
+	var err error
+	if t.Ts, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	if t.Prec, err = strconv.ParseFloat(parts[2], 64); err != nil {
+		return
+	}
+	return t, true
+}
+
+// state of a receiver's clock
+type ClockStatus struct {
+	Ts       time.Time // server time at which the most recent time sync was received
+	Offset   float64   // server receipt time minus receiver clock reading, in seconds
+	Drift    float64   // rate of change of Offset between the last two time syncs, in parts per million
+	Prec     float64   // precision of receiver clock, in seconds
+	Locked   bool      // is the receiver clock locked to GPS time?
+	Unsynced bool      // is Offset too large?
+}
+
+// record a time sync received from an SG at server time `ts`,
+// returning its new clock status and the one it replaces, if any
+//
+// `maxOffset` and `lockPrec` are as for ClockMonitor.  The caller must
+// hold the lock on the SG.
+func (sg *ActiveSG) updateClock(tsync TimeSync, ts time.Time, maxOffset, lockPrec float64) (cs, prev *ClockStatus) {
+	cs = &ClockStatus{Ts: ts, Offset: unixtime(ts) - tsync.Ts, Prec: tsync.Prec}
+	cs.Locked = cs.Prec <= lockPrec
+	cs.Unsynced = math.Abs(cs.Offset) > maxOffset
+	prev = sg.Clock
+	if prev != nil {
+		if dt := cs.Ts.Sub(prev.Ts).Seconds(); dt > 0 {
+			cs.Drift = 1e6 * (cs.Offset - prev.Offset) / dt
+		}
+	}
+	sg.Clock = cs
+	return
+}
+
+// goroutine to monitor receiver clocks
+//
+// Each time sync from a receiver is compared to the time at which the
+// server received it.  A receiver whose clock differs from ours by
+// more than `maxOffset` seconds is flagged as Unsynced, and an
+// MsgSGClockBad message is published.  A receiver whose clock
+// precision is at most `lockPrec` seconds is taken to be locked to
+// GPS time.
+func ClockMonitor(maxOffset, lockPrec float64) {
+	evt := Bus.Sub(MsgTimeSync)
+	go func() {
+		defer evt.Unsub("*")
+		for msg := range evt.Msgs() {
+			m := msg.Msg.(SGMsg)
+			tsync, ok := ParseTimeSync(m.text)
+			if !ok {
+				continue
+			}
+			sgp, ok := activeSGs.Load(Serno(m.sender))
+			if !ok {
+				continue
+			}
+			sg := sgp.(*ActiveSG)
+			sg.lock.Lock()
+			cs, prev := sg.updateClock(tsync, m.ts, maxOffset, lockPrec)
+			sg.lock.Unlock()
+			wasUnsynced := prev != nil && prev.Unsynced
+			if cs.Unsynced && !wasUnsynced {
+				text := fmt.Sprintf("%s clock is off by %.1f s (precision %g s)", MsgSGClockBad, cs.Offset, cs.Prec)
+				Bus.Pub(mbus.Msg{MsgSGClockBad, SGMsg{ts: m.ts, sender: m.sender, text: text}})
+			}
+			if cs.Unsynced != wasUnsynced || prev == nil || cs.Locked != prev.Locked {
+				Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+			}
+		}
+	}()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseTimeSync(t *testing.T) {
+	tests := []struct {
+		text string
+		want TimeSync
+		ok   bool
+	}{
+		{"C,1441318337.123,0.000001\n", TimeSync{1441318337.123, 0.000001}, true},
+		{"C,1441318337,1,extra", TimeSync{1441318337, 1}, true},
+		{"C,1441318337", TimeSync{}, false},
+		{"C,now,0.1", TimeSync{}, false},
+		{"C,1441318337,fine", TimeSync{}, false},
+		{"G,1441318337,0.1", TimeSync{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseTimeSync(tt.text)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("ParseTimeSync(%q) = %v, %v; want %v, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestUpdateClock(t *testing.T) {
+	const (
+		maxOffset = 10
+		lockPrec  = 0.001
+	)
+	sg := &ActiveSG{}
+	t0 := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	// the first sync, from a GPS-locked clock 2 s behind ours
+	cs, prev := sg.updateClock(TimeSync{unixtime(t0) - 2, 1e-6}, t0, maxOffset, lockPrec)
+	if prev != nil || sg.Clock != cs {
+		t.Fatal("first clock status not recorded")
+	}
+	if cs.Offset != 2 || !cs.Locked || cs.Unsynced || cs.Drift != 0 {
+		t.Errorf("first sync: %+v", *cs)
+	}
+
+	// 1000 s later, the clock has fallen another 0.01 s behind, and
+	// lost GPS lock
+	t1 := t0.Add(1000 * time.Second)
+	cs, prev = sg.updateClock(TimeSync{unixtime(t1) - 2.01, 0.5}, t1, maxOffset, lockPrec)
+	if prev == nil || prev.Offset != 2 {
+		t.Fatalf("previous status %v, want the first one", prev)
+	}
+	if math.Abs(cs.Drift-10) > 1e-3 || cs.Locked || cs.Unsynced {
+		t.Errorf("second sync: %+v; want drift 10 ppm, unlocked", *cs)
+	}
+
+	// a clock which is far off, either way, is unsynced
+	for _, off := range []float64{maxOffset + 1, -maxOffset - 1} {
+		cs, _ = sg.updateClock(TimeSync{unixtime(t1) - off, 1e-6}, t1, maxOffset, lockPrec)
+		if !cs.Unsynced {
+			t.Errorf("offset %g s not unsynced", off)
+		}
+		// no drift is computed from two syncs at the same time
+		if cs.Drift != 0 {
+			t.Errorf("drift %g from syncs at the same time", cs.Drift)
+		}
+	}
+}
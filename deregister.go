@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jbrzusto/mbus"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Deregistration
+//
+// A decommissioned or stolen receiver is deregistered so that its keys
+// no longer work.  Its row in the receivers table is moved to
+// deleted_receivers, which frees its tunnel port for reuse by the next
+// receiver to register, and its keys are removed from authorized_keys.
+// Its web session is ended, and MsgSGDeregister is published, on
+// which SyncManager stops its SyncWorker.  If it is connected, the
+// processes holding its connection semaphore (i.e. its sshd session)
+// are sent SIGTERM, which drops the connection.
+//
+// A deregistered receiver, which may be in the wrong hands, is refused
+// by the registration server until an admin clears it with the status
+// server's `deregister clear` command; otherwise it could register
+// again at once and get new keys.
+//
+// Deregistration is done by the status server's `deregister` command,
+// or by an administrator through the web API at /admin/deregister.
+
+// deregister a receiver
+func DeregisterSG(serno Serno) error {
+	reg, ok := DB.GetRegistration(serno)
+	if !ok {
+		return fmt.Errorf("%s is not registered", serno)
+	}
+	// a key issued by a key rotation in progress must also be revoked
+	var (
+		newPub, newPriv string
+		ts              float64
+	)
+	SQL(DBQGetRotation, c{serno}, c{&newPub, &newPriv, &ts})
+	if err := DB.DeleteRegistration(serno); err != nil {
+		return err
+	}
+	env := `environment="SG_SERNO=` + string(serno) + `"`
+	if _, err := editAuthKeys(func(line string) string {
+		if authKeyLineHasKey(line, reg.pubKey) || authKeyLineHasKey(line, newPub) || strings.Contains(line, env) {
+			return ""
+		}
+		return line
+	}); err != nil {
+		log.Printf("unable to remove keys of %s from %s: %s\n", serno, authKeysPath, err.Error())
+	}
+	if pems, err := filepath.Glob(filepath.Join(keyDir, "id_*_"+string(serno)+".openssl.pub")); err == nil {
+		for _, p := range pems {
+			os.Remove(p)
+		}
+	}
+	if sgp, ok := activeSGs.Load(serno); ok {
+		sg := sgp.(*ActiveSG)
+		sg.lock.Lock()
+		sg.WebUser = 0
+		sg.lock.Unlock()
+	}
+	sessLock.Lock()
+	delete(SernoToSess, serno)
+	sessLock.Unlock()
+	Bus.Pub(mbus.Msg{MsgSGDeregister, SGMsg{ts: time.Now(), sender: string(serno), text: fmt.Sprintf("%s %s deregistered; tunnel port %d freed", MsgSGDeregister, serno, reg.tunnelPort)}})
+	if n := killConnection(serno); n > 0 {
+		log.Printf("terminated %d connection processes of %s\n", n, serno)
+	}
+	log.Printf("deregistered %s\n", serno)
+	return nil
+}
+
+// get when a receiver was deregistered, if it was and has not been
+// cleared since
+func deregisteredAt(serno Serno) (ts time.Time, ok bool) {
+	var t float64
+	if !SQL(DBQGetDeregistered, c{serno}, c{&t}) {
+		return
+	}
+	return fromUnixtime(t), true
+}
+
+// let a deregistered receiver register again
+func ClearDeregistration(serno Serno) error {
+	if _, ok := deregisteredAt(serno); !ok {
+		return fmt.Errorf("%s is not deregistered", serno)
+	}
+	if !SQL(DBQClearDeregistered, c{unixtime(time.Now()), serno}, c{}) {
+		return fmt.Errorf("unable to clear deregistration of %s", serno)
+	}
+	log.Printf("cleared deregistration of %s\n", serno)
+	return nil
+}
+
+// send SIGTERM to processes holding a receiver's connection semaphore,
+// and return how many there were
+//
+// sshd maps the semaphore named by the connection-semname option of
+// the receiver's key for as long as the receiver is connected, so the
+// processes are found by looking for it in /proc/PID/maps.  The
+// semaphores for both the receiver's key and any new key from a key
+// rotation are looked for.
+func killConnection(serno Serno) (n int) {
+	sems := [][]byte{
+		[]byte(filepath.Join(ConnectionSemPath, "sem."+string(serno)) + "\n"),
+		[]byte(filepath.Join(ConnectionSemPath, "sem."+string(serno)+newKeySemSuffix) + "\n"),
+	}
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		maps, err := ioutil.ReadFile(filepath.Join("/proc", p.Name(), "maps"))
+		if err != nil {
+			continue
+		}
+		for _, sem := range sems {
+			if bytes.Contains(maps, sem) {
+				if syscall.Kill(pid, syscall.SIGTERM) == nil {
+					n++
+				}
+				break
+			}
+		}
+	}
+	return
+}
+
+// reply to a status server request to deregister a receiver
+//
+// `words` are the words of the request: "deregister SERNO", or
+// "deregister clear SERNO" to let a deregistered receiver register
+// again.
+func DeregisterReply(words []string) string {
+	if len(words) == 3 && words[1] == "clear" {
+		serno := lookupSerno(words[2])
+		if serno == "" {
+			return "Error: invalid serial number " + words[2]
+		}
+		if err := ClearDeregistration(serno); err != nil {
+			return "Error: " + err.Error()
+		}
+		return "OK: " + string(serno) + " may register again"
+	}
+	if len(words) != 2 {
+		return "Error: usage: " + words[0] + " [clear] SERNO"
+	}
+	serno := lookupSerno(words[1])
+	if serno == "" {
+		return "Error: invalid serial number " + words[1]
+	}
+	if err := DeregisterSG(serno); err != nil {
+		return "Error: " + err.Error()
+	}
+	return "OK: " + string(serno) + " deregistered"
+}
+
+// get the token of an administrator making a request
+//
+// returns nil if the user is not logged in, or is not a motus
+// administrator.
+func adminToken(r *http.Request) *UserToken {
+	token := requestToken(r)
+	if token == nil {
+		return nil
+	}
+	if user := MotusInfo.User(token.UserID); user == nil || !user.IsAdmin {
+		return nil
+	}
+	return token
+}
+
+// deregister a receiver through the web API
+//
+// The request is a POST to /admin/deregister with a `serno` form
+// field and the csrfHeader header, by a motus administrator.
+func DeregisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "400 - deregistration requires POST", http.StatusBadRequest)
+		return
+	}
+	if !checkCSRF(w, r) {
+		return
+	}
+	token := adminToken(r)
+	if token == nil {
+		http.Error(w, "401 - motus administrator login required", http.StatusUnauthorized)
+		return
+	}
+	serno := lookupSerno(r.FormValue("serno"))
+	if serno == "" {
+		http.Error(w, "400 - invalid serial number", http.StatusBadRequest)
+		return
+	}
+	if err := DeregisterSG(serno); err != nil {
+		http.Error(w, "404 - "+err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("%s deregistered by user %d\n", serno, token.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
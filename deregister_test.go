@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDeregisterSG(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	pub := testRegister(t, "SG-1234BBBK5678", true)
+	other := testRegister(t, "SG-5678BBBK1234", true)
+
+	if err := DeregisterSG("SG-1234BBBK5678"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := DB.GetRegistration("SG-1234BBBK5678"); ok {
+		t.Error("still registered after deregistration")
+	}
+	if lines := testAuthKeyLines(t, pub); len(lines) != 0 {
+		t.Errorf("key still in authorized_keys: %q", lines)
+	}
+	if lines := testAuthKeyLines(t, other); len(lines) != 1 {
+		t.Errorf("another receiver's key was removed: %q", lines)
+	}
+	if _, ok := deregisteredAt("SG-1234BBBK5678"); !ok {
+		t.Error("deregistration not recorded")
+	}
+	if err := DeregisterSG("SG-1234BBBK5678"); err == nil {
+		t.Error("deregistered twice")
+	}
+	if err := ClearDeregistration("SG-1234BBBK5678"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := deregisteredAt("SG-1234BBBK5678"); ok {
+		t.Error("still deregistered after clearing")
+	}
+}
+
+func TestDeregisterLegacySerno(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	pub := testRegister(t, "SG-SG-1234BBBK5678", true)
+
+	for _, s := range []string{"SG-1234BBBK5678", "SG-SG-1234BBBK5678"} {
+		if got := lookupSerno(s); got != "SG-SG-1234BBBK5678" {
+			t.Errorf("lookupSerno(%q) = %q, want SG-SG-1234BBBK5678", s, got)
+		}
+	}
+	if got := lookupSerno("SG-5678BBBK1234"); got != "SG-5678BBBK1234" {
+		t.Errorf("lookupSerno of an unknown receiver = %q, want SG-5678BBBK1234", got)
+	}
+
+	if r := DeregisterReply([]string{"deregister", "SG-1234BBBK5678"}); r != "OK: SG-SG-1234BBBK5678 deregistered" {
+		t.Fatalf("deregister: %q", r)
+	}
+	if lines := testAuthKeyLines(t, pub); len(lines) != 0 {
+		t.Errorf("key still in authorized_keys: %q", lines)
+	}
+	if r := DeregisterReply([]string{"deregister", "clear", "SG-1234BBBK5678"}); r != "OK: SG-SG-1234BBBK5678 may register again" {
+		t.Errorf("deregister clear: %q", r)
+	}
+}
+
+func TestDeregisterHandler(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMotus(t, nil)
+	testRegister(t, "SG-SG-1234BBBK5678", true)
+	admin := testLogin(t, &MotusUser{UserID: 1, Email: "admin@example.org", IsAdmin: true})
+	user := testLogin(t, &MotusUser{UserID: 2, Email: "user@example.org"})
+
+	post := func(cookie *http.Cookie, csrf bool, serno string) int {
+		req := httptest.NewRequest("POST", "/admin/deregister", strings.NewReader(url.Values{"serno": {serno}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if csrf {
+			req.Header.Set(csrfHeader, "1")
+		}
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		DeregisterHandler(w, req)
+		return w.Code
+	}
+	if code := post(admin, false, "SG-1234BBBK5678"); code != http.StatusForbidden {
+		t.Errorf("without %s header: status %d, want 403", csrfHeader, code)
+	}
+	if code := post(user, true, "SG-1234BBBK5678"); code != http.StatusUnauthorized {
+		t.Errorf("by non-admin: status %d, want 401", code)
+	}
+	if code := post(admin, true, "bogus"); code != http.StatusBadRequest {
+		t.Errorf("invalid serial number: status %d, want 400", code)
+	}
+	if code := post(admin, true, "SG-1234BBBK5678"); code != http.StatusNoContent {
+		t.Errorf("by admin: status %d, want 204", code)
+	}
+	if _, ok := DB.GetRegistration("SG-SG-1234BBBK5678"); ok {
+		t.Error("legacy receiver still registered")
+	}
+	if code := post(admin, true, "SG-1234BBBK5678"); code != http.StatusNotFound {
+		t.Errorf("deregistered twice: status %d, want 404", code)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/jbrzusto/mbus"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Detection statistics
+//
+// Tag detections are counted by receiver, hour, antenna port and tag
+// ID in the det_hourly table.  Counts are accumulated in memory and
+// added to the table every `flush`, so that a busy receiver doesn't
+// cost one database write per detection.  Counts by receiver or by
+// port are sums over this table.
+
+// key for an hourly detection count
+type detCountKey struct {
+	serno Serno
+	hour  int64 // start of hour, in seconds since the epoch
+	port  int
+	tagID string
+}
+
+// time of the most recent detection by a receiver, from the database
+//
+// Returns the zero time if the receiver has never made a detection.
+func LastDetection(serno Serno) time.Time {
+	var (
+		ts  float64
+		msg string
+	)
+	if SQL(DBQGetLastMsgOfType, c{serno, MsgTag}, c{&ts, &msg}) {
+		return fromUnixtime(ts)
+	}
+	return time.Time{}
+}
+
+// record a detection by an SG at `ts`, clearing its NoTags flag;
+// returns whether it was set
+//
+// The caller must hold the lock on the SG.
+func (sg *ActiveSG) detected(ts time.Time) (wasFlagged bool) {
+	sg.TsLastDet = ts
+	wasFlagged = sg.NoTags
+	sg.NoTags = false
+	return
+}
+
+// flag an SG as NoTags if it is connected and has made no detection
+// for longer than `threshold` before `now`; returns the time since
+// which it has made none, and whether it was newly flagged
+//
+// A receiver which has never detected anything is measured from when
+// it connected.  The caller must hold the lock on the SG.
+func (sg *ActiveSG) checkNoTags(now time.Time, threshold time.Duration) (since time.Time, flag bool) {
+	since = sg.TsLastDet
+	if since.IsZero() {
+		since = sg.TsConn
+	}
+	if !sg.Connected || sg.NoTags || now.Sub(since) <= threshold {
+		return since, false
+	}
+	sg.NoTags = true
+	return since, true
+}
+
+// goroutine to keep detection statistics and flag receivers which
+// have stopped detecting tags
+//
+// Detections are counted as described above.  Every `flush`, counts
+// are written to the det_hourly table, and any connected receiver
+// which has made no detection on any port for longer than `threshold`
+// is flagged as NoTags, and an MsgSGNoTags message is
+// published.  This usually means a failed antenna or cable.  The flag
+// is cleared by the receiver's next detection.
+func DetectionStats(threshold, flush time.Duration) {
+	evt := Bus.Sub(MsgTag)
+	go func() {
+		defer evt.Unsub("*")
+		counts := make(map[detCountKey]int)
+		tick := time.NewTicker(flush)
+		defer tick.Stop()
+		for {
+			select {
+			case msg, ok := <-evt.Msgs():
+				if !ok {
+					return
+				}
+				m := msg.Msg.(SGMsg)
+				d, ok := ParseDetection(m)
+				if !ok {
+					continue
+				}
+				hour := int64(d.Ts) / 3600 * 3600
+				counts[detCountKey{d.Serno, hour, d.Port, d.TagID}]++
+				sgp, ok := activeSGs.Load(d.Serno)
+				if !ok {
+					continue
+				}
+				sg := sgp.(*ActiveSG)
+				sg.lock.Lock()
+				wasFlagged := sg.detected(m.ts)
+				sg.lock.Unlock()
+				if wasFlagged {
+					Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+				}
+			case now := <-tick.C:
+				for k, n := range counts {
+					if !SQL(DBQAddDetCount, c{k.serno, k.hour, k.port, k.tagID, n}, c{}) {
+						log.Printf("unable to record detection counts for %s\n", k.serno)
+						continue
+					}
+					delete(counts, k)
+				}
+				changed := false
+				activeSGs.Range(func(sno interface{}, sgp interface{}) bool {
+					serno := sno.(Serno)
+					sg := sgp.(*ActiveSG)
+					sg.lock.Lock()
+					since, flag := sg.checkNoTags(now, threshold)
+					sg.lock.Unlock()
+					if flag {
+						text := fmt.Sprintf("%s %s has made no detections on any port since %s", MsgSGNoTags, serno, since.Format(time.RFC1123))
+						Bus.Pub(mbus.Msg{MsgSGNoTags, SGMsg{ts: now, sender: string(serno), text: text}})
+						changed = true
+					}
+					return true
+				})
+				if changed {
+					Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+				}
+			}
+		}
+	}()
+}
+
+// a detection count, as returned by DetectionStatsHandler
+type DetCount struct {
+	Hour  time.Time // start of hour
+	Port  *int      `json:",omitempty"` // antenna port, when counting by port
+	TagID string    `json:",omitempty"` // tag ID, when counting by tag
+	N     int       // number of detections
+}
+
+// get hourly detection counts for a receiver over a time range
+//
+// `by` is "receiver" for one count per hour, "port" for one count per
+// hour and antenna port, or "tag" for one count per hour and tag ID.
+// Counts are ordered by hour.
+func GetDetCounts(serno Serno, from, to time.Time, by string) (counts []*DetCount, err error) {
+	rows, err := SQLRows(DBQGetDetCounts, c{serno, from.Unix(), to.Unix()})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type key struct {
+		hour  int64
+		port  int
+		tagID string
+	}
+	index := make(map[key]*DetCount)
+	for rows.Next() {
+		var (
+			k key
+			n int
+		)
+		if rows.Scan(&k.hour, &k.port, &k.tagID, &n) != nil {
+			continue
+		}
+		switch by {
+		case "port":
+			k.tagID = ""
+		case "tag":
+			k.port = 0
+		default:
+			k.port, k.tagID = 0, ""
+		}
+		dc := index[k]
+		if dc == nil {
+			dc = &DetCount{Hour: time.Unix(k.hour, 0), TagID: k.tagID}
+			if by == "port" {
+				port := k.port
+				dc.Port = &port
+			}
+			index[k] = dc
+			counts = append(counts, dc)
+		}
+		dc.N += n
+	}
+	return counts, rows.Err()
+}
+
+// serve hourly detection counts for a receiver over a time range
+//
+// The request looks like
+//
+//	/detections/stats?serno=SERNO[&from=FROM][&to=TO][&by=BY][&format=csv]
+//
+// where FROM and TO are as for reports and default to the last 7 days,
+// and BY is `receiver` (the default), `port` or `tag`.  The reply is a
+// JSON array of counts, or CSV.  The user must be authorized for the
+// receiver.
+func DetectionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	if token == nil {
+		http.Error(w, "401 - Motus login required", http.StatusUnauthorized)
+		return
+	}
+	serno := parseSerno(r.FormValue("serno"))
+	if serno == "" || !Authorized(token.UserID, serno) {
+		http.Error(w, "401 - not authorized for device", http.StatusUnauthorized)
+		return
+	}
+	to, from := time.Now(), time.Now().AddDate(0, 0, -7)
+	var err error
+	if s := r.FormValue("from"); s != "" {
+		if from, err = parseReportTime(s); err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.FormValue("to"); s != "" {
+		if to, err = parseReportTime(s); err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	by := r.FormValue("by")
+	switch by {
+	case "":
+		by = "receiver"
+	case "receiver", "port", "tag":
+	default:
+		http.Error(w, "400 - by must be receiver, port or tag", http.StatusBadRequest)
+		return
+	}
+	counts, err := GetDetCounts(serno, from, to, by)
+	if err != nil {
+		http.Error(w, "500 - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		header := []string{"serno", "hour", "n"}
+		if by != "receiver" {
+			header = []string{"serno", "hour", by, "n"}
+		}
+		cw.Write(header)
+		for _, dc := range counts {
+			rec := []string{string(serno), dc.Hour.UTC().Format(time.RFC3339)}
+			switch by {
+			case "port":
+				rec = append(rec, strconv.Itoa(*dc.Port))
+			case "tag":
+				rec = append(rec, dc.TagID)
+			}
+			cw.Write(append(rec, strconv.Itoa(dc.N)))
+		}
+		cw.Flush()
+		return
+	}
+	if counts == nil {
+		counts = []*DetCount{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
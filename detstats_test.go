@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNoTags(t *testing.T) {
+	const threshold = 24 * time.Hour
+	t0 := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	sg := &ActiveSG{Connected: true, TsConn: t0}
+
+	// measured from the connection until the first detection
+	if _, flag := sg.checkNoTags(t0.Add(threshold), threshold); flag {
+		t.Error("flagged within the threshold of connecting")
+	}
+	if since, flag := sg.checkNoTags(t0.Add(threshold+time.Minute), threshold); !flag || !since.Equal(t0) || !sg.NoTags {
+		t.Errorf("not flagged after the threshold; since %s", since)
+	}
+	if _, flag := sg.checkNoTags(t0.Add(threshold+2*time.Minute), threshold); flag {
+		t.Error("flagged twice")
+	}
+	if !sg.detected(t0.Add(25*time.Hour)) || sg.NoTags {
+		t.Error("flag not cleared by a detection")
+	}
+	if sg.detected(t0.Add(26 * time.Hour)) {
+		t.Error("flag cleared twice")
+	}
+	if _, flag := sg.checkNoTags(t0.Add(50*time.Hour), threshold); flag {
+		t.Error("flagged within the threshold of the last detection")
+	}
+	sg.Connected = false
+	if _, flag := sg.checkNoTags(t0.Add(100*time.Hour), threshold); flag {
+		t.Error("disconnected receiver flagged")
+	}
+}
+
+func TestGetDetCounts(t *testing.T) {
+	testDB(t)
+	const serno = Serno("SG-1234BBBK5678")
+	h0 := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	h1 := h0.Add(time.Hour)
+	for _, dc := range []struct {
+		hour  time.Time
+		port  int
+		tagID string
+		n     int
+	}{
+		{h0, 1, "A", 2},
+		{h0, 1, "B", 3},
+		{h0, 2, "A", 5},
+		{h1, 2, "A", 7},
+		// added to an existing count
+		{h1, 2, "A", 1},
+		{h1.Add(time.Hour), 2, "A", 100},
+	} {
+		if !SQL(DBQAddDetCount, c{serno, dc.hour.Unix(), dc.port, dc.tagID, dc.n}, c{}) {
+			t.Fatal("unable to add detection count")
+		}
+	}
+	SQL(DBQAddDetCount, c{Serno("SG-5678BBBK1234"), h0.Unix(), 1, "A", 1000}, c{})
+
+	type count struct {
+		hour  time.Time
+		port  int
+		tagID string
+		n     int
+	}
+	tests := []struct {
+		by   string
+		want []count
+	}{
+		{"receiver", []count{{h0, 0, "", 10}, {h1, 0, "", 8}}},
+		{"port", []count{{h0, 1, "", 5}, {h0, 2, "", 5}, {h1, 2, "", 8}}},
+		{"tag", []count{{h0, 0, "A", 7}, {h0, 0, "B", 3}, {h1, 0, "A", 8}}},
+	}
+	for _, tt := range tests {
+		counts, err := GetDetCounts(serno, h0, h1.Add(time.Hour), tt.by)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []count
+		for _, dc := range counts {
+			g := count{dc.Hour.UTC(), 0, dc.TagID, dc.N}
+			if dc.Port != nil {
+				g.port = *dc.Port
+			}
+			got = append(got, g)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("by %s: %v, want %v", tt.by, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("by %s: %v, want %v", tt.by, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDetectionStatsHandler(t *testing.T) {
+	testDB(t)
+	testMotus(t, map[Serno]RecvDep{"SG-1234BBBK5678": {ProjectID: 1}})
+	member := testLogin(t, &MotusUser{UserID: 1, Email: "member@example.org", ProjectIDs: map[int]bool{1: true}})
+	other := testLogin(t, &MotusUser{UserID: 2, Email: "other@example.org", ProjectIDs: map[int]bool{2: true}})
+	h0 := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	SQL(DBQAddDetCount, c{Serno("SG-1234BBBK5678"), h0.Unix(), 3, "A", 4}, c{})
+
+	get := func(cookie *http.Cookie, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/detections/stats?"+query, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		DetectionStatsHandler(w, req)
+		return w
+	}
+	const q = "serno=SG-1234BBBK5678&from=2019-05-01&to=2019-05-02"
+	if w := get(nil, q); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: status %d, want 401", w.Code)
+	}
+	if w := get(other, q); w.Code != http.StatusUnauthorized {
+		t.Errorf("member of another project: status %d, want 401", w.Code)
+	}
+	if w := get(member, q+"&by=antenna"); w.Code != http.StatusBadRequest {
+		t.Errorf("by antenna: status %d, want 400", w.Code)
+	}
+	w := get(member, q+"&by=port")
+	var counts []DetCount
+	if err := json.NewDecoder(w.Body).Decode(&counts); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[0].Port == nil || *counts[0].Port != 3 || counts[0].N != 4 {
+		t.Errorf("counts by port: %+v", counts)
+	}
+	w = get(member, q+"&by=tag&format=csv")
+	if want := "serno,hour,tag,n\nSG-1234BBBK5678,2019-05-01T00:00:00Z,A,4\n"; w.Body.String() != want {
+		t.Errorf("CSV %q, want %q", w.Body.String(), want)
+	}
+	w = get(member, "serno=SG-1234BBBK5678&from=2019-06-01&to=2019-06-02")
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("no counts: %s, want []", body)
+	}
+}
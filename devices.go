@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/csv"
+	"github.com/jbrzusto/mbus"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a device event, parsed from the text of a MsgDevAdded or
+// MsgDevRemoved message
+//
+// The SG sends these as lines like
+//
+//	A,1441318337,3,funcubeProPlus,/dev/sdr3
+//	R,1441318400,3
+//
+// i.e. the timestamp (seconds since the epoch), the USB port number,
+// and, for additions, the device type and any further attributes.
+type DevEvent struct {
+	Added bool     // true if the device was added, false if removed
+	Ts    float64  // timestamp of event, as reported by the receiver
+	Port  int      // USB port number
+	Type  string   // device type (only for additions)
+	Attrs []string // further attributes (only for additions)
+}
+
+// parse a device event from the text of a MsgDevAdded or
+// MsgDevRemoved message
+//
+// returns false if the message text is not a valid device event.
+func ParseDevEvent(text string) (e DevEvent, ok bool) {
+	parts := strings.Split(strings.TrimSpace(text), ",")
+	if len(parts) < 3 || (parts[0] != MsgDevAdded && parts[0] != MsgDevRemoved) {
+		return
+	}
+	var err error
+	if e.Ts, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	if e.Port, err = strconv.Atoi(parts[2]); err != nil {
+		return
+	}
+	e.Added = parts[0] == MsgDevAdded
+	if e.Added && len(parts) > 3 {
+		e.Type = parts[3]
+		e.Attrs = parts[4:]
+	}
+	return e, true
+}
+
+// a device setting, parsed from the text of a MsgDeviceSetting message
+//
+// The SG sends these as lines like
+//
+//	S,1441318337,3,frequency,166.376
+//
+// i.e. the timestamp (seconds since the epoch), the USB port number,
+// the name of the setting and its value.  Any further fields (e.g. an
+// error message if the setting failed) are ignored.
+type DevSetting struct {
+	Ts    float64 // timestamp of setting, as reported by the receiver
+	Port  int     // USB port number
+	Name  string  // name of setting
+	Value string  // value of setting
+}
+
+// parse a device setting from the text of a MsgDeviceSetting message
+//
+// returns false if the message text is not a valid device setting.
+func ParseDevSetting(text string) (s DevSetting, ok bool) {
+	parts := strings.Split(strings.TrimSpace(text), ",")
+	if len(parts) < 5 || parts[0] != MsgDeviceSetting {
+		return
+	}
+	var err error
+	if s.Ts, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	if s.Port, err = strconv.Atoi(parts[2]); err != nil {
+		return
+	}
+	s.Name, s.Value = parts[3], parts[4]
+	return s, true
+}
+
+// a device attached to a receiver
+type Device struct {
+	Type     string
+	Attrs    []string          `json:",omitempty"`
+	TsAdded  time.Time         // time at which device was added, as reported by the receiver
+	Settings map[string]string `json:",omitempty"` // most recent value of each setting
+}
+
+// get the devices currently attached to a receiver from the database
+//
+// For receivers with no entries in device_history, (i.e. not seen
+// since that table was created), device additions and removals are
+// replayed from the messages table instead.
+func LoadDevices(serno Serno) map[int]*Device {
+	devs := make(map[int]*Device)
+	have := false
+	if rows, err := SQLRows(DBQGetDevices, c{serno}); err == nil {
+		for rows.Next() {
+			var (
+				port  int
+				typ   string
+				attrs string
+				added float64
+			)
+			if rows.Scan(&port, &typ, &attrs, &added) == nil {
+				devs[port] = &Device{Type: typ, Attrs: splitAttrs(attrs), TsAdded: fromUnixtime(added)}
+			}
+			have = true
+		}
+		rows.Close()
+	}
+	if have || SQL(DBQGetAnyDevice, c{serno}, c{new(int)}) {
+		return devs
+	}
+	var events []DevEvent
+	for _, t := range []string{MsgDevAdded, MsgDevRemoved} {
+		rows, err := SQLRows(DBQGetMsgsOfType, c{serno, t, -1})
+		if err != nil {
+			continue
+		}
+		for rows.Next() {
+			var (
+				ts  float64
+				msg string
+			)
+			if rows.Scan(&ts, &msg) == nil {
+				if e, ok := ParseDevEvent(msg); ok {
+					events = append(events, e)
+				}
+			}
+		}
+		rows.Close()
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Ts < events[j].Ts })
+	for _, e := range events {
+		if e.Added {
+			devs[e.Port] = &Device{Type: e.Type, Attrs: e.Attrs, TsAdded: fromUnixtime(e.Ts)}
+		} else {
+			delete(devs, e.Port)
+		}
+	}
+	return devs
+}
+
+// device attributes are stored in device_history as a single
+// comma-separated string
+func splitAttrs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// goroutine to maintain the inventory of devices attached to receivers
+//
+// Device additions and removals update the receiver's Devices, and are
+// recorded in the device_history table.  Device settings update the
+// Settings of the device on that port.
+//
+// A port on which devices have been added or removed at least
+// `flapCount` times within `flapWindow` is flagged as Flapping; this
+// usually means a bad USB cable or hub, or an underpowered receiver.
+// The flag is cleared once the port has been stable for `flapWindow`.
+func DeviceInventory(flapCount int, flapWindow time.Duration) {
+	evt := Bus.Sub(MsgDevAdded, MsgDevRemoved, MsgDeviceSetting)
+	go func() {
+		defer evt.Unsub("*")
+		// recent add/remove times by serno and port
+		changes := make(map[Serno]map[int][]time.Time)
+		// update the Flapping flags of a receiver; the caller must
+		// hold its lock.  Returns true if any flag changed.
+		updateFlapping := func(serno Serno, sg *ActiveSG, now time.Time) (changed bool) {
+			for port, times := range changes[serno] {
+				i := 0
+				for i < len(times) && now.Sub(times[i]) > flapWindow {
+					i++
+				}
+				times = times[i:]
+				if len(times) == 0 {
+					delete(changes[serno], port)
+				} else {
+					changes[serno][port] = times
+				}
+				flapping := len(times) >= flapCount
+				if flapping != sg.Flapping[port] {
+					changed = true
+					if flapping {
+						if sg.Flapping == nil {
+							sg.Flapping = make(map[int]bool)
+						}
+						sg.Flapping[port] = true
+					} else {
+						delete(sg.Flapping, port)
+					}
+				}
+			}
+			return
+		}
+		tick := time.NewTicker(flapWindow / 10)
+		defer tick.Stop()
+		for {
+			select {
+			case msg, ok := <-evt.Msgs():
+				if !ok {
+					return
+				}
+				m := msg.Msg.(SGMsg)
+				serno := Serno(m.sender)
+				sgp, ok := activeSGs.Load(serno)
+				if !ok {
+					continue
+				}
+				sg := sgp.(*ActiveSG)
+				if msg.Topic == MsgDeviceSetting {
+					s, ok := ParseDevSetting(m.text)
+					if !ok {
+						continue
+					}
+					sg.lock.Lock()
+					if dev := sg.Devices[s.Port]; dev != nil {
+						if dev.Settings == nil {
+							dev.Settings = make(map[string]string)
+						}
+						dev.Settings[s.Name] = s.Value
+					}
+					sg.lock.Unlock()
+					continue
+				}
+				e, ok := ParseDevEvent(m.text)
+				if !ok {
+					continue
+				}
+				// close any existing entry for this port, in case we
+				// missed its removal
+				if !SQL(DBQRemoveDevice, c{e.Ts, serno, e.Port}, c{}) {
+					log.Printf("unable to record device removal for %s port %d\n", serno, e.Port)
+				}
+				if e.Added && !SQL(DBQNewDevice, c{serno, e.Port, e.Type, strings.Join(e.Attrs, ","), e.Ts}, c{}) {
+					log.Printf("unable to record device addition for %s port %d\n", serno, e.Port)
+				}
+				if changes[serno] == nil {
+					changes[serno] = make(map[int][]time.Time)
+				}
+				changes[serno][e.Port] = append(changes[serno][e.Port], m.ts)
+				sg.lock.Lock()
+				if sg.Devices == nil {
+					sg.Devices = make(map[int]*Device)
+				}
+				if e.Added {
+					sg.Devices[e.Port] = &Device{Type: e.Type, Attrs: e.Attrs, TsAdded: fromUnixtime(e.Ts)}
+				} else {
+					delete(sg.Devices, e.Port)
+				}
+				updateFlapping(serno, sg, m.ts)
+				sg.lock.Unlock()
+				Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+			case now := <-tick.C:
+				changed := false
+				for serno := range changes {
+					if sgp, ok := activeSGs.Load(serno); ok {
+						sg := sgp.(*ActiveSG)
+						sg.lock.Lock()
+						changed = updateFlapping(serno, sg, now) || changed
+						sg.lock.Unlock()
+					}
+				}
+				if changed {
+					Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+				}
+			}
+		}
+	}()
+}
+
+// summary of a receiver's devices for the status page, e.g.
+// "1:funcubeProPlus 2:funcubeProPlus <b>3:rtlsdr (flapping)</b>"
+//
+// The caller must hold the lock on the SG.
+func (sg *ActiveSG) deviceSummary() string {
+	ports := make([]int, 0, len(sg.Devices)+len(sg.Flapping))
+	for p := range sg.Devices {
+		ports = append(ports, p)
+	}
+	for p := range sg.Flapping {
+		if sg.Devices[p] == nil {
+			ports = append(ports, p)
+		}
+	}
+	sort.Ints(ports)
+	parts := make([]string, len(ports))
+	for i, p := range ports {
+		d := strconv.Itoa(p) + ":"
+		if dev := sg.Devices[p]; dev != nil {
+			d += statusPageText(dev.Type)
+		} else {
+			d += "none"
+		}
+		if sg.Flapping[p] {
+			d = "<b>" + d + " (flapping)</b>"
+		}
+		parts[i] = d
+	}
+	return strings.Join(parts, " ")
+}
+
+// reply to a status server request for the device history of a receiver
+//
+// The reply is CSV, one line per device, oldest first, with times in
+// UTC; `removed` is empty for devices still attached.
+func DeviceHistoryReply(s string) string {
+	serno := lookupSerno(s)
+	if serno == "" {
+		return "Error: invalid serial number " + s
+	}
+	rows, err := SQLRows(DBQGetDeviceHistory, c{serno})
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	defer rows.Close()
+	var b strings.Builder
+	cw := csv.NewWriter(&b)
+	cw.Write([]string{"serno", "port", "type", "attrs", "added", "removed"})
+	for rows.Next() {
+		var (
+			port    int
+			typ     string
+			attrs   string
+			added   float64
+			removed *float64
+		)
+		if rows.Scan(&port, &typ, &attrs, &added, &removed) != nil {
+			continue
+		}
+		rem := ""
+		if removed != nil {
+			rem = fromUnixtime(*removed).UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{string(serno), strconv.Itoa(port), typ, attrs, fromUnixtime(added).UTC().Format(time.RFC3339), rem})
+	}
+	cw.Flush()
+	return b.String()
+}
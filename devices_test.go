@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDevEvent(t *testing.T) {
+	tests := []struct {
+		text string
+		want DevEvent
+		ok   bool
+	}{
+		{"A,1441318337,3,funcubeProPlus,/dev/sdr3", DevEvent{true, 1441318337, 3, "funcubeProPlus", []string{"/dev/sdr3"}}, true},
+		{"A,1441318337.5,3,rtlsdr\n", DevEvent{true, 1441318337.5, 3, "rtlsdr", []string{}}, true},
+		{"A,1441318337,3", DevEvent{true, 1441318337, 3, "", nil}, true},
+		{"R,1441318400,3", DevEvent{false, 1441318400, 3, "", nil}, true},
+		{"R,1441318400,3,funcubeProPlus", DevEvent{false, 1441318400, 3, "", nil}, true},
+		{"A,1441318337", DevEvent{}, false},
+		{"A,now,3,rtlsdr", DevEvent{}, false},
+		{"A,1441318337,usb3,rtlsdr", DevEvent{}, false},
+		{"S,1441318337,3,frequency,166.376", DevEvent{}, false},
+		{"", DevEvent{}, false},
+	}
+	for _, tt := range tests {
+		e, ok := ParseDevEvent(tt.text)
+		if ok != tt.ok {
+			t.Errorf("ParseDevEvent(%q): ok %v, want %v", tt.text, ok, tt.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(e, tt.want) {
+			t.Errorf("ParseDevEvent(%q) = %+v, want %+v", tt.text, e, tt.want)
+		}
+	}
+}
+
+func TestDeviceSummary(t *testing.T) {
+	tests := []struct {
+		name     string
+		devices  map[int]*Device
+		flapping map[int]bool
+		want     string
+	}{
+		{"none", nil, nil, ""},
+		{"in port order", map[int]*Device{2: {Type: "rtlsdr"}, 1: {Type: "funcubeProPlus"}}, nil,
+			"1:funcubeProPlus 2:rtlsdr"},
+		{"flapping", map[int]*Device{1: {Type: "funcubeProPlus"}, 3: {Type: "rtlsdr"}}, map[int]bool{3: true, 4: true},
+			"1:funcubeProPlus <b>3:rtlsdr (flapping)</b> <b>4:none (flapping)</b>"},
+		{"type is escaped", map[int]*Device{1: {Type: `<script>alert("x")</script>|`}}, nil,
+			"1:&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;&#124;"},
+	}
+	for _, tt := range tests {
+		sg := &ActiveSG{Devices: tt.devices, Flapping: tt.flapping}
+		if got := sg.deviceSummary(); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceHistoryReply(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testRegister(t, "SG-SG-1234BBBK5678", true)
+	const serno = Serno("SG-SG-1234BBBK5678")
+	SQL(DBQNewDevice, c{serno, 1, "funcubeProPlus", "/dev/sdr1", 1441318337.0}, c{})
+	SQL(DBQNewDevice, c{serno, 2, "rtlsdr", "", 1441318338.0}, c{})
+	SQL(DBQRemoveDevice, c{1441318400.0, serno, 1}, c{})
+
+	want := "serno,port,type,attrs,added,removed\n" +
+		"SG-SG-1234BBBK5678,1,funcubeProPlus,/dev/sdr1,2015-09-03T22:12:17Z,2015-09-03T22:13:20Z\n" +
+		"SG-SG-1234BBBK5678,2,rtlsdr,,2015-09-03T22:12:18Z,\n"
+	// the receiver is found by its serial number, though registered
+	// under its legacy name
+	for _, s := range []string{"SG-1234BBBK5678", "SG-SG-1234BBBK5678"} {
+		if r := DeviceHistoryReply(s); r != want {
+			t.Errorf("device history of %s:\n%s\nwant:\n%s", s, r, want)
+		}
+	}
+}
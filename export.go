@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// columns of exported detections
+//
+// These follow the .csv files written by find_tags on the SG, which
+// motus.org tools read, with the receiver serial number added in front.
+// `ant` is the antenna port; the remaining columns after `fullID` are
+// passed through from the receiver as-is.
+var DetExportColumns = []string{"recv", "ant", "ts", "fullID", "freq", "freqsd", "sig", "sigsd", "noise",
+	"runID", "posInRun", "slop", "burstSlop", "antFreq"}
+
+// number of decimal places in exported detection timestamps; the SG
+// reports detection times to 0.1 ms
+const DetExportTsDigits = 4
+
+// receiver timestamp of a detection message, for the detts column of
+// the messages table; nil for other messages
+//
+// Messages are stored with the time the server received them, which
+// for detections relayed after an outage can be days or weeks after
+// the receiver made them, so detections are exported by detts.
+func detectionTs(text string) interface{} {
+	if d, ok := ParseDetection(SGMsg{text: text}); ok {
+		return d.Ts
+	}
+	return nil
+}
+
+// fill in detts for detections recorded before it was added
+//
+// This is done in SQL, as there can be millions of them; the second
+// field of a detection message is the receiver timestamp.  sqlite
+// casts a malformed one to 0, which is then cleared.
+func fillDetectionTs(tx *sql.Tx, dialect string) error {
+	q := `UPDATE messages SET detts = CAST(substr(substr(message, instr(message, ',') + 1), 1,
+                  instr(substr(message, instr(message, ',') + 1) || ',', ',') - 1) AS REAL)
+              WHERE substr(message, 1, 1) = 'p'`
+	if dialect == "postgres" {
+		q = `UPDATE messages SET detts = CAST(split_part(message, ',', 2) AS DOUBLE PRECISION)
+             WHERE substr(message, 1, 1) = 'p' AND split_part(message, ',', 2) ~ '^[0-9]+(\.[0-9]*)?$'`
+	}
+	if _, err := tx.Exec(q); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE messages SET detts = NULL WHERE detts = 0")
+	return err
+}
+
+// write the detections made by a receiver over a time range as CSV
+//
+// Detections come from the MsgTag messages in the messages table, so
+// only those relayed live by the receiver are included; motus.org
+// gets the complete set from the receiver's data files.  Detections
+// are selected, and ordered, by the time reported by the receiver (see
+// detectionTs), however long after that they were relayed.
+//
+// Detections received longer ago than the MessageRetention period for
+// MsgTag have been moved to the monthly files in ArchiveDir (see
+// archive.go), so an export of an earlier time range is incomplete or
+// empty; those detections must be taken from the archive.
+func ExportDetections(w io.Writer, serno Serno, from, to time.Time) error {
+	rows, err := SQLRows(DBQGetDetections, c{serno, unixtime(from), unixtime(to)})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var dets []Detection
+	for rows.Next() {
+		var (
+			ts  float64
+			msg string
+		)
+		if rows.Scan(&ts, &msg) != nil {
+			continue
+		}
+		d, ok := ParseDetection(SGMsg{ts: fromUnixtime(ts), sender: string(serno), text: msg})
+		if !ok {
+			continue
+		}
+		dets = append(dets, d)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(DetExportColumns)
+	n := len(DetExportColumns)
+	for _, d := range dets {
+		rec := make([]string, 4, n)
+		rec[0], rec[1], rec[2], rec[3] = string(d.Serno), strconv.Itoa(d.Port), strconv.FormatFloat(d.Ts, 'f', DetExportTsDigits, 64), d.TagID
+		rec = append(rec, d.Fields...)
+		// pad or trim to the expected number of columns, in case
+		// the receiver sends more or fewer fields than we expect
+		for len(rec) < n {
+			rec = append(rec, "")
+		}
+		cw.Write(rec[:n])
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// reply to a status server request to export detections
+//
+// `words` are the words of the request: "detections SERNO FROM TO",
+// with FROM and TO as for uptime reports.
+func DetectionsReply(words []string) string {
+	if len(words) < 4 {
+		return "Error: usage: " + words[0] + " SERNO FROM TO"
+	}
+	serno := lookupSerno(words[1])
+	if serno == "" {
+		return "Error: invalid serial number " + words[1]
+	}
+	from, err := parseReportTime(words[2])
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	to, err := parseReportTime(words[3])
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	var b strings.Builder
+	if err = ExportDetections(&b, serno, from, to); err != nil {
+		return "Error: " + err.Error()
+	}
+	return b.String()
+}
+
+// serve detections from a receiver over a time range as CSV
+//
+// The request looks like
+//
+//	/detections/export?serno=SERNO&from=FROM&to=TO
+//
+// with FROM and TO as for reports.  The user must be authorized for
+// the receiver.
+func DetectionExportHandler(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	if token == nil {
+		http.Error(w, "401 - Motus login required", http.StatusUnauthorized)
+		return
+	}
+	serno := parseSerno(r.FormValue("serno"))
+	if serno == "" || !Authorized(token.UserID, serno) {
+		http.Error(w, "401 - not authorized for device", http.StatusUnauthorized)
+		return
+	}
+	from, err := parseReportTime(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseReportTime(r.FormValue("to"))
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// build the CSV first, so that a database error isn't sent as an
+	// empty export
+	var b strings.Builder
+	if err = ExportDetections(&b, serno, from, to); err != nil {
+		log.Printf("unable to export detections of %s: %s\n", serno, err.Error())
+		http.Error(w, "500 - unable to export detections", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_%s_%s.csv"`,
+		serno, from.UTC().Format("2006-01-02T15-04-05"), to.UTC().Format("2006-01-02T15-04-05")))
+	io.WriteString(w, b.String())
+}
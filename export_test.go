@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportDetections(t *testing.T) {
+	testDB(t)
+	const serno = Serno("SG-1234BBBK5678")
+	from := time.Date(2015, 9, 3, 22, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	d := unixtime(from)
+	err := DB.AddMessages([]dbMsg{
+		// relayed a week after it was made, ahead of a live one
+		{d + 7*86400, string(serno), "p2,1441318337.12345,TestTags#123.1:4.7@166.38,1.2,0.1,-45,2,-80,11,1,0.0001,0.0002,166.376"},
+		{d + 100, string(serno), "p1,1441317700,TestTags#5:4.7@166.38,1.2"},
+		// before and after the range
+		{d - 1, string(serno), "p1,1441317599.9,TestTags#5:4.7@166.38"},
+		{d + 3600, string(serno), "p1,1441321200,TestTags#5:4.7@166.38"},
+		// not a detection
+		{d + 200, string(serno), "G,1441317800,45.1,-64.5,20"},
+		// another receiver's
+		{d + 300, "SG-5678BBBK1234", "p1,1441317900,TestTags#5:4.7@166.38"},
+		// more fields than expected
+		{d + 400, string(serno), "p3,1441318000,TestTags#7:4.7@166.38,1,2,3,4,5,6,7,8,9,10,11,12"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err = ExportDetections(&b, serno, from, to); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"recv,ant,ts,fullID,freq,freqsd,sig,sigsd,noise,runID,posInRun,slop,burstSlop,antFreq",
+		"SG-1234BBBK5678,1,1441317700.0000,TestTags#5:4.7@166.38,1.2,,,,,,,,,",
+		"SG-1234BBBK5678,3,1441318000.0000,TestTags#7:4.7@166.38,1,2,3,4,5,6,7,8,9,10",
+		"SG-1234BBBK5678,2,1441318337.1235,TestTags#123.1:4.7@166.38,1.2,0.1,-45,2,-80,11,1,0.0001,0.0002,166.376",
+		""}, "\n")
+	if b.String() != want {
+		t.Errorf("export:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	if r := DetectionsReply([]string{"detections", string(serno), "2015-09-03"}); !strings.HasPrefix(r, "Error: usage:") {
+		t.Errorf("detections with no end: %q", r)
+	}
+	if r := DetectionsReply([]string{"detections", string(serno), "2015-09-03T22:00:00Z", "2015-09-03T23:00:00Z"}); r != want {
+		t.Errorf("detections reply:\n%s\nwant:\n%s", r, want)
+	}
+}
+
+func TestDetectionsReplyLegacySerno(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testRegister(t, "SG-SG-1234BBBK5678", true)
+	DB.AddMessages([]dbMsg{{1441318400, "SG-SG-1234BBBK5678", "p1,1441318337,TestTags#5:4.7@166.38"}})
+	r := DetectionsReply([]string{"detections", "SG-1234BBBK5678", "2015-09-03", "2015-09-04"})
+	if !strings.Contains(r, "\nSG-SG-1234BBBK5678,1,1441318337.0000,TestTags#5:4.7@166.38,") {
+		t.Errorf("detections of a receiver registered under its legacy name: %q", r)
+	}
+}
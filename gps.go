@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jbrzusto/mbus"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a GPS fix, parsed from the text of a MsgGPS message
+//
+// The SG sends fixes as lines like
+//
+//	G,1441318337,45.1234,-64.5678,31.2
+//
+// i.e. the timestamp (seconds since the epoch), latitude and
+// longitude (degrees), and altitude (metres).
+type GPSFix struct {
+	Ts  float64 // timestamp of fix, as reported by the receiver
+	Lat float64 // latitude (degrees N)
+	Lon float64 // longitude (degrees E)
+	Alt float64 // altitude (metres)
+}
+
+// parse a GPS fix from the text of a MsgGPS message
+//
+// returns false if the message text is not a valid fix.  A receiver
+// without a GPS lock reports a position of 0, 0, which we also treat
+// as invalid.
+func ParseGPSFix(text string) (f GPSFix, ok bool) {
+	parts := strings.Split(strings.TrimSpace(text), ",")
+	if len(parts) < 4 || parts[0] != MsgGPS {
+		return
+	}
+	var err error
+	if f.Ts, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	if f.Lat, err = strconv.ParseFloat(parts[2], 64); err != nil || math.IsNaN(f.Lat) {
+		return
+	}
+	if f.Lon, err = strconv.ParseFloat(parts[3], 64); err != nil || math.IsNaN(f.Lon) {
+		return
+	}
+	if f.Lat == 0 && f.Lon == 0 {
+		return
+	}
+	if len(parts) > 4 {
+		f.Alt, _ = strconv.ParseFloat(parts[4], 64)
+	}
+	return f, true
+}
+
+// great-circle distance in metres between two points given in degrees
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const R = 6371000 // mean radius of the earth, in metres
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dp, dl := (lat2-lat1)*math.Pi/180, (lon2-lon1)*math.Pi/180
+	a := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * R * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// distance in metres between two fixes
+func (f *GPSFix) DistanceTo(g *GPSFix) float64 {
+	return distance(f.Lat, f.Lon, g.Lat, g.Lon)
+}
+
+// get the most recent GPS fix for a receiver from the database
+//
+// Fixes recorded before the gps_fixes table existed are recovered from
+// the messages table.  Returns nil if there is no fix.
+func LastGPSFix(serno Serno) *GPSFix {
+	var f GPSFix
+	if SQL(DBQGetLastGPSFix, c{serno}, c{&f.Ts, &f.Lat, &f.Lon, &f.Alt}) {
+		return &f
+	}
+	var (
+		ts  float64
+		msg string
+	)
+	if SQL(DBQGetLastMsgOfType, c{serno, MsgGPS}, c{&ts, &msg}) {
+		if f, ok := ParseGPSFix(msg); ok {
+			return &f
+		}
+	}
+	return nil
+}
+
+// make a GPS fix a receiver's current position, and return whether it
+// has moved by more than `threshold` metres, from where, and how far
+//
+// Moves are measured from the first fix of the receiver's current
+// stay, GPSStay, rather than from its previous fix, so that a receiver
+// drifting a little at a time is caught too.  A move starts a new
+// stay.  The caller must hold the lock on the SG.
+func (sg *ActiveSG) updateGPS(fix *GPSFix, threshold float64) (from *GPSFix, dist float64, moved bool) {
+	sg.GPS = fix
+	if sg.GPSStay == nil {
+		sg.GPSStay = fix
+		return nil, 0, false
+	}
+	from = sg.GPSStay
+	dist = from.DistanceTo(fix)
+	if moved = dist > threshold; moved {
+		sg.GPSStay = fix
+	}
+	return
+}
+
+// compare a GPS fix to the location of a receiver's motus deployment,
+// setting DepDist, and flagging it Mislocated if they are more than
+// `mismatch` metres apart
+//
+// A receiver whose deployment has no location is not Mislocated.  The
+// caller must hold the lock on the SG.
+func (sg *ActiveSG) checkDeployment(fix *GPSFix, dep RecvDep, mismatch float64) {
+	if !dep.HasLocation {
+		sg.DepDist, sg.Mislocated = 0, false
+		return
+	}
+	sg.DepDist = distance(fix.Lat, fix.Lon, dep.Lat, dep.Lon)
+	sg.Mislocated = sg.DepDist > mismatch
+}
+
+// goroutine to track receiver locations
+//
+// Each GPS fix is recorded in the gps_fixes table and becomes the
+// receiver's current position.  If the receiver has moved by more
+// than `threshold` metres from where it settled (see updateGPS), an
+// MsgSGMoved message is published.
+//
+// Each fix is also compared to the location of the receiver's motus
+// deployment, if known.  When the distance between these first
+// exceeds `mismatch` metres, an MsgSGMislocated message is published;
+// the receiver stays flagged as Mislocated until a fix agrees with
+// the deployment again, or the deployment no longer has a location
+// (see checkDeployment).
+func GPSTracker(threshold, mismatch float64) {
+	evt := Bus.Sub(MsgGPS)
+	go func() {
+		defer evt.Unsub("*")
+		for msg := range evt.Msgs() {
+			m := msg.Msg.(SGMsg)
+			fix, ok := ParseGPSFix(m.text)
+			if !ok {
+				continue
+			}
+			serno := Serno(m.sender)
+			if !SQL(DBQNewGPSFix, c{serno, fix.Ts, fix.Lat, fix.Lon, fix.Alt}, c{}) {
+				log.Printf("unable to record GPS fix for %s\n", serno)
+			}
+			sgp, ok := activeSGs.Load(serno)
+			if !ok {
+				continue
+			}
+			dep, _ := MotusInfo.Dep(serno)
+			sg := sgp.(*ActiveSG)
+			sg.lock.Lock()
+			wasMislocated := sg.Mislocated
+			sg.checkDeployment(&fix, dep, mismatch)
+			mislocated, depDist := sg.Mislocated, sg.DepDist
+			prev, dist, moved := sg.updateGPS(&fix, threshold)
+			if moved {
+				sg.TsMoved = m.ts
+			}
+			sg.lock.Unlock()
+			if moved {
+				text := fmt.Sprintf("%s moved %.0f m from %.6f,%.6f to %.6f,%.6f", MsgSGMoved, dist, prev.Lat, prev.Lon, fix.Lat, fix.Lon)
+				Bus.Pub(mbus.Msg{MsgSGMoved, SGMsg{ts: m.ts, sender: string(serno), text: text}})
+			}
+			if mislocated && !wasMislocated {
+				text := fmt.Sprintf("%s GPS fix %.6f,%.6f is %.1f km from motus deployment %s at %.6f,%.6f", MsgSGMislocated, fix.Lat, fix.Lon, depDist/1000, dep.SiteName, dep.Lat, dep.Lon)
+				Bus.Pub(mbus.Msg{MsgSGMislocated, SGMsg{ts: m.ts, sender: string(serno), text: text}})
+			}
+			if moved || mislocated != wasMislocated {
+				Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+			}
+		}
+	}()
+}
+
+// GeoJSON types; see RFC 7946
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONPoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type GeoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// make a GeoJSON point feature from a GPS fix
+func (f *GPSFix) Feature(props map[string]interface{}) GeoJSONFeature {
+	props["ts"] = f.Ts
+	props["alt"] = f.Alt
+	return GeoJSONFeature{Type: "Feature",
+		Geometry:   GeoJSONPoint{Type: "Point", Coordinates: []float64{f.Lon, f.Lat}},
+		Properties: props}
+}
+
+// marker colours for receiver connection states, for map renderers
+// which follow the simplestyle spec
+const (
+	MarkerConnected    = "#2ca02c" // green
+	MarkerSilent       = "#ff7f0e" // orange
+	MarkerDisconnected = "#d62728" // red
+	MarkerUnknown      = "#7f7f7f" // grey; not seen since server was launched
+)
+
+// serve the latest GPS fixes of receivers as GeoJSON
+//
+// Each receiver is a point feature whose properties give its serial
+// number, connection state, motus site and project, and a
+// `marker-color` reflecting its connection state.  Exact locations
+// would help thieves, and some projects keep theirs private, so the
+// user must be logged in, and only gets the receivers they are
+// authorized for.
+func GPSLatestHandler(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	if token == nil {
+		http.Error(w, "401 - Motus login required", http.StatusUnauthorized)
+		return
+	}
+	rows, err := SQLRows(DBQGetLatestGPSFixes, c{})
+	if err != nil {
+		http.Error(w, "500 - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	fc := GeoJSONCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for rows.Next() {
+		var (
+			serno Serno
+			f     GPSFix
+		)
+		if rows.Scan(&serno, &f.Ts, &f.Lat, &f.Lon, &f.Alt) != nil || !Authorized(token.UserID, serno) {
+			continue
+		}
+		props := map[string]interface{}{"serno": serno, "state": "unknown", "marker-color": MarkerUnknown}
+		if sgp, ok := activeSGs.Load(serno); ok {
+			sg := sgp.(*ActiveSG)
+			sg.lock.Lock()
+			switch {
+			case sg.Connected && sg.Silent:
+				props["state"], props["marker-color"] = "silent", MarkerSilent
+			case sg.Connected:
+				props["state"], props["marker-color"] = "connected", MarkerConnected
+			default:
+				props["state"], props["marker-color"] = "disconnected", MarkerDisconnected
+			}
+			sg.lock.Unlock()
+		}
+		if dep, known := MotusInfo.Dep(serno); known {
+			props["site"] = dep.SiteName
+			props["project"] = MotusInfo.Project(dep.ProjectID)
+		}
+		fc.Features = append(fc.Features, f.Feature(props))
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(fc)
+}
+
+// serve the GPS fixes of one receiver over a time range as GeoJSON
+//
+// The request looks like
+//
+//	/gps/history.geojson?serno=SERNO[&from=FROM][&to=TO]
+//
+// where FROM and TO are as for reports, and default to the last 30
+// days.  The user must be authorized for the receiver.
+func GPSHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	if token == nil {
+		http.Error(w, "401 - Motus login required", http.StatusUnauthorized)
+		return
+	}
+	serno := parseSerno(r.FormValue("serno"))
+	if serno == "" || !Authorized(token.UserID, serno) {
+		http.Error(w, "401 - not authorized for device", http.StatusUnauthorized)
+		return
+	}
+	to, from := time.Now(), time.Now().AddDate(0, 0, -30)
+	var err error
+	if s := r.FormValue("from"); s != "" {
+		if from, err = parseReportTime(s); err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.FormValue("to"); s != "" {
+		if to, err = parseReportTime(s); err != nil {
+			http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	rows, err := SQLRows(DBQGetGPSFixes, c{serno, unixtime(from), unixtime(to)})
+	if err != nil {
+		http.Error(w, "500 - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	fc := GeoJSONCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for rows.Next() {
+		var f GPSFix
+		if rows.Scan(&f.Ts, &f.Lat, &f.Lon, &f.Alt) == nil {
+			fc.Features = append(fc.Features, f.Feature(map[string]interface{}{"serno": serno}))
+		}
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(fc)
+}
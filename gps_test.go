@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseGPSFix(t *testing.T) {
+	tests := []struct {
+		text string
+		want GPSFix
+		ok   bool
+	}{
+		{"G,1441318337,45.1234,-64.5678,12.5", GPSFix{1441318337, 45.1234, -64.5678, 12.5}, true},
+		{"G,1441318337.5,45.1234,-64.5678\n", GPSFix{1441318337.5, 45.1234, -64.5678, 0}, true},
+		{"G,1441318337,45.1234,-64.5678,unknown", GPSFix{1441318337, 45.1234, -64.5678, 0}, true},
+		{"G,1441318337,0,0,0", GPSFix{}, false},
+		{"G,1441318337,NaN,-64.5678", GPSFix{}, false},
+		{"G,1441318337,45.1234", GPSFix{}, false},
+		{"G,now,45.1234,-64.5678", GPSFix{}, false},
+		{"G,1441318337,north,-64.5678", GPSFix{}, false},
+		{"p3,1441318337,45.1234,-64.5678", GPSFix{}, false},
+		{"", GPSFix{}, false},
+	}
+	for _, tt := range tests {
+		f, ok := ParseGPSFix(tt.text)
+		if ok != tt.ok {
+			t.Errorf("ParseGPSFix(%q): ok %v, want %v", tt.text, ok, tt.ok)
+			continue
+		}
+		if ok && f != tt.want {
+			t.Errorf("ParseGPSFix(%q) = %+v, want %+v", tt.text, f, tt.want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		lat1, lon1, lat2, lon2 float64
+		want                   float64 // metres
+		tol                    float64
+	}{
+		{45, -64, 45, -64, 0, 1e-6},
+		{0, 0, 1, 0, 111195, 1},
+		{0, 0, 0, 1, 111195, 1},
+		{0, 179.5, 0, -179.5, 111195, 1},
+		{90, 0, -90, 0, math.Pi * 6371000, 1},
+	}
+	for _, tt := range tests {
+		if d := distance(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(d-tt.want) > tt.tol {
+			t.Errorf("distance(%g, %g, %g, %g) = %f, want %f", tt.lat1, tt.lon1, tt.lat2, tt.lon2, d, tt.want)
+		}
+	}
+}
+
+func TestGPSLatestHandler(t *testing.T) {
+	testDB(t)
+	testMotus(t, map[Serno]RecvDep{
+		"SG-1234BBBK5678": {ProjectID: 1},
+		"SG-2234BBBK5678": {ProjectID: 2},
+	})
+	for _, s := range []Serno{"SG-1234BBBK5678", "SG-2234BBBK5678", "SG-3234BBBK5678"} {
+		if !SQL(DBQNewGPSFix, c{s, 1441318337, 45.1, -64.3, 10}, c{}) {
+			t.Fatalf("unable to add fix for %s", s)
+		}
+	}
+	member := testLogin(t, &MotusUser{UserID: 1, Email: "member@b.org", ProjectIDs: map[int]bool{1: true}})
+	admin := testLogin(t, &MotusUser{UserID: 2, Email: "admin@b.org", ProjectIDs: map[int]bool{}, IsAdmin: true})
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+		sernos []string
+	}{
+		{"anonymous", nil, http.StatusUnauthorized, nil},
+		{"bad session", &http.Cookie{Name: "sgsession", Value: "bogus"}, http.StatusUnauthorized, nil},
+		{"project member", member, http.StatusOK, []string{"SG-1234BBBK5678"}},
+		{"admin", admin, http.StatusOK, []string{"SG-1234BBBK5678", "SG-2234BBBK5678", "SG-3234BBBK5678"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/gps/latest.geojson", nil)
+		if tt.cookie != nil {
+			r.AddCookie(tt.cookie)
+		}
+		w := httptest.NewRecorder()
+		GPSLatestHandler(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var fc GeoJSONCollection
+		if err := json.Unmarshal(w.Body.Bytes(), &fc); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		var sernos []string
+		for _, f := range fc.Features {
+			sernos = append(sernos, f.Properties["serno"].(string))
+		}
+		sort.Strings(sernos)
+		if !reflect.DeepEqual(sernos, tt.sernos) {
+			t.Errorf("%s: got receivers %v, want %v", tt.name, sernos, tt.sernos)
+		}
+	}
+}
+
+func TestUpdateGPS(t *testing.T) {
+	// about 11 m north of the previous fix per step
+	const step = 0.0001
+	tests := []struct {
+		name  string
+		lats  []float64 // successive fixes, all at longitude -64
+		moved []bool    // whether each counts as a move
+	}{
+		{"first fix", []float64{45}, []bool{false}},
+		{"jitter", []float64{45, 45 + step, 45, 45 - step, 45}, []bool{false, false, false, false, false}},
+		{"jump", []float64{45, 45.01, 45.01 + step}, []bool{false, true, false}},
+		{"slow drift", []float64{45, 45 + 2*step, 45 + 4*step, 45 + 6*step, 45 + 8*step, 45 + 10*step, 45 + 12*step},
+			[]bool{false, false, false, false, false, true, false}},
+	}
+	for _, tt := range tests {
+		sg := &ActiveSG{}
+		for i, lat := range tt.lats {
+			fix := &GPSFix{Ts: float64(i), Lat: lat, Lon: -64}
+			from, dist, moved := sg.updateGPS(fix, 100)
+			if moved != tt.moved[i] {
+				t.Errorf("%s: fix %d: moved %v (%.0f m from %v), want %v", tt.name, i, moved, dist, from, tt.moved[i])
+			}
+			if sg.GPS != fix {
+				t.Errorf("%s: fix %d is not the current position", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestCheckDeployment(t *testing.T) {
+	const mismatch = 1000
+	dep := RecvDep{SiteName: "Lighthouse", HasLocation: true, Lat: 45, Lon: -64}
+	sg := &ActiveSG{}
+
+	// 0.005 degrees of latitude is about 556 m
+	sg.checkDeployment(&GPSFix{Lat: 45.005, Lon: -64}, dep, mismatch)
+	if sg.Mislocated || math.Abs(sg.DepDist-556) > 1 {
+		t.Errorf("fix 556 m away: mislocated %v, distance %.0f m", sg.Mislocated, sg.DepDist)
+	}
+	sg.checkDeployment(&GPSFix{Lat: 45.01, Lon: -64}, dep, mismatch)
+	if !sg.Mislocated || math.Abs(sg.DepDist-1112) > 1 {
+		t.Errorf("fix 1112 m away: mislocated %v, distance %.0f m", sg.Mislocated, sg.DepDist)
+	}
+	// the flag is cleared by a fix which agrees with the deployment
+	sg.checkDeployment(&GPSFix{Lat: 45, Lon: -64.001}, dep, mismatch)
+	if sg.Mislocated {
+		t.Error("still mislocated at the deployment")
+	}
+	// or by the deployment losing its location
+	sg.checkDeployment(&GPSFix{Lat: 46, Lon: -64}, dep, mismatch)
+	sg.checkDeployment(&GPSFix{Lat: 46, Lon: -64}, RecvDep{SiteName: "Lighthouse"}, mismatch)
+	if sg.Mislocated || sg.DepDist != 0 {
+		t.Errorf("deployment without location: mislocated %v, distance %.0f m", sg.Mislocated, sg.DepDist)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Private key encryption
+//
+// Receivers' private keys are stored in the database encrypted with
+// AES-256-GCM under a server master key, so that a copy of the database
+// (or of one of its snapshots) doesn't give away every receiver's
+// credentials.  Keys are decrypted only to reply to a registration
+// request.  The receiver's serial number is bound to each encrypted key,
+// so a key can't be moved to another receiver's row.
+//
+// The master key is 32 random bytes, base64-encoded, taken from the
+// environment variable MasterKeyEnv if it is set, and otherwise from
+// the file MasterKeyFile.  Losing it means re-registering every
+// receiver, so it must be backed up separately from the database.
+
+// prefix of an encrypted private key, which is followed by the
+// base64-encoded nonce and ciphertext
+const encKeyPrefix = "enc1:"
+
+// the master key, loaded by LoadMasterKey()
+var masterKey []byte
+
+// load the master key from the environment variable `env` or, if that
+// is not set, the file `file`
+func LoadMasterKey(env, file string) error {
+	s := os.Getenv(env)
+	if s == "" {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("no master key: set %s or create %s (see README): %s", env, file, err.Error())
+		}
+		s = string(buf)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("master key is not valid base64: %s", err.Error())
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("master key must be 32 bytes, not %d", len(key))
+	}
+	masterKey = key
+	return nil
+}
+
+// get the AEAD cipher for the master key
+func masterAEAD() (cipher.AEAD, error) {
+	if masterKey == nil {
+		return nil, fmt.Errorf("no master key loaded")
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt a receiver's private key for storage
+func encryptKey(serno Serno, plain string) (string, error) {
+	aead, err := masterAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = cryptorand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(serno))
+	return encKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt a receiver's stored private key
+//
+// An empty key decrypts to itself; a key which is not encrypted is an
+// error, since the migration which encrypts existing keys should have
+// caught it.
+func decryptKey(serno Serno, stored string) (string, error) {
+	if stored == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(stored, encKeyPrefix) {
+		return "", fmt.Errorf("private key for %s is not encrypted", serno)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored[len(encKeyPrefix):])
+	if err != nil {
+		return "", err
+	}
+	aead, err := masterAEAD()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("private key for %s is truncated", serno)
+	}
+	n := aead.NonceSize()
+	plain, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(serno))
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt private key for %s (wrong master key?): %s", serno, err.Error())
+	}
+	return string(plain), nil
+}
+
+// migration to encrypt the private keys of current and deleted
+// receivers
+//
+// Keys already encrypted are left alone, so this is safe to re-run.
+// Rows are updated by their old key value, which is unique, since
+// deleted_receivers has no key of its own.
+func encryptStoredKeys(tx *sql.Tx, dialect string) error {
+	for _, table := range []string{"receivers", "deleted_receivers"} {
+		rows, err := tx.Query(dialectSQL(dialect, "SELECT serno, privkey FROM "+table+" WHERE privkey IS NOT NULL AND privkey != '' AND privkey NOT LIKE ?"), encKeyPrefix+"%")
+		if err != nil {
+			return err
+		}
+		var sernos, keys []string
+		for rows.Next() {
+			var serno, key string
+			if err = rows.Scan(&serno, &key); err != nil {
+				rows.Close()
+				return err
+			}
+			sernos, keys = append(sernos, serno), append(keys, key)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for i, key := range keys {
+			enc, err := encryptKey(Serno(sernos[i]), key)
+			if err != nil {
+				return err
+			}
+			if _, err = tx.Exec(dialectSQL(dialect, "UPDATE "+table+" SET privkey = ? WHERE privkey = ?"), enc, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
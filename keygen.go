@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// Key generation
+//
+// Each receiver gets its own key pair, which it uses to log in to the
+// server over ssh, and to sign the datagrams it sends.  Keys are
+// generated here rather than by ssh-keygen and openssl, so no key
+// material is written to disk, and nothing depends on those tools'
+// output formats.  The key type is CryptoKeyType: "rsa" keys work with
+// every receiver; "ed25519" keys are smaller and faster, but need
+// OpenSSH 6.5 or later on the receiver.
+
+// a key pair for a receiver
+type KeyPair struct {
+	AuthorizedKey string // public key as an OpenSSH authorized_keys line (without options), ending in newline
+	PublicPEM     string // public key in PEM-encoded PKIX form, for verifying the receiver's datagram signatures
+	PrivatePEM    string // private key in PEM form, as read by OpenSSH
+}
+
+// generate a new key pair for a receiver
+//
+// `keyType` is "rsa" or "ed25519".  The receiver's serial number is the
+// comment on its authorized_keys line.  RSA private keys are in PKCS#1
+// form, as ssh-keygen used to write them; Ed25519 private keys are in
+// OpenSSH's own format, as no other is read by all OpenSSH versions.
+func NewKeyPair(keyType string, serno Serno) (*KeyPair, error) {
+	var (
+		pub     interface{}
+		privPEM *pem.Block
+	)
+	switch keyType {
+	case "rsa":
+		key, err := rsa.GenerateKey(cryptorand.Reader, CryptoRSABits)
+		if err != nil {
+			return nil, err
+		}
+		pub = &key.PublicKey
+		privPEM = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case "ed25519":
+		edPub, edPriv, err := ed25519.GenerateKey(cryptorand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		pub = edPub
+		if privPEM, err = openSSHEd25519PrivateKey(edPub, edPriv, string(serno)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown key type %q; must be rsa or ed25519", keyType)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{
+		AuthorizedKey: strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(sshPub)), "\n") + " " + string(serno) + "\n",
+		PublicPEM:     string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})),
+		PrivatePEM:    string(pem.EncodeToMemory(privPEM)),
+	}, nil
+}
+
+// get the PEM-encoded PKIX form of an OpenSSH public key
+func publicPEM(authorizedKey string) (string, error) {
+	sshPub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", err
+	}
+	cpk, ok := sshPub.(ssh.CryptoPublicKey)
+	if !ok {
+		return "", fmt.Errorf("unsupported key type %s", sshPub.Type())
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(cpk.CryptoPublicKey())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})), nil
+}
+
+// encode an unencrypted Ed25519 private key in OpenSSH's format
+//
+// See PROTOCOL.key in the OpenSSH sources.
+func openSSHEd25519PrivateKey(pub ed25519.PublicKey, priv ed25519.PrivateKey, comment string) (*pem.Block, error) {
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	// the two check values are equal, and random
+	var check [4]byte
+	if _, err = cryptorand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	ci := binary.BigEndian.Uint32(check[:])
+	key := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{ci, ci, ssh.KeyAlgoED25519, pub, priv, comment, nil}
+	// pad to the block size of the (null) cipher with 1, 2, 3, ...
+	n := len(ssh.Marshal(key))
+	for i := 0; (n+i)%8 != 0; i++ {
+		key.Pad = append(key.Pad, byte(i+1))
+	}
+	body := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, sshPub.Marshal(), ssh.Marshal(key)}
+	return &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: append([]byte("openssh-key-v1\x00"), ssh.Marshal(body)...)}, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+)
+
+func TestNewKeyPair(t *testing.T) {
+	for _, keyType := range []string{"rsa", "ed25519"} {
+		keys, err := NewKeyPair(keyType, "SG-1234BBBK5678")
+		if err != nil {
+			t.Fatalf("%s: %s", keyType, err)
+		}
+		signer, err := ssh.ParsePrivateKey([]byte(keys.PrivatePEM))
+		if err != nil {
+			t.Fatalf("%s: private key: %s", keyType, err)
+		}
+		pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(keys.AuthorizedKey))
+		if err != nil {
+			t.Fatalf("%s: authorized key: %s", keyType, err)
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+			t.Errorf("%s: private key does not match authorized key", keyType)
+		}
+		if comment != "SG-1234BBBK5678" || !strings.HasSuffix(keys.AuthorizedKey, "\n") {
+			t.Errorf("%s: authorized key %q, want comment SG-1234BBBK5678 and newline", keyType, keys.AuthorizedKey)
+		}
+
+		// the PEM public key, from which datagram signatures are
+		// verified, is the same key, and is what publicPEM gives
+		block, _ := pem.Decode([]byte(keys.PublicPEM))
+		if block == nil {
+			t.Fatalf("%s: public PEM not decoded", keyType)
+		}
+		pkix, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: public PEM: %s", keyType, err)
+		}
+		sshPub, err := ssh.NewPublicKey(pkix)
+		if err != nil {
+			t.Fatalf("%s: public PEM: %s", keyType, err)
+		}
+		if !bytes.Equal(sshPub.Marshal(), pub.Marshal()) {
+			t.Errorf("%s: public PEM does not match authorized key", keyType)
+		}
+		if p, err := publicPEM(keys.AuthorizedKey); err != nil || p != keys.PublicPEM {
+			t.Errorf("%s: publicPEM differs from the generated one: %v", keyType, err)
+		}
+
+		// a signature made with the private key verifies
+		data := []byte("datagram")
+		sig, err := signer.Sign(nil, data)
+		if err != nil {
+			t.Fatalf("%s: sign: %s", keyType, err)
+		}
+		if err = pub.Verify(data, sig); err != nil {
+			t.Errorf("%s: verify: %s", keyType, err)
+		}
+	}
+	if _, err := NewKeyPair("dsa", "SG-1234BBBK5678"); err == nil {
+		t.Error("generated a dsa key")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jbrzusto/mbus"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Key rotation
+//
+// A receiver's key pair is replaced in three steps:
+//
+//   - StartKeyRotation generates a new key pair, stores it alongside
+//     the current one, and adds a line for the new public key to
+//     authorized_keys, so that both keys are accepted.  The new line
+//     names a different connection semaphore: the serial number
+//     followed by newKeySemSuffix.
+//
+//   - When the receiver next registers, it is given the new key pair
+//     instead of the current one.
+//
+//   - When it connects with the new key, ConnectionWatcher sees the
+//     new key's semaphore and publishes MsgSGNewKey, on which
+//     KeyRotator calls FinishKeyRotation: the new key replaces the old
+//     one in the database, and the old key's line is removed from
+//     authorized_keys, so it can no longer be used.
+//
+// If the receiver hasn't connected with its new key within the grace
+// period, the rotation is abandoned, and the new key is revoked, rather
+// than lock out a receiver which may be hard to reach in the field.
+// Rotations can be started for one receiver by the status server's
+// `rotatekey` command, or for the whole fleet by KeyRotator, which
+// rotates keys older than KeyRotationMaxAge a few at a time.
+
+// suffix added to the name of the connection semaphore for a new key
+const newKeySemSuffix = ".newkey"
+
+// start rotating a receiver's key pair
+func StartKeyRotation(serno Serno) error {
+	reg, ok := DB.GetRegistration(serno)
+	if !ok || reg.pubKey == "" {
+		return fmt.Errorf("%s is not registered", serno)
+	}
+	var (
+		newPub, newPriv string
+		ts              float64
+	)
+	if SQL(DBQGetRotation, c{serno}, c{&newPub, &newPriv, &ts}) {
+		return fmt.Errorf("key rotation for %s already started at %s", serno, fromUnixtime(ts).Format(time.RFC3339))
+	}
+	keys, err := NewKeyPair(CryptoKeyType, serno)
+	if err != nil {
+		return err
+	}
+	encPriv, err := encryptKey(serno, keys.PrivatePEM)
+	if err != nil {
+		return err
+	}
+	if !SQL(DBQStartRotation, c{keys.AuthorizedKey, encPriv, unixtime(time.Now()), serno}, c{}) {
+		return fmt.Errorf("unable to record new key for %s", serno)
+	}
+	if err = appendAuthKey(authKeyLine(serno, reg.tunnelPort, reg.verified, keys.AuthorizedKey, string(serno)+newKeySemSuffix)); err != nil {
+		SQL(DBQCancelRotation, c{serno}, c{})
+		return err
+	}
+	log.Printf("started key rotation for %s\n", serno)
+	return nil
+}
+
+// finish rotating a receiver's key pair, once it has connected with
+// the new key
+//
+// Does nothing if no rotation was started.
+func FinishKeyRotation(serno Serno) error {
+	var (
+		newPub, newPriv string
+		ts              float64
+	)
+	if !SQL(DBQGetRotation, c{serno}, c{&newPub, &newPriv, &ts}) {
+		return nil
+	}
+	reg, ok := DB.GetRegistration(serno)
+	if !ok {
+		return fmt.Errorf("%s is not registered", serno)
+	}
+	// the PEM file with which the receiver's datagrams are verified is
+	// written before the new key replaces the old one, and moved into
+	// place after, so the rotation is only finished if it can be
+	pem, err := publicPEM(newPub)
+	if err != nil {
+		return err
+	}
+	newPEM := pemPath(serno) + ".new"
+	if err = ioutil.WriteFile(newPEM, []byte(pem), 0644); err != nil {
+		return err
+	}
+	if !SQL(DBQFinishRotation, c{unixtime(time.Now()), serno}, c{}) {
+		os.Remove(newPEM)
+		return fmt.Errorf("unable to replace key for %s", serno)
+	}
+	if err = os.Rename(newPEM, pemPath(serno)); err != nil {
+		log.Printf("unable to replace %s: %s\n", pemPath(serno), err.Error())
+	}
+	_, err = editAuthKeys(func(line string) string {
+		switch {
+		case authKeyLineHasKey(line, reg.pubKey):
+			// revoke the old key
+			return ""
+		case authKeyLineHasKey(line, newPub):
+			// the new key gets the usual semaphore for its next
+			// connection
+			return strings.TrimSuffix(authKeyLine(serno, reg.tunnelPort, reg.verified, newPub, string(serno)), "\n")
+		}
+		return line
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("finished key rotation for %s; old key revoked\n", serno)
+	return nil
+}
+
+// abandon rotating a receiver's key pair, revoking the new key
+func CancelKeyRotation(serno Serno) error {
+	var (
+		newPub, newPriv string
+		ts              float64
+	)
+	if !SQL(DBQGetRotation, c{serno}, c{&newPub, &newPriv, &ts}) {
+		return fmt.Errorf("no key rotation in progress for %s", serno)
+	}
+	if !SQL(DBQCancelRotation, c{serno}, c{}) {
+		return fmt.Errorf("unable to cancel key rotation for %s", serno)
+	}
+	_, err := editAuthKeys(func(line string) string {
+		if authKeyLineHasKey(line, newPub) {
+			return ""
+		}
+		return line
+	})
+	log.Printf("cancelled key rotation for %s\n", serno)
+	return err
+}
+
+// a key rotation in progress
+type KeyRotation struct {
+	Serno   Serno
+	Started time.Time
+}
+
+// get key rotations in progress, oldest first
+func GetKeyRotations() (rots []KeyRotation) {
+	rows, err := SQLRows(DBQGetRotations, c{})
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			serno string
+			ts    float64
+		)
+		if rows.Scan(&serno, &ts) == nil {
+			rots = append(rots, KeyRotation{Serno(serno), fromUnixtime(ts)})
+		}
+	}
+	return
+}
+
+// goroutine to finish key rotations when receivers connect with their
+// new keys, and, every `interval`, to abandon rotations older than
+// `grace`, then start rotations for up to `batch` receivers whose keys
+// are older than `maxAge`; if maxAge is zero, rotations are only
+// started by the `rotatekey` command.
+func KeyRotator(grace, maxAge time.Duration, batch int, interval time.Duration) {
+	evt := Bus.Sub(MsgSGNewKey)
+	go func() {
+		defer evt.Unsub("*")
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case msg, ok := <-evt.Msgs():
+				if !ok {
+					return
+				}
+				serno := Serno(msg.Msg.(SGMsg).sender)
+				if err := FinishKeyRotation(serno); err != nil {
+					log.Printf("unable to finish key rotation for %s: %s\n", serno, err.Error())
+				}
+			case now := <-tick.C:
+				for _, r := range GetKeyRotations() {
+					if now.Sub(r.Started) > grace {
+						log.Printf("%s has not connected with its new key since %s; abandoning key rotation\n", r.Serno, r.Started.Format(time.RFC3339))
+						if err := CancelKeyRotation(r.Serno); err != nil {
+							log.Printf("unable to cancel key rotation for %s: %s\n", r.Serno, err.Error())
+						}
+					}
+				}
+				if maxAge <= 0 {
+					continue
+				}
+				rows, err := SQLRows(DBQGetStaleKeys, c{unixtime(now.Add(-maxAge)), batch})
+				if err != nil {
+					continue
+				}
+				var sernos []Serno
+				for rows.Next() {
+					var serno string
+					if rows.Scan(&serno) == nil {
+						sernos = append(sernos, Serno(serno))
+					}
+				}
+				rows.Close()
+				for _, serno := range sernos {
+					if err := StartKeyRotation(serno); err != nil {
+						log.Printf("unable to start key rotation for %s: %s\n", serno, err.Error())
+					}
+				}
+			}
+		}
+	}()
+}
+
+// publish MsgSGNewKey if a connection semaphore is for a new key
+//
+// Called by ConnectionWatcher for each semaphore created.
+func checkNewKeySem(name string, serno string, ts time.Time) {
+	if strings.HasSuffix(name, newKeySemSuffix) {
+		Bus.Pub(mbus.Msg{MsgSGNewKey, SGMsg{ts: ts, sender: serno, text: MsgSGNewKey + " " + serno + " connected with its new key"}})
+	}
+}
+
+// reply to a status server request about key rotations
+//
+// `words` are the words of the request: "rotatekey" lists rotations in
+// progress as CSV; "rotatekey SERNO" starts one, and "rotatekey cancel
+// SERNO" abandons one.
+func KeyRotationReply(words []string) string {
+	switch {
+	case len(words) == 1:
+		var b strings.Builder
+		b.WriteString("serno,started\n")
+		for _, r := range GetKeyRotations() {
+			fmt.Fprintf(&b, "%s,%s\n", r.Serno, r.Started.UTC().Format(time.RFC3339))
+		}
+		return b.String()
+	case len(words) == 3 && words[1] == "cancel":
+		serno := lookupSerno(words[2])
+		if serno == "" {
+			return "Error: invalid serial number " + words[2]
+		}
+		if err := CancelKeyRotation(serno); err != nil {
+			return "Error: " + err.Error()
+		}
+		return "OK: key rotation for " + string(serno) + " cancelled"
+	case len(words) == 2:
+		serno := lookupSerno(words[1])
+		if serno == "" {
+			return "Error: invalid serial number " + words[1]
+		}
+		if err := StartKeyRotation(serno); err != nil {
+			return "Error: " + err.Error()
+		}
+		return "OK: new key for " + string(serno) + " will be issued at its next registration"
+	}
+	return "Error: usage: " + words[0] + " [SERNO | cancel SERNO]"
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// get the new public key of a key rotation in progress
+func testRotation(t *testing.T, serno Serno) (newPub string, ok bool) {
+	t.Helper()
+	var (
+		newPriv string
+		ts      float64
+	)
+	ok = SQL(DBQGetRotation, c{serno}, c{&newPub, &newPriv, &ts})
+	return
+}
+
+func TestKeyRotation(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMasterKey(t)
+	const serno = Serno("SG-1234BBBK5678")
+	oldPub := testRegister(t, serno, true)
+
+	if err := FinishKeyRotation(serno); err != nil {
+		t.Errorf("finishing with no rotation: %s", err)
+	}
+	if err := StartKeyRotation(serno); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartKeyRotation(serno); err == nil {
+		t.Error("started a second rotation")
+	}
+	if r := GetKeyRotations(); len(r) != 1 || r[0].Serno != serno {
+		t.Errorf("rotations %v, want one for %s", r, serno)
+	}
+	newPub, ok := testRotation(t, serno)
+	if !ok {
+		t.Fatal("no key rotation recorded")
+	}
+	reg, _ := DB.GetRegistration(serno)
+	if lines := testAuthKeyLines(t, oldPub); len(lines) != 1 {
+		t.Errorf("old key not accepted during rotation: %q", lines)
+	}
+	if lines := testAuthKeyLines(t, newPub); len(lines) != 1 || lines[0]+"\n" != authKeyLine(serno, reg.tunnelPort, true, newPub, string(serno)+newKeySemSuffix) {
+		t.Errorf("new key not accepted with its own semaphore: %q", lines)
+	}
+
+	if err := FinishKeyRotation(serno); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := testRotation(t, serno); ok {
+		t.Error("rotation still in progress after finishing")
+	}
+	if reg, _ = DB.GetRegistration(serno); reg.pubKey != newPub {
+		t.Error("new key not stored")
+	}
+	if lines := testAuthKeyLines(t, oldPub); len(lines) != 0 {
+		t.Errorf("old key not revoked: %q", lines)
+	}
+	if lines := testAuthKeyLines(t, newPub); len(lines) != 1 || lines[0]+"\n" != authKeyLine(serno, reg.tunnelPort, true, newPub, string(serno)) {
+		t.Errorf("new key not given the usual semaphore: %q", lines)
+	}
+	want, _ := publicPEM(newPub)
+	if pem, err := ioutil.ReadFile(pemPath(serno)); err != nil || string(pem) != want {
+		t.Errorf("public key file not replaced: %v", err)
+	}
+}
+
+func TestCancelKeyRotation(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMasterKey(t)
+	const serno = Serno("SG-1234BBBK5678")
+	oldPub := testRegister(t, serno, true)
+
+	if err := CancelKeyRotation(serno); err == nil {
+		t.Error("cancelled a rotation which wasn't started")
+	}
+	if err := StartKeyRotation(serno); err != nil {
+		t.Fatal(err)
+	}
+	newPub, _ := testRotation(t, serno)
+	if err := CancelKeyRotation(serno); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := testRotation(t, serno); ok {
+		t.Error("rotation still in progress after cancelling")
+	}
+	if reg, _ := DB.GetRegistration(serno); reg.pubKey != oldPub {
+		t.Error("key replaced by a cancelled rotation")
+	}
+	if lines := testAuthKeyLines(t, newPub); len(lines) != 0 {
+		t.Errorf("new key not revoked: %q", lines)
+	}
+	if lines := testAuthKeyLines(t, oldPub); len(lines) != 1 {
+		t.Errorf("old key revoked: %q", lines)
+	}
+}
+
+func TestFinishKeyRotationUnwritablePEM(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMasterKey(t)
+	const serno = Serno("SG-1234BBBK5678")
+	oldPub := testRegister(t, serno, true)
+	if err := StartKeyRotation(serno); err != nil {
+		t.Fatal(err)
+	}
+	keyDir = filepath.Join(keyDir, "missing")
+	if err := FinishKeyRotation(serno); err == nil {
+		t.Fatal("finished without writing the public key file")
+	}
+	if _, ok := testRotation(t, serno); !ok {
+		t.Error("rotation no longer in progress")
+	}
+	if reg, _ := DB.GetRegistration(serno); reg.pubKey != oldPub {
+		t.Error("key replaced without writing the public key file")
+	}
+	if lines := testAuthKeyLines(t, oldPub); len(lines) != 1 {
+		t.Errorf("old key revoked: %q", lines)
+	}
+}
+
+func TestKeyRotationReplyLegacySerno(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMasterKey(t)
+	testRegister(t, "SG-SG-1234BBBK5678", true)
+
+	if r := KeyRotationReply([]string{"rotatekey", "SG-1234BBBK5678"}); !strings.HasPrefix(r, "OK: new key for SG-SG-1234BBBK5678") {
+		t.Fatalf("rotatekey: %q", r)
+	}
+	if r := KeyRotationReply([]string{"rotatekey"}); !strings.Contains(r, "\nSG-SG-1234BBBK5678,") {
+		t.Errorf("rotatekey list: %q", r)
+	}
+	if r := KeyRotationReply([]string{"rotatekey", "cancel", "SG-1234BBBK5678"}); r != "OK: key rotation for SG-SG-1234BBBK5678 cancelled" {
+		t.Errorf("rotatekey cancel: %q", r)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/jbrzusto/mbus"
+	"time"
+)
+
+// Liveness
+//
+// ConnectionWatcher only tells us whether a receiver's ssh connection
+// is up.  The ssh tunnel can stay up while uploader.js on the SG has
+// died, in which case the receiver is connected but sends nothing.
+// To catch this, we record the time of the most recent message on
+// each topic from each receiver, and flag connected receivers which
+// have been silent for too long.
+
+// time at which we last heard from an SG: the most recent of its
+// connection time and its last message on any topic
+//
+// The caller must hold the lock on the SG.
+func (sg *ActiveSG) lastHeard() time.Time {
+	t := sg.TsConn
+	for _, ts := range sg.LastMsg {
+		if ts.After(t) {
+			t = ts
+		}
+	}
+	return t
+}
+
+// record a message from an SG on `topic` at `ts`, clearing its Silent
+// flag; returns whether it was set
+//
+// The caller must hold the lock on the SG.
+func (sg *ActiveSG) heard(topic string, ts time.Time) (wasSilent bool) {
+	if sg.LastMsg == nil {
+		sg.LastMsg = make(map[string]time.Time)
+	}
+	sg.LastMsg[topic] = ts
+	wasSilent = sg.Silent
+	sg.Silent = false
+	return
+}
+
+// mark an SG Silent if it is connected and has sent nothing for
+// longer than `threshold` before `now`; returns whether it was newly
+// marked
+//
+// The caller must hold the lock on the SG.
+func (sg *ActiveSG) checkSilent(now time.Time, threshold time.Duration) bool {
+	if !sg.Connected || sg.Silent || now.Sub(sg.lastHeard()) <= threshold {
+		return false
+	}
+	sg.Silent = true
+	return true
+}
+
+// goroutine to track the liveness of connected receivers
+//
+// Records the time of each message from an SG in its ActiveSG.  Every
+// `interval`, any connected receiver which has sent nothing for
+// longer than `threshold` is marked Silent, and an MsgSGSilent message
+// is published.  The flag is cleared when the receiver next sends a
+// message.  MsgStatusChange is published whenever the flag changes.
+func LivenessMonitor(threshold, interval time.Duration) {
+	// subscribe only to topics sent by SGs, so that we never receive
+	// our own messages
+	evt := Bus.Sub(MsgGPS, MsgMachineInfo, MsgTimeSync, MsgDeviceSetting, MsgDevAdded, MsgDevRemoved, MsgTag)
+	go func() {
+		defer evt.Unsub("*")
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case msg, ok := <-evt.Msgs():
+				if !ok {
+					return
+				}
+				if msg.Msg == nil {
+					continue
+				}
+				m := msg.Msg.(SGMsg)
+				sgp, ok := activeSGs.Load(Serno(m.sender))
+				if !ok {
+					continue
+				}
+				ts := m.ts
+				if ts.IsZero() {
+					ts = time.Now()
+				}
+				sg := sgp.(*ActiveSG)
+				sg.lock.Lock()
+				wasSilent := sg.heard(string(msg.Topic), ts)
+				sg.lock.Unlock()
+				if wasSilent {
+					Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+				}
+			case now := <-tick.C:
+				changed := false
+				activeSGs.Range(func(sno interface{}, sgp interface{}) bool {
+					sg := sgp.(*ActiveSG)
+					sg.lock.Lock()
+					silent := sg.checkSilent(now, threshold)
+					sg.lock.Unlock()
+					if silent {
+						Bus.Pub(mbus.Msg{MsgSGSilent, SGMsg{sender: string(sno.(Serno)), ts: now}})
+						changed = true
+					}
+					return true
+				})
+				if changed {
+					Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+				}
+			}
+		}
+	}()
+}
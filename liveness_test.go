@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	const threshold = 30 * time.Minute
+	t0 := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	sg := &ActiveSG{Connected: true, TsConn: t0}
+
+	if sg.checkSilent(t0.Add(threshold), threshold) {
+		t.Error("silent before the threshold")
+	}
+	// a message on any topic counts
+	if sg.heard(MsgGPS, t0.Add(20*time.Minute)) {
+		t.Error("silent before being marked")
+	}
+	sg.heard(MsgTag, t0.Add(10*time.Minute))
+	if got := sg.lastHeard(); !got.Equal(t0.Add(20 * time.Minute)) {
+		t.Errorf("last heard at %s, want 00:20", got)
+	}
+	if sg.checkSilent(t0.Add(50*time.Minute), threshold) {
+		t.Error("silent within the threshold of the last message")
+	}
+	if !sg.checkSilent(t0.Add(51*time.Minute), threshold) || !sg.Silent {
+		t.Error("not silent after the threshold")
+	}
+	if sg.checkSilent(t0.Add(52*time.Minute), threshold) {
+		t.Error("marked silent twice")
+	}
+	if !sg.heard(MsgTag, t0.Add(53*time.Minute)) || sg.Silent {
+		t.Error("silence not cleared by a message")
+	}
+
+	// a disconnected receiver is never silent
+	sg = &ActiveSG{TsConn: t0}
+	if sg.checkSilent(t0.Add(24*time.Hour), threshold) {
+		t.Error("disconnected receiver marked silent")
+	}
+}
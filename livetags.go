@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a tag detection, parsed from the text of a MsgTag message
+//
+// The SG sends detections as lines like
+//
+//	p3,1441318337.1234,Project#123:4.7@166.38,...
+//
+// i.e. "p" followed by the antenna port number, the detection
+// timestamp (seconds since the epoch), the tag ID, and then
+// further fields which we pass through uninterpreted.
+type Detection struct {
+	Serno  Serno    // receiver which made the detection
+	Port   int      // antenna port
+	Ts     float64  // detection timestamp, as reported by the receiver
+	TagID  string   // ID of the tag
+	Fields []string `json:",omitempty"` // any remaining fields
+}
+
+// parse a detection from a MsgTag message
+//
+// returns false if the message text is not a valid detection.
+func ParseDetection(m SGMsg) (d Detection, ok bool) {
+	parts := strings.Split(strings.TrimSpace(m.text), ",")
+	if len(parts) < 3 || len(parts[0]) < 2 || parts[0][0] != MsgTag[0] {
+		return
+	}
+	var err error
+	if d.Port, err = strconv.Atoi(parts[0][1:]); err != nil {
+		return
+	}
+	if d.Ts, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	d.Serno = Serno(m.sender)
+	d.TagID = parts[2]
+	d.Fields = parts[3:]
+	return d, true
+}
+
+// a web client receiving live detections
+type liveClient struct {
+	want func(Serno) bool // which receivers the client wants detections from
+	dets chan Detection   // detections waiting to be sent to the client
+}
+
+// set of live clients
+//
+// Clients are added and removed by LiveTagHandler, and fed by
+// LiveTagRelay.
+var liveClients = struct {
+	clients map[*liveClient]bool
+	lock    sync.Mutex
+}{clients: make(map[*liveClient]bool)}
+
+// relay tag detections to live web clients
+//
+// Each detection is queued for every client that wants it.  A
+// client whose queue is full misses the detection, rather than
+// holding up the message bus.
+func LiveTagRelay() {
+	evt := Bus.Sub(MsgTag)
+	go func() {
+		defer evt.Unsub("*")
+		for msg := range evt.Msgs() {
+			d, ok := ParseDetection(msg.Msg.(SGMsg))
+			if !ok {
+				continue
+			}
+			liveClients.lock.Lock()
+			for lc := range liveClients.clients {
+				if !lc.want(d.Serno) {
+					continue
+				}
+				select {
+				case lc.dets <- d:
+				default:
+				}
+			}
+			liveClients.lock.Unlock()
+		}
+	}()
+}
+
+// stream live tag detections to a web client as Server-Sent Events
+//
+// The request looks like one of:
+//
+//	/detections/live?serno=SG-1234BBBK5678
+//	/detections/live?project=123
+//
+// and the user must be authorized for the receiver or project.
+// Each detection is sent as an event of type "detection" whose
+// data is the JSON-encoded Detection.
+func LiveTagHandler(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	if token == nil {
+		http.Error(w, "401 - Motus login required", http.StatusUnauthorized)
+		return
+	}
+	lc := &liveClient{dets: make(chan Detection, LiveTagBacklog)}
+	if s := r.FormValue("serno"); s != "" {
+		serno := parseSerno(s)
+		if serno == "" || !Authorized(token.UserID, serno) {
+			http.Error(w, "401 - not authorized for device", http.StatusUnauthorized)
+			return
+		}
+		lc.want = func(s Serno) bool { return s == serno }
+	} else if p := r.FormValue("project"); p != "" {
+		projectID, err := strconv.Atoi(p)
+		if err != nil || !AuthorizedProject(token.UserID, projectID) {
+			http.Error(w, "401 - not authorized for project", http.StatusUnauthorized)
+			return
+		}
+		lc.want = func(s Serno) bool {
+			dep, known := MotusInfo.Dep(s)
+			return known && dep.ProjectID == projectID
+		}
+	} else {
+		http.Error(w, "400 - must specify serno or project", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 - streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // tell nginx not to buffer the stream
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	liveClients.lock.Lock()
+	liveClients.clients[lc] = true
+	liveClients.lock.Unlock()
+	defer func() {
+		liveClients.lock.Lock()
+		delete(liveClients.clients, lc)
+		liveClients.lock.Unlock()
+	}()
+
+	keepAlive := time.NewTicker(LiveTagKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case d := <-lc.dets:
+			js, _ := json.Marshal(d)
+			_, err = fmt.Fprintf(w, "event: detection\ndata: %s\n\n", js)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDetection(t *testing.T) {
+	tests := []struct {
+		text string
+		want Detection
+		ok   bool
+	}{
+		{"p3,1441318337.1234,TestTags#123.1:4.7@166.38,1.2,0.1,-45,2,-80\n",
+			Detection{"SG-1234BBBK5678", 3, 1441318337.1234, "TestTags#123.1:4.7@166.38", []string{"1.2", "0.1", "-45", "2", "-80"}}, true},
+		{"p10,1441318337,TAG#1",
+			Detection{"SG-1234BBBK5678", 10, 1441318337, "TAG#1", []string{}}, true},
+		{"p3,1441318337", Detection{}, false},
+		{"p,1441318337,TAG#1", Detection{}, false},
+		{"px,1441318337,TAG#1", Detection{}, false},
+		{"p3,yesterday,TAG#1", Detection{}, false},
+		{"G,1441318337,45.1,-64.3", Detection{}, false},
+		{"", Detection{}, false},
+	}
+	for _, tt := range tests {
+		d, ok := ParseDetection(SGMsg{sender: "SG-1234BBBK5678", text: tt.text})
+		if ok != tt.ok {
+			t.Errorf("ParseDetection(%q): ok %v, want %v", tt.text, ok, tt.ok)
+			continue
+		}
+		if ok && !reflect.DeepEqual(d, tt.want) {
+			t.Errorf("ParseDetection(%q) = %+v, want %+v", tt.text, d, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/jbrzusto/mbus"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// an item of machine information, parsed from the text of a
+// MsgMachineInfo message
+//
+// The SG sends these as lines like
+//
+//	M,1441318337,bootCount,27
+//
+// i.e. the timestamp (seconds since the epoch), the name of the item
+// and its value.  pushStartupInfo() in uploader.js sends `machineID`
+// and `bootCount` each time it starts; newer images also send items
+// such as `version` and `hardware`.
+type MachineInfoItem struct {
+	Ts    float64 // timestamp of item, as reported by the receiver
+	Name  string  // name of item
+	Value string  // value of item; may contain commas
+}
+
+// parse an item of machine information from the text of a
+// MsgMachineInfo message
+//
+// returns false if the message text is not a valid item.
+func ParseMachineInfo(text string) (m MachineInfoItem, ok bool) {
+	parts := strings.SplitN(strings.TrimSpace(text), ",", 4)
+	if len(parts) < 4 || parts[0] != MsgMachineInfo || parts[2] == "" {
+		return
+	}
+	var err error
+	if m.Ts, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	m.Name, m.Value = parts[2], parts[3]
+	return m, true
+}
+
+// machine information for a receiver
+type MachineInfo struct {
+	Items     map[string]string // most recent value of each item
+	Version   string            // software version (image date), if reported
+	BootCount int               // number of times the receiver has booted, if reported
+	Hardware  string            // hardware type; if not reported, taken from the serial number
+	TsBoot    time.Time         // time of the most recent boot, as reported by the receiver
+}
+
+// regular expression matching the hardware type in a serial number,
+// e.g. BBBK in SG-1614BBBK1666
+var sernoHardwareRE = regexp.MustCompile(`^SG-[0-9A-Z]{4}([A-Z0-9]{4})[0-9A-Z]{4}`)
+
+// create an empty MachineInfo for a receiver
+func NewMachineInfo(serno Serno) *MachineInfo {
+	mi := &MachineInfo{Items: make(map[string]string)}
+	if m := sernoHardwareRE.FindStringSubmatch(string(serno)); m != nil {
+		mi.Hardware = m[1]
+	}
+	return mi
+}
+
+// record an item of machine information
+//
+// Each uploader start sends a `bootCount`, so we take the time of that
+// item to be the time of the most recent boot.
+func (mi *MachineInfo) Set(m MachineInfoItem) {
+	mi.Items[m.Name] = m.Value
+	switch m.Name {
+	case "version":
+		mi.Version = m.Value
+	case "hardware":
+		mi.Hardware = m.Value
+	case "bootCount":
+		if n, err := strconv.Atoi(m.Value); err == nil {
+			mi.BootCount = n
+			mi.TsBoot = fromUnixtime(m.Ts)
+		}
+	}
+}
+
+// get the machine information for a receiver from the database
+//
+// For receivers with no entries in machine_info (i.e. not heard from
+// since that table was created), items are replayed from the messages
+// table instead.
+func LoadMachineInfo(serno Serno) *MachineInfo {
+	mi := NewMachineInfo(serno)
+	have := false
+	if rows, err := SQLRows(DBQGetMachineInfo, c{serno}); err == nil {
+		for rows.Next() {
+			var m MachineInfoItem
+			if rows.Scan(&m.Ts, &m.Name, &m.Value) == nil {
+				mi.Set(m)
+				have = true
+			}
+		}
+		rows.Close()
+	}
+	if have {
+		return mi
+	}
+	// messages come most recent first, so replay them in reverse
+	var items []MachineInfoItem
+	if rows, err := SQLRows(DBQGetMsgsOfType, c{serno, MsgMachineInfo, -1}); err == nil {
+		for rows.Next() {
+			var (
+				ts  float64
+				msg string
+			)
+			if rows.Scan(&ts, &msg) == nil {
+				if m, ok := ParseMachineInfo(msg); ok {
+					items = append(items, m)
+				}
+			}
+		}
+		rows.Close()
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		mi.Set(items[i])
+	}
+	return mi
+}
+
+// goroutine to maintain the machine information of receivers
+//
+// Each item is recorded in the machine_info table, which holds only
+// the most recent value of each item for each receiver, and in the
+// receiver's ActiveSG.  When a receiver's bootCount increases, an
+// MsgSGReboot message is published.
+func MachineInfoMonitor() {
+	evt := Bus.Sub(MsgMachineInfo)
+	go func() {
+		defer evt.Unsub("*")
+		for msg := range evt.Msgs() {
+			sm := msg.Msg.(SGMsg)
+			m, ok := ParseMachineInfo(sm.text)
+			if !ok {
+				continue
+			}
+			serno := Serno(sm.sender)
+			if !SQL(DBQSetMachineInfo, c{serno, m.Ts, m.Name, m.Value}, c{}) {
+				log.Printf("unable to record machine info %s for %s\n", m.Name, serno)
+			}
+			sgp, ok := activeSGs.Load(serno)
+			if !ok {
+				continue
+			}
+			sg := sgp.(*ActiveSG)
+			sg.lock.Lock()
+			if sg.Machine == nil {
+				sg.Machine = NewMachineInfo(serno)
+			}
+			mi := sg.Machine
+			version, tsBoot, bootCount := mi.Version, mi.TsBoot, mi.BootCount
+			mi.Set(m)
+			changed := mi.Version != version || !mi.TsBoot.Equal(tsBoot)
+			// a receiver's first bootCount, or one which has gone down
+			// (e.g. after its SD card was reflashed), is not a reboot
+			rebooted := bootCount > 0 && mi.BootCount > bootCount
+			newCount := mi.BootCount
+			sg.lock.Unlock()
+			if rebooted {
+				text := fmt.Sprintf("%s rebooted; boot count is %d (was %d)", MsgSGReboot, newCount, bootCount)
+				Bus.Pub(mbus.Msg{MsgSGReboot, SGMsg{ts: sm.ts, sender: string(serno), text: text}})
+			}
+			if changed {
+				Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+			}
+		}
+	}()
+}
+
+// get the machine information for every registered receiver, by serial
+// number
+func GetFleetMachineInfo() (sernos []Serno, info map[Serno]*MachineInfo) {
+	info = make(map[Serno]*MachineInfo)
+	rows, err := SQLRows(DBQGetSernos, c{})
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var serno Serno
+		if rows.Scan(&serno) == nil {
+			sernos = append(sernos, serno)
+		}
+	}
+	rows.Close()
+	for _, serno := range sernos {
+		if sgp, ok := activeSGs.Load(serno); ok {
+			sg := sgp.(*ActiveSG)
+			sg.lock.Lock()
+			if sg.Machine != nil {
+				mi := *sg.Machine
+				info[serno] = &mi
+			}
+			sg.lock.Unlock()
+		}
+		if info[serno] == nil {
+			info[serno] = LoadMachineInfo(serno)
+		}
+	}
+	return
+}
+
+// reply to a status server request for the software versions of
+// receivers
+//
+// `words` are the words of the request: "versions [VERSION]".  The
+// reply is CSV, one line per registered receiver, with boot times in
+// UTC; if VERSION is given, only receivers running that version are
+// listed.  Receivers which have never reported a version (e.g. those
+// running the 2015-08-27 image) have an empty version, and can be
+// selected with VERSION `unknown`.
+func VersionsReply(words []string) string {
+	want := ""
+	if len(words) > 1 {
+		want = words[1]
+	}
+	sernos, info := GetFleetMachineInfo()
+	var b strings.Builder
+	cw := csv.NewWriter(&b)
+	cw.Write([]string{"serno", "version", "hardware", "bootCount", "lastBoot"})
+	for _, serno := range sernos {
+		mi := info[serno]
+		switch {
+		case want == "":
+		case want == "unknown" && mi.Version == "":
+		case want == mi.Version:
+		default:
+			continue
+		}
+		boot := ""
+		if !mi.TsBoot.IsZero() {
+			boot = mi.TsBoot.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{string(serno), mi.Version, mi.Hardware, strconv.Itoa(mi.BootCount), boot})
+	}
+	cw.Flush()
+	return b.String()
+}
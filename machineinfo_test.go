@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMachineInfo(t *testing.T) {
+	tests := []struct {
+		text string
+		want MachineInfoItem
+		ok   bool
+	}{
+		{"M,1441318337,bootCount,27\n", MachineInfoItem{1441318337, "bootCount", "27"}, true},
+		{"M,1441318337.5,hardware,BeagleBone Black, rev C", MachineInfoItem{1441318337.5, "hardware", "BeagleBone Black, rev C"}, true},
+		{"M,1441318337,version,", MachineInfoItem{1441318337, "version", ""}, true},
+		{"M,1441318337,,27", MachineInfoItem{}, false},
+		{"M,1441318337,bootCount", MachineInfoItem{}, false},
+		{"M,yesterday,bootCount,27", MachineInfoItem{}, false},
+		{"G,1441318337,bootCount,27", MachineInfoItem{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseMachineInfo(tt.text)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("ParseMachineInfo(%q) = %v, %v; want %v, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMachineInfoSet(t *testing.T) {
+	mi := NewMachineInfo("SG-1614BBBK1666")
+	if mi.Hardware != "BBBK" {
+		t.Errorf("hardware from serial number %q, want BBBK", mi.Hardware)
+	}
+	mi.Set(MachineInfoItem{1441318337, "bootCount", "27"})
+	mi.Set(MachineInfoItem{1441318338, "version", "2019-01-15"})
+	mi.Set(MachineInfoItem{1441318339, "hardware", "rpi3"})
+	mi.Set(MachineInfoItem{1441318340, "bootCount", "many"})
+	if mi.BootCount != 27 || !mi.TsBoot.Equal(fromUnixtime(1441318337)) {
+		t.Errorf("boot count %d at %s, want 27 at 1441318337", mi.BootCount, mi.TsBoot)
+	}
+	if mi.Version != "2019-01-15" || mi.Hardware != "rpi3" || mi.Items["bootCount"] != "many" {
+		t.Errorf("machine info %+v", *mi)
+	}
+}
+
+func TestLoadMachineInfo(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testRegister(t, "SG-1234BBBK5678", true)
+	testRegister(t, "SG-5678RPI31234", true)
+
+	// a receiver heard from since machine_info was created
+	SQL(DBQSetMachineInfo, c{Serno("SG-1234BBBK5678"), 1441318337.0, "bootCount", "27"}, c{})
+	SQL(DBQSetMachineInfo, c{Serno("SG-1234BBBK5678"), 1441318338.0, "version", "2019-01-15"}, c{})
+	// one only in the messages table, where later items win
+	DB.AddMessages([]dbMsg{
+		{1441318300, "SG-5678RPI31234", "M,1441318300,bootCount,3"},
+		{1441318400, "SG-5678RPI31234", "M,1441318400,bootCount,4"},
+		{1441318401, "SG-5678RPI31234", "G,1441318401,45.1,-64.5,20"},
+	})
+
+	mi := LoadMachineInfo("SG-1234BBBK5678")
+	if mi.BootCount != 27 || mi.Version != "2019-01-15" || mi.Hardware != "BBBK" {
+		t.Errorf("machine info from machine_info: %+v", *mi)
+	}
+	mi = LoadMachineInfo("SG-5678RPI31234")
+	if mi.BootCount != 4 || !mi.TsBoot.Equal(fromUnixtime(1441318400)) || mi.Version != "" {
+		t.Errorf("machine info from messages: %+v", *mi)
+	}
+
+	r := VersionsReply([]string{"versions"})
+	if !strings.HasPrefix(r, "serno,version,hardware,bootCount,lastBoot\n") ||
+		!strings.Contains(r, "SG-1234BBBK5678,2019-01-15,BBBK,27,2015-09-03T22:12:17Z\n") ||
+		!strings.Contains(r, "SG-5678RPI31234,,RPI3,4,") {
+		t.Errorf("versions: %q", r)
+	}
+	if r = VersionsReply([]string{"versions", "unknown"}); strings.Contains(r, "SG-1234BBBK5678") || !strings.Contains(r, "SG-5678RPI31234") {
+		t.Errorf("versions unknown: %q", r)
+	}
+	if r = VersionsReply([]string{"versions", "2019-01-15"}); !strings.Contains(r, "SG-1234BBBK5678") || strings.Contains(r, "SG-5678RPI31234") {
+		t.Errorf("versions 2019-01-15: %q", r)
+	}
+}
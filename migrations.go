@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Schema migrations
+//
+// The database schema is built by a series of migrations, each of
+// which takes it from one version to the next.  The schema_version
+// table records each migration applied to a database, so at startup,
+// OpenStore() need only run those with a higher version, in order, each
+// in its own transaction.  To change the schema, append a migration to
+// dbMigrations; never edit or reorder one which has been released, as
+// it will not be run again on databases which already have it.
+//
+// Migrations up to version 6 create the schema as it was before
+// versioning, and use IF NOT EXISTS so that they leave existing
+// databases unchanged.
+
+// a change to the database schema
+type migration struct {
+	version int                                    // schema version after this migration
+	name    string                                 // what it does
+	stmts   []string                               // statements, written for sqlite; see pgDialect()
+	fn      func(tx *sql.Tx, dialect string) error // if not nil, run after stmts, for changes to data which can't be made in SQL
+}
+
+// all migrations, in order of version, which starts at 1
+var dbMigrations = []migration{
+	{1, "messages and receivers", []string{
+		`CREATE TABLE IF NOT EXISTS messages (
+                    ts DOUBLE,
+                    sender TEXT,
+                    message TEXT
+                )`,
+		`CREATE INDEX IF NOT EXISTS messages_ts ON messages(ts)`,
+		`CREATE INDEX IF NOT EXISTS messages_sender ON messages(sender)`,
+		`CREATE INDEX IF NOT EXISTS messages_sender_ts ON messages(sender, ts)`,
+		`CREATE INDEX IF NOT EXISTS messages_sender_type_ts ON messages(sender, substr(message, 1, 1), ts)`,
+		`CREATE TABLE IF NOT EXISTS receivers (
+                 serno        TEXT UNIQUE PRIMARY KEY, -- only one entry per receiver
+                 creationdate REAL,                    -- timestamp when this entry was created
+                 tunnelport   INTEGER UNIQUE,          -- port used on server for reverse tunnel back to sensorgnome
+                 pubkey       TEXT,                    -- unique public/private key pair used by sensorgnome to login to server
+                 privkey      TEXT,
+                 verified     INTEGER DEFAULT 0        -- has this SG been verified to belong to a real user?
+                 )`,
+		`CREATE INDEX IF NOT EXISTS receivers_tunnelport ON receivers(tunnelport)`,
+		`CREATE TABLE IF NOT EXISTS deleted_receivers (
+                 ts           REAL,                    -- deletion timestamp
+                 serno        TEXT,                    -- possibly multiple entries per receiver
+                 creationdate REAL,                    -- timestamp when this entry was created
+                 tunnelport   INTEGER,                 -- port used on server for reverse tunnel back to sensorgnome
+                 pubkey       TEXT,                    -- unique public/private key pair used by sensorgnome to login to server
+                 privkey      TEXT,
+                 verified     INTEGER DEFAULT 0        -- non-zero when verified
+                 )`,
+		`CREATE INDEX IF NOT EXISTS deleted_receivers_tunnelport ON deleted_receivers(tunnelport)`}, nil},
+	{2, "GPS fixes", []string{
+		`CREATE TABLE IF NOT EXISTS gps_fixes (
+                 serno        TEXT,                    -- receiver serial number
+                 ts           DOUBLE,                  -- timestamp of fix, as reported by receiver
+                 lat          DOUBLE,                  -- latitude (degrees N)
+                 lon          DOUBLE,                  -- longitude (degrees E)
+                 alt          DOUBLE                   -- altitude (metres)
+                 )`,
+		`CREATE INDEX IF NOT EXISTS gps_fixes_serno_ts ON gps_fixes(serno, ts)`}, nil},
+	{3, "device history", []string{
+		`CREATE TABLE IF NOT EXISTS device_history (
+                 serno        TEXT,                    -- receiver serial number
+                 port         INTEGER,                 -- USB port number
+                 type         TEXT,                    -- device type, e.g. funcubeProPlus
+                 attrs        TEXT,                    -- further attributes, comma-separated
+                 added        DOUBLE,                  -- timestamp of addition, as reported by receiver
+                 removed      DOUBLE                   -- timestamp of removal, as reported by receiver; NULL while attached
+                 )`,
+		`CREATE INDEX IF NOT EXISTS device_history_serno_port ON device_history(serno, port)`}, nil},
+	{4, "machine info", []string{
+		`CREATE TABLE IF NOT EXISTS machine_info (
+                 serno        TEXT,                    -- receiver serial number
+                 ts           DOUBLE,                  -- timestamp of item, as reported by receiver
+                 name         TEXT,                    -- name of item, e.g. bootCount
+                 value        TEXT,                    -- most recent value of item
+                 PRIMARY KEY (serno, name)             -- only one entry per item per receiver
+                 )`}, nil},
+	{5, "hourly detection counts", []string{
+		`CREATE TABLE IF NOT EXISTS det_hourly (
+                 serno        TEXT,                    -- receiver serial number
+                 hour         INTEGER,                 -- start of hour, in seconds since the epoch, as reported by receiver
+                 port         INTEGER,                 -- antenna port
+                 tagid        TEXT,                    -- tag ID
+                 n            INTEGER,                 -- number of detections
+                 PRIMARY KEY (serno, hour, port, tagid)
+                 )`}, nil},
+	{6, "web sessions", []string{
+		`CREATE TABLE IF NOT EXISTS sessions (
+                 token        TEXT PRIMARY KEY,        -- session cookie value
+                 userid       INTEGER,                 -- motus user ID
+                 expiry       DOUBLE,                  -- timestamp when session expires
+                 email        TEXT,                    -- user's email address
+                 isadmin      INTEGER,                 -- non-zero if user is a motus administrator
+                 projects     TEXT                     -- comma-separated IDs of the user's motus projects
+                 )`}, nil},
+	{7, "encrypt private keys", nil, encryptStoredKeys},
+	{8, "key rotation", []string{
+		// new key pair issued by a key rotation in progress (private
+		// key encrypted), and when the rotation started
+		`ALTER TABLE receivers ADD COLUMN newpubkey TEXT`,
+		`ALTER TABLE receivers ADD COLUMN newprivkey TEXT`,
+		`ALTER TABLE receivers ADD COLUMN rotationts DOUBLE`}, nil},
+	{9, "verify existing receivers", []string{
+		// receivers registered before the verification workflow
+		// keep the access they had; only new ones need approval
+		`UPDATE receivers SET verified = 1 WHERE pubkey IS NOT NULL`}, nil},
+	{10, "deregistration clearing", []string{
+		// when an admin let a deregistered receiver register again;
+		// receivers deleted before this existed are not blocked
+		`ALTER TABLE deleted_receivers ADD COLUMN cleared DOUBLE`,
+		`UPDATE deleted_receivers SET cleared = ts`}, nil},
+	{11, "detection timestamps", []string{
+		// time reported by the receiver for a tag detection, which
+		// can be long before ts if it was relayed after an outage;
+		// NULL for other messages
+		`ALTER TABLE messages ADD COLUMN detts DOUBLE`,
+		`CREATE INDEX IF NOT EXISTS messages_sender_detts ON messages(sender, detts)`}, fillDetectionTs},
+	{12, "motus users", []string{
+		// the email address and motus projects of each user who has
+		// logged in, as of their last login, kept after their
+		// sessions end so they can be sent alerts
+		`CREATE TABLE motus_users (
+                 userid       INTEGER PRIMARY KEY,     -- motus user ID
+                 email        TEXT,                    -- user's email address
+                 projects     TEXT,                    -- comma-separated IDs of the user's motus projects
+                 ts           DOUBLE                   -- timestamp of user's last login
+                 )`,
+		// users with sessions, from their latest one
+		`INSERT INTO motus_users (userid, email, projects, ts)
+                 SELECT userid, email, projects, expiry FROM sessions s
+                 WHERE NOT EXISTS (SELECT 1 FROM sessions s2 WHERE s2.userid = s.userid AND (s2.expiry > s.expiry OR (s2.expiry = s.expiry AND s2.token > s.token)))`}, nil},
+}
+
+// get the schema version of a database
+//
+// Returns 0 if it has no schema_version table, i.e. no migrations have
+// been run.
+func (s *sqlStore) schemaVersion() (v int, err error) {
+	q := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'"
+	if s.dialect == "postgres" {
+		q = "SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'schema_version'"
+	}
+	var n int
+	if err = s.db.QueryRow(q).Scan(&n); err != nil || n == 0 {
+		return 0, err
+	}
+	err = s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&v)
+	return
+}
+
+// get the migrations not yet run on a database
+//
+// Returns an error if the database has a newer schema than this
+// server knows about.
+func (s *sqlStore) pendingMigrations() ([]migration, error) {
+	v, err := s.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	latest := dbMigrations[len(dbMigrations)-1].version
+	if v > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than this server's (%d)", v, latest)
+	}
+	for i, m := range dbMigrations {
+		if m.version > v {
+			return dbMigrations[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+// rewrite an sqlite statement for a dialect
+func dialectSQL(dialect, q string) string {
+	if dialect == "postgres" {
+		return pgDialect(q)
+	}
+	return q
+}
+
+// the statements of a migration, in the store's dialect
+func (s *sqlStore) migrationStmts(m migration) []string {
+	stmts := make([]string, len(m.stmts))
+	for i, st := range m.stmts {
+		stmts[i] = dialectSQL(s.dialect, st)
+	}
+	return stmts
+}
+
+// run a migration and record it in schema_version, in one transaction
+func (s *sqlStore) runMigration(m migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, st := range s.migrationStmts(m) {
+		if _, err = tx.Exec(st); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema migration %d (%s): %s: %s", m.version, m.name, err.Error(), st)
+		}
+	}
+	if m.fn != nil {
+		if err = m.fn(tx, s.dialect); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema migration %d (%s): %s", m.version, m.name, err.Error())
+		}
+	}
+	ins := dialectSQL(s.dialect, "INSERT INTO schema_version (version, name, ts) VALUES (?, ?, ?)")
+	if _, err = tx.Exec(ins, m.version, m.name, unixtime(time.Now())); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// bring the schema of a database up to date
+func (s *sqlStore) migrate() error {
+	st := `CREATE TABLE IF NOT EXISTS schema_version (
+                 version      INTEGER PRIMARY KEY,     -- schema version after migration
+                 name         TEXT,                    -- what the migration does
+                 ts           DOUBLE                   -- timestamp when migration was run
+                 )`
+	if _, err := s.db.Exec(dialectSQL(s.dialect, st)); err != nil {
+		return err
+	}
+	pending, err := s.pendingMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err = s.runMigration(m); err != nil {
+			return err
+		}
+		log.Printf("applied schema migration %d: %s\n", m.version, m.name)
+	}
+	return nil
+}
+
+// print the migrations which OpenStore() would run on a database,
+// without running them
+//
+// `path` is as for OpenStore().  Each migration is printed as an SQL
+// comment followed by its statements; changes made in Go code are
+// only noted.
+func PrintPendingMigrations(w io.Writer, path string) error {
+	s, err := openSQLStore(path)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	v, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	pending, err := s.pendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Fprintf(w, "-- schema is up to date at version %d\n", v)
+		return nil
+	}
+	fmt.Fprintf(w, "-- schema is at version %d; %d migration(s) pending\n", v, len(pending))
+	for _, m := range pending {
+		fmt.Fprintf(w, "\n-- migration %d: %s\n", m.version, m.name)
+		for _, st := range s.migrationStmts(m) {
+			fmt.Fprintf(w, "%s;\n", st)
+		}
+		if m.fn != nil {
+			fmt.Fprintf(w, "-- (changes data in Go code, not shown)\n")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// open a new sqlite database with the schema of a server from before
+// schema versioning, i.e. that of migrations 1 to 6 with no
+// schema_version table, returning it and its path
+func testLegacyStore(t *testing.T) (*sqlStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sg_remote.sqlite")
+	s, err := openSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for _, m := range dbMigrations[:6] {
+		for _, st := range m.stmts {
+			if _, err = s.db.Exec(st); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return s, path
+}
+
+func TestMigrateNewDB(t *testing.T) {
+	testMasterKey(t)
+	path := filepath.Join(t.TempDir(), "sg_remote.sqlite")
+	s, err := openSQLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.schemaVersion(); err != nil || v != 0 {
+		t.Fatalf("new database at version %d (%v), want 0", v, err)
+	}
+	if err = s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	latest := dbMigrations[len(dbMigrations)-1].version
+	if v, err := s.schemaVersion(); err != nil || v != latest {
+		t.Errorf("migrated to version %d (%v), want %d", v, err, latest)
+	}
+	var n int
+	s.db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&n)
+	if n != len(dbMigrations) {
+		t.Errorf("%d migrations recorded, want %d", n, len(dbMigrations))
+	}
+	// migrating again does nothing
+	if err = s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	s.db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&n)
+	if n != len(dbMigrations) {
+		t.Errorf("%d migrations recorded after migrating twice, want %d", n, len(dbMigrations))
+	}
+	var b bytes.Buffer
+	if err = PrintPendingMigrations(&b, path); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "up to date") {
+		t.Errorf("pending migrations of an up-to-date database: %s", b.String())
+	}
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	testMasterKey(t)
+	s, path := testLegacyStore(t)
+	for _, st := range []string{
+		`INSERT INTO receivers (serno, creationdate, tunnelport, pubkey, privkey, verified) VALUES ('SG-1234BBBK5678', 1, 40000, 'ssh-rsa AAAA1', 'PRIVATE KEY 1', 0)`,
+		`INSERT INTO receivers (serno, creationdate, tunnelport) VALUES ('SG-5678BBBK1234', 2, 40001)`,
+		`INSERT INTO deleted_receivers (ts, serno, creationdate, tunnelport, pubkey, privkey, verified) VALUES (3, 'SG-1111BBBK2222', 1, 40002, 'ssh-rsa AAAA2', 'PRIVATE KEY 2', 1)`,
+		`INSERT INTO messages (ts, sender, message) VALUES (10, 'SG-1234BBBK5678', 'p3,1441318337.5,TAG#1')`,
+		`INSERT INTO messages (ts, sender, message) VALUES (11, 'SG-1234BBBK5678', 'p3,yesterday,TAG#1')`,
+		`INSERT INTO messages (ts, sender, message) VALUES (12, 'SG-1234BBBK5678', 'G1441318337,45.1,-64.5,20')`,
+		`INSERT INTO sessions (token, userid, expiry, email, isadmin, projects) VALUES ('t1', 1, 100, 'a@b.org', 0, '123')`,
+		`INSERT INTO sessions (token, userid, expiry, email, isadmin, projects) VALUES ('t2', 1, 200, 'a@b.org', 0, '123,456')`,
+		`INSERT INTO sessions (token, userid, expiry, email, isadmin, projects) VALUES ('t3', 2, 100, 'c@d.org', 0, '456')`,
+	} {
+		if _, err := s.db.Exec(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b bytes.Buffer
+	if err := PrintPendingMigrations(&b, path); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "schema is at version 0") || !strings.Contains(b.String(), "-- migration 12: motus users") {
+		t.Errorf("pending migrations: %s", b.String())
+	}
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// migration 7: private keys are encrypted, in both tables
+	for _, k := range []struct{ table, serno, plain string }{
+		{"receivers", "SG-1234BBBK5678", "PRIVATE KEY 1"},
+		{"deleted_receivers", "SG-1111BBBK2222", "PRIVATE KEY 2"},
+	} {
+		var stored string
+		s.db.QueryRow("SELECT privkey FROM "+k.table+" WHERE serno = ?", k.serno).Scan(&stored)
+		if !strings.HasPrefix(stored, encKeyPrefix) {
+			t.Errorf("%s key of %s not encrypted: %q", k.table, k.serno, stored)
+		}
+		if plain, err := decryptKey(Serno(k.serno), stored); err != nil || plain != k.plain {
+			t.Errorf("%s key of %s decrypts to %q (%v), want %q", k.table, k.serno, plain, err, k.plain)
+		}
+	}
+	// migration 9: receivers with keys stay verified; others must be
+	// approved
+	for serno, want := range map[string]int{"SG-1234BBBK5678": 1, "SG-5678BBBK1234": 0} {
+		var v int
+		s.db.QueryRow("SELECT verified FROM receivers WHERE serno = ?", serno).Scan(&v)
+		if v != want {
+			t.Errorf("%s verified = %d, want %d", serno, v, want)
+		}
+	}
+	// migration 10: earlier deregistrations are cleared
+	var cleared sql.NullFloat64
+	s.db.QueryRow("SELECT cleared FROM deleted_receivers WHERE serno = 'SG-1111BBBK2222'").Scan(&cleared)
+	if !cleared.Valid || cleared.Float64 != 3 {
+		t.Errorf("deregistration cleared at %v, want 3", cleared)
+	}
+	// migration 11: detection timestamps are filled in, for
+	// well-formed detections only
+	for ts, want := range map[int]sql.NullFloat64{
+		10: {Float64: 1441318337.5, Valid: true},
+		11: {},
+		12: {},
+	} {
+		var detts sql.NullFloat64
+		s.db.QueryRow("SELECT detts FROM messages WHERE ts = ?", ts).Scan(&detts)
+		if detts != want {
+			t.Errorf("message at %d has detts %v, want %v", ts, detts, want)
+		}
+	}
+	// migration 12: users with sessions are recorded, with the
+	// projects of their latest session
+	for userid, want := range map[int]string{1: "123,456", 2: "456"} {
+		var projects string
+		s.db.QueryRow("SELECT projects FROM motus_users WHERE userid = ?", userid).Scan(&projects)
+		if projects != want {
+			t.Errorf("user %d has projects %q, want %q", userid, projects, want)
+		}
+	}
+	var n int
+	s.db.QueryRow("SELECT COUNT(*) FROM motus_users").Scan(&n)
+	if n != 2 {
+		t.Errorf("%d motus users recorded, want 2", n)
+	}
+}
+
+func TestMigrateWithoutMasterKey(t *testing.T) {
+	saved := masterKey
+	masterKey = nil
+	defer func() { masterKey = saved }()
+	s, _ := testLegacyStore(t)
+	s.db.Exec(`INSERT INTO receivers (serno, creationdate, tunnelport, pubkey, privkey) VALUES ('SG-1234BBBK5678', 1, 40000, 'ssh-rsa AAAA1', 'PRIVATE KEY 1')`)
+	if err := s.migrate(); err == nil || !strings.Contains(err.Error(), "schema migration 7") {
+		t.Fatalf("migrated without a master key: %v", err)
+	}
+	// the failed migration is rolled back, and later ones not run
+	if v, _ := s.schemaVersion(); v != 6 {
+		t.Errorf("schema at version %d, want 6", v)
+	}
+	var stored string
+	s.db.QueryRow("SELECT privkey FROM receivers").Scan(&stored)
+	if stored != "PRIVATE KEY 1" {
+		t.Errorf("key changed by a failed migration: %q", stored)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	testMasterKey(t)
+	s, _ := testLegacyStore(t)
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	s.db.Exec("INSERT INTO schema_version (version, name, ts) VALUES (?, 'from the future', 0)", dbMigrations[len(dbMigrations)-1].version+1)
+	if err := s.migrate(); err == nil || !strings.Contains(err.Error(), "newer than this server's") {
+		t.Errorf("migrated a newer schema: %v", err)
+	}
+}
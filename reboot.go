@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jbrzusto/mbus"
+	"time"
+)
+
+// Reboots
+//
+// uploader.js sends the receiver's bootCount each time it starts, so
+// an increase in bootCount means the receiver has rebooted since we
+// last heard from it (see MachineInfoMonitor, which publishes an
+// MsgSGReboot message).  A receiver which keeps rebooting is usually
+// short of power: a failing battery or solar panel, or too many
+// devices for its supply.
+
+// recent reboots of receivers, for BootLoopMonitor
+type bootLoops struct {
+	count   int                   // number of reboots within window which is a boot loop
+	window  time.Duration         // period over which reboots are counted
+	reboots map[Serno][]time.Time // recent reboot times by serno, oldest first
+}
+
+// drop reboots older than the window and update the BootLoop flag of
+// a receiver; returns true if the flag changed
+//
+// The caller must hold the lock on the SG.
+func (bl *bootLoops) update(serno Serno, sg *ActiveSG, now time.Time) bool {
+	times := bl.reboots[serno]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > bl.window {
+		i++
+	}
+	times = times[i:]
+	if len(times) == 0 {
+		delete(bl.reboots, serno)
+	} else {
+		bl.reboots[serno] = times
+	}
+	loop := len(times) >= bl.count
+	if loop == sg.BootLoop {
+		return false
+	}
+	sg.BootLoop = loop
+	return true
+}
+
+// goroutine to flag receivers which are stuck in a boot loop
+//
+// A receiver which reboots at least `count` times within `window` is
+// flagged as BootLoop, and an MsgSGBootLoop message is published.  The
+// flag is cleared once the receiver has gone `window` with fewer
+// reboots.
+func BootLoopMonitor(count int, window time.Duration) {
+	evt := Bus.Sub(MsgSGReboot)
+	go func() {
+		defer evt.Unsub("*")
+		bl := &bootLoops{count: count, window: window, reboots: make(map[Serno][]time.Time)}
+		tick := time.NewTicker(window / 10)
+		defer tick.Stop()
+		for {
+			select {
+			case msg, ok := <-evt.Msgs():
+				if !ok {
+					return
+				}
+				m := msg.Msg.(SGMsg)
+				serno := Serno(m.sender)
+				sgp, ok := activeSGs.Load(serno)
+				if !ok {
+					continue
+				}
+				if _, have := bl.reboots[serno]; !have {
+					// recover earlier reboots, e.g. from before the
+					// server was restarted; this one has already been
+					// recorded, so skip it
+					if rows, err := SQLRows(DBQGetMsgsOfType, c{serno, MsgSGReboot, count}); err == nil {
+						var times []time.Time
+						for rows.Next() {
+							var (
+								ts  float64
+								txt string
+							)
+							if rows.Scan(&ts, &txt) == nil {
+								if t := fromUnixtime(ts); m.ts.Sub(t) > time.Millisecond {
+									times = append([]time.Time{t}, times...)
+								}
+							}
+						}
+						rows.Close()
+						bl.reboots[serno] = times
+					}
+				}
+				bl.reboots[serno] = append(bl.reboots[serno], m.ts)
+				sg := sgp.(*ActiveSG)
+				sg.lock.Lock()
+				changed := bl.update(serno, sg, m.ts)
+				n := len(bl.reboots[serno])
+				loop := sg.BootLoop
+				sg.lock.Unlock()
+				if changed && loop {
+					text := fmt.Sprintf("%s %s has rebooted %d times in the last %s", MsgSGBootLoop, serno, n, window)
+					Bus.Pub(mbus.Msg{MsgSGBootLoop, SGMsg{ts: m.ts, sender: string(serno), text: text}})
+				}
+				Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+			case now := <-tick.C:
+				changed := false
+				for serno := range bl.reboots {
+					if sgp, ok := activeSGs.Load(serno); ok {
+						sg := sgp.(*ActiveSG)
+						sg.lock.Lock()
+						changed = bl.update(serno, sg, now) || changed
+						sg.lock.Unlock()
+					}
+				}
+				if changed {
+					Bus.Pub(mbus.Msg{MsgStatusChange, nil})
+				}
+			}
+		}
+	}()
+}
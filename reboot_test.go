@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBootLoops(t *testing.T) {
+	const serno = Serno("SG-1234BBBK5678")
+	t0 := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	bl := &bootLoops{count: 3, window: time.Hour, reboots: make(map[Serno][]time.Time)}
+	sg := &ActiveSG{}
+	reboot := func(at time.Duration) bool {
+		bl.reboots[serno] = append(bl.reboots[serno], t0.Add(at))
+		return bl.update(serno, sg, t0.Add(at))
+	}
+
+	if reboot(0) || reboot(30*time.Minute) || sg.BootLoop {
+		t.Fatal("boot loop after 2 reboots")
+	}
+	// the first reboot is more than an hour before the third
+	if reboot(61*time.Minute) || sg.BootLoop {
+		t.Fatal("boot loop from reboots over more than the window")
+	}
+	if len(bl.reboots[serno]) != 2 {
+		t.Errorf("%d reboots kept, want 2", len(bl.reboots[serno]))
+	}
+	if !reboot(70*time.Minute) || !sg.BootLoop {
+		t.Fatal("no boot loop after 3 reboots within the window")
+	}
+	if bl.update(serno, sg, t0.Add(80*time.Minute)) {
+		t.Error("flag changed with no new reboots")
+	}
+	// the loop ends once fewer than 3 reboots are within the window
+	if !bl.update(serno, sg, t0.Add(91*time.Minute)) || sg.BootLoop {
+		t.Error("boot loop not cleared")
+	}
+	bl.update(serno, sg, t0.Add(200*time.Minute))
+	if _, have := bl.reboots[serno]; have {
+		t.Error("reboots kept after the window")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// number of most recent syncs reported by a receiver status query
+const StatusSyncHistoryLen = 10
+
+// detailed status of a single receiver
+//
+// This combines the ActiveSG record, if any, with information
+// recovered from the messages table.
+type ReceiverStatus struct {
+	*ActiveSG
+	Active      bool        // has the receiver connected since the server was launched?
+	LastHeard   time.Time   // time of most recent message from receiver, on any topic; the embedded LastMsg has it by topic
+	SiteName    string      // motus deployment site name
+	ProjectID   int         // motus project ID
+	Project     string      // motus project code
+	SyncHistory []time.Time // times of most recent syncs with motus.org, most recent first
+}
+
+// convert a timestamp stored in the messages table to a time.Time
+func fromUnixtime(ts float64) time.Time {
+	return time.Unix(0, int64(ts*1e9))
+}
+
+// get the status of a receiver
+//
+// returns nil if the receiver is neither active nor registered.
+func GetReceiverStatus(serno Serno) *ReceiverStatus {
+	rs := &ReceiverStatus{}
+	if sgp, ok := activeSGs.Load(serno); ok {
+		rs.ActiveSG = sgp.(*ActiveSG)
+		rs.Active = true
+	} else {
+		var t int
+		if !SQL(DBQGetTunnelPort, c{serno}, c{&t}) {
+			return nil
+		}
+		rs.ActiveSG = (&ActiveSG{Serno: serno}).FromDB()
+	}
+	var (
+		ts  float64
+		msg string
+	)
+	if SQL(DBQGetLastMsgTs, c{serno}, c{&ts}) && ts > 0 {
+		rs.LastHeard = fromUnixtime(ts)
+	}
+	if rows, err := SQLRows(DBQGetMsgsOfType, c{serno, MsgSGSync, StatusSyncHistoryLen}); err == nil {
+		for rows.Next() {
+			if rows.Scan(&ts, &msg) == nil {
+				rs.SyncHistory = append(rs.SyncHistory, fromUnixtime(ts))
+			}
+		}
+		rows.Close()
+	}
+	if dep, known := MotusInfo.Dep(serno); known {
+		rs.SiteName = dep.SiteName
+		rs.ProjectID = dep.ProjectID
+		rs.Project = MotusInfo.Project(dep.ProjectID)
+	}
+	return rs
+}
+
+// JSON-formatted status of a receiver
+func (rs *ReceiverStatus) JSON() ([]byte, error) {
+	rs.ActiveSG.lock.Lock()
+	defer rs.ActiveSG.lock.Unlock()
+	return json.Marshal(rs)
+}
+
+// reply to a status server request for the status of a single receiver
+//
+// `s` is the serial number, with or without the leading "SG-", or the
+// legacy name of a receiver registered under one (see lookupSerno).
+func ReceiverStatusReply(s string) string {
+	serno := lookupSerno(s)
+	if serno == "" {
+		return "Error: invalid serial number " + s
+	}
+	rs := GetReceiverStatus(serno)
+	if rs == nil {
+		return "Error: unknown receiver " + string(serno)
+	}
+	js, err := rs.JSON()
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return string(js)
+}
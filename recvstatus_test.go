@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetReceiverStatus(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMotus(t, map[Serno]RecvDep{"SG-1234BBBK5678": {ProjectID: 7, SiteName: "Lighthouse"}})
+	MotusInfo.Projects[7] = "Shorebirds"
+	const serno = Serno("SG-1234BBBK5678")
+	testRegister(t, serno, true)
+	DB.AddMessages([]dbMsg{
+		{1441318000, string(serno), MsgSGSync + " first sync"},
+		{1441318100, string(serno), "G,1441318100,45.1,-64.5,20"},
+		{1441318200, string(serno), MsgSGSync + " second sync"},
+		{1441318300, string(serno), "p1,1441318300,TestTags#5:4.7@166.38"},
+	})
+
+	if rs := GetReceiverStatus("SG-5678BBBK1234"); rs != nil {
+		t.Errorf("status of an unknown receiver: %+v", rs)
+	}
+	rs := GetReceiverStatus(serno)
+	if rs == nil {
+		t.Fatal("no status for a registered receiver")
+	}
+	if rs.Active {
+		t.Error("inactive receiver reported as active")
+	}
+	reg, _ := DB.GetRegistration(serno)
+	if rs.TunnelPort != reg.tunnelPort || rs.WebPort != webPortFromTunnelPort(reg.tunnelPort) {
+		t.Errorf("ports %d, %d; want %d, %d", rs.TunnelPort, rs.WebPort, reg.tunnelPort, webPortFromTunnelPort(reg.tunnelPort))
+	}
+	if !rs.LastHeard.Equal(fromUnixtime(1441318300)) || !rs.TsLastSync.Equal(fromUnixtime(1441318200)) {
+		t.Errorf("last heard %s, last synced %s", rs.LastHeard, rs.TsLastSync)
+	}
+	if len(rs.SyncHistory) != 2 || !rs.SyncHistory[0].Equal(fromUnixtime(1441318200)) {
+		t.Errorf("sync history %v, want the 2 syncs, most recent first", rs.SyncHistory)
+	}
+	if rs.GPS == nil || rs.GPS.Lat != 45.1 || !rs.TsLastDet.Equal(fromUnixtime(1441318300)) {
+		t.Errorf("GPS %v, last detection %s", rs.GPS, rs.TsLastDet)
+	}
+	if rs.SiteName != "Lighthouse" || rs.ProjectID != 7 || rs.Project != "Shorebirds" {
+		t.Errorf("deployment %q, %d, %q", rs.SiteName, rs.ProjectID, rs.Project)
+	}
+
+	r := ReceiverStatusReply("1234BBBK5678")
+	var js map[string]interface{}
+	if err := json.Unmarshal([]byte(r), &js); err != nil {
+		t.Fatalf("status reply %q: %s", r, err)
+	}
+	if js["Serno"] != string(serno) || js["Project"] != "Shorebirds" {
+		t.Errorf("status reply %s", r)
+	}
+	if _, have := js["Proxy"]; have {
+		t.Error("status reply includes the web proxy")
+	}
+	if _, err := time.Parse(time.RFC3339, js["LastHeard"].(string)); err != nil {
+		t.Errorf("LastHeard in status reply: %s", err)
+	}
+	if r = ReceiverStatusReply("bogus"); !strings.HasPrefix(r, "Error: invalid serial number") {
+		t.Errorf("status of an invalid serial number: %q", r)
+	}
+	if r = ReceiverStatusReply("SG-5678BBBK1234"); r != "Error: unknown receiver SG-5678BBBK1234" {
+		t.Errorf("status of an unknown receiver: %q", r)
+	}
+}
+
+func TestReceiverStatusLegacySerno(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMotus(t, nil)
+	testRegister(t, "SG-SG-1234BBBK5678", true)
+	var js map[string]interface{}
+	for _, s := range []string{"SG-1234BBBK5678", "SG-SG-1234BBBK5678"} {
+		r := ReceiverStatusReply(s)
+		if err := json.Unmarshal([]byte(r), &js); err != nil || js["Serno"] != "SG-SG-1234BBBK5678" {
+			t.Errorf("status of %s: %q", s, r)
+		}
+	}
+}
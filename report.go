@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connectivity reports
+//
+// These are built from the connect (MsgSGConnect) and disconnect
+// (MsgSGDisconnect) events recorded in the messages table by
+// DBRecorder.  A receiver whose state at the start of a reporting
+// period is unknown is treated as disconnected until its first event.
+
+// a time interval
+type Interval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// connectivity of one receiver over a time range
+type UptimeReport struct {
+	Serno   Serno
+	From    time.Time
+	To      time.Time
+	Uptime  float64    // percentage of the range during which the receiver was connected
+	Outages []Interval // intervals during which the receiver was disconnected
+	Flaps   int        // number of connections lasting less than UptimeFlapMaxSession
+}
+
+// total time covered by a report's outages
+func (u *UptimeReport) Downtime() (d time.Duration) {
+	for _, o := range u.Outages {
+		d += o.End.Sub(o.Start)
+	}
+	return
+}
+
+// build an uptime report for one receiver from its connect / disconnect
+// events
+//
+// `connected` is the receiver's state at the start of the range;
+// `times` and `topics` are the timestamps and topics of events
+// within the range, in order.
+func makeUptimeReport(serno Serno, from, to time.Time, connected bool, times []time.Time, topics []string) *UptimeReport {
+	u := &UptimeReport{Serno: serno, From: from, To: to}
+	var up time.Duration
+	last := from
+	// start of the current connection; unknown for one already in
+	// progress at the start of the range
+	var connStart time.Time
+	haveStart := false
+	for i, t := range times {
+		isConnect := topics[i] == MsgSGConnect
+		if isConnect == connected {
+			// duplicate event (e.g. from ConnectionWatcher at startup)
+			continue
+		}
+		if connected {
+			up += t.Sub(last)
+			if haveStart && t.Sub(connStart) < UptimeFlapMaxSession {
+				u.Flaps++
+			}
+		} else {
+			u.Outages = append(u.Outages, Interval{last, t})
+			connStart, haveStart = t, true
+		}
+		connected = isConnect
+		last = t
+	}
+	if connected {
+		up += to.Sub(last)
+	} else {
+		u.Outages = append(u.Outages, Interval{last, to})
+	}
+	// drop any zero-length outage produced by an event exactly at `from`
+	if len(u.Outages) > 0 && !u.Outages[0].End.After(u.Outages[0].Start) {
+		u.Outages = u.Outages[1:]
+	}
+	if span := to.Sub(from); span > 0 {
+		u.Uptime = 100 * float64(up) / float64(span)
+	}
+	return u
+}
+
+// get uptime reports for receivers over a time range
+//
+// If `sernos` is empty, reports are generated for all registered
+// receivers and any others with events in the range.
+func GetUptimeReports(from, to time.Time, sernos []Serno) (reps []*UptimeReport, err error) {
+	type events struct {
+		times  []time.Time
+		topics []string
+	}
+	evts := make(map[Serno]*events)
+	var order []Serno
+	want := make(map[Serno]bool)
+	for _, s := range sernos {
+		want[s] = true
+		evts[s] = &events{}
+		order = append(order, s)
+	}
+	if len(sernos) == 0 {
+		rows, err := SQLRows(DBQGetSernos, c{})
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var s Serno
+			if rows.Scan(&s) == nil {
+				evts[s] = &events{}
+				order = append(order, s)
+			}
+		}
+		rows.Close()
+	}
+	rows, err := SQLRows(DBQGetConnEvents, c{unixtime(from), unixtime(to)})
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			s   Serno
+			ts  float64
+			msg string
+		)
+		if rows.Scan(&s, &ts, &msg) != nil || (len(want) > 0 && !want[s]) {
+			continue
+		}
+		e := evts[s]
+		if e == nil {
+			e = &events{}
+			evts[s] = e
+			order = append(order, s)
+		}
+		e.times = append(e.times, fromUnixtime(ts))
+		e.topics = append(e.topics, msg[0:1])
+	}
+	rows.Close()
+	for _, s := range order {
+		var msg string
+		connected := SQL(DBQGetConnStateBefore, c{s, unixtime(from)}, c{&msg}) && msg[0:1] == MsgSGConnect
+		e := evts[s]
+		reps = append(reps, makeUptimeReport(s, from, to, connected, e.times, e.topics))
+	}
+	return
+}
+
+// parse a time given in a report request
+//
+// Accepts a date (2006-01-02), an RFC3339 timestamp, or seconds
+// since the epoch.
+func parseReportTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if ts, err := strconv.ParseFloat(s, 64); err == nil {
+		return fromUnixtime(ts), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+// write uptime reports as CSV, one line per receiver, with times in
+// UTC
+func writeUptimeCSV(w io.Writer, reps []*UptimeReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"serno", "from", "to", "uptime_pct", "outages", "downtime_hours", "flaps"})
+	for _, u := range reps {
+		cw.Write([]string{string(u.Serno), u.From.UTC().Format(time.RFC3339), u.To.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(u.Uptime, 'f', 2, 64), strconv.Itoa(len(u.Outages)),
+			strconv.FormatFloat(u.Downtime().Hours(), 'f', 2, 64), strconv.Itoa(u.Flaps)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// write the outages in uptime reports as CSV, one line per outage,
+// with times in UTC
+func writeOutagesCSV(w io.Writer, reps []*UptimeReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"serno", "start", "end", "hours"})
+	for _, u := range reps {
+		for _, o := range u.Outages {
+			cw.Write([]string{string(u.Serno), o.Start.UTC().Format(time.RFC3339), o.End.UTC().Format(time.RFC3339),
+				strconv.FormatFloat(o.End.Sub(o.Start).Hours(), 'f', 2, 64)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// reply to a status server request for an uptime or outage report
+//
+// `words` are the request: command FROM TO [SERNO...]; the reply is CSV.
+func UptimeReply(words []string, outages bool) string {
+	if len(words) < 3 {
+		return "Error: usage: " + words[0] + " FROM TO [SERNO...]"
+	}
+	from, err := parseReportTime(words[1])
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	to, err := parseReportTime(words[2])
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	var sernos []Serno
+	for _, w := range words[3:] {
+		if s := lookupSerno(w); s != "" {
+			sernos = append(sernos, s)
+		}
+	}
+	reps, err := GetUptimeReports(from, to, sernos)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	var b strings.Builder
+	if outages {
+		writeOutagesCSV(&b, reps)
+	} else {
+		writeUptimeCSV(&b, reps)
+	}
+	return b.String()
+}
+
+// serve uptime reports over HTTP
+//
+// The request looks like
+//
+//	/report/uptime?from=2019-05-01&to=2019-09-01[&serno=SERNO...][&format=csv]
+//
+// or the same with /report/outages.  Only receivers the user is
+// authorized for are reported.  The default format is JSON.
+func UptimeHandler(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	if token == nil {
+		http.Error(w, "401 - Motus login required", http.StatusUnauthorized)
+		return
+	}
+	from, err := parseReportTime(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseReportTime(r.FormValue("to"))
+	if err != nil {
+		http.Error(w, "400 - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var sernos []Serno
+	for _, v := range r.Form["serno"] {
+		if s := parseSerno(v); s != "" {
+			sernos = append(sernos, s)
+		}
+	}
+	all, err := GetUptimeReports(from, to, sernos)
+	if err != nil {
+		http.Error(w, "500 - "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var reps []*UptimeReport
+	for _, u := range all {
+		if Authorized(token.UserID, u.Serno) {
+			reps = append(reps, u)
+		}
+	}
+	outages := strings.HasSuffix(r.URL.Path, "/outages")
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		if outages {
+			writeOutagesCSV(w, reps)
+		} else {
+			writeUptimeCSV(w, reps)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reps)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMakeUptimeReport(t *testing.T) {
+	from := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	at := func(d time.Duration) time.Time { return from.Add(d) }
+	const (
+		conn = MsgSGConnect
+		dis  = MsgSGDisconnect
+	)
+	tests := []struct {
+		name      string
+		connected bool
+		times     []time.Duration
+		topics    []string
+		uptime    float64
+		outages   []Interval
+		flaps     int
+	}{
+		{"always up", true, nil, nil, 100, nil, 0},
+		{"always down", false, nil, nil, 0, []Interval{{from, to}}, 0},
+		{"one outage", true,
+			[]time.Duration{2 * time.Hour, 4 * time.Hour}, []string{dis, conn},
+			80, []Interval{{at(2 * time.Hour), at(4 * time.Hour)}}, 0},
+		{"down at start", false,
+			[]time.Duration{5 * time.Hour}, []string{conn},
+			50, []Interval{{from, at(5 * time.Hour)}}, 0},
+		{"down at end", true,
+			[]time.Duration{9 * time.Hour}, []string{dis},
+			90, []Interval{{at(9 * time.Hour), to}}, 0},
+		{"connect exactly at start", false,
+			[]time.Duration{0}, []string{conn},
+			100, nil, 0},
+		{"duplicate events ignored", true,
+			[]time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour, 4 * time.Hour}, []string{conn, dis, dis, conn},
+			80, []Interval{{at(2 * time.Hour), at(4 * time.Hour)}}, 0},
+		{"short connection is a flap", false,
+			[]time.Duration{time.Hour, time.Hour + time.Minute, 5 * time.Hour}, []string{conn, dis, conn},
+			100 * float64(time.Minute+5*time.Hour) / float64(10*time.Hour),
+			[]Interval{{from, at(time.Hour)}, {at(time.Hour + time.Minute), at(5 * time.Hour)}}, 1},
+		{"connection in progress at start is not a flap", true,
+			[]time.Duration{time.Minute}, []string{dis},
+			100 * float64(time.Minute) / float64(10*time.Hour),
+			[]Interval{{at(time.Minute), to}}, 0},
+		{"long connection is not a flap", false,
+			[]time.Duration{time.Hour, 2 * time.Hour}, []string{conn, dis},
+			10, []Interval{{from, at(time.Hour)}, {at(2 * time.Hour), to}}, 0},
+	}
+	for _, tt := range tests {
+		times := make([]time.Time, len(tt.times))
+		for i, d := range tt.times {
+			times[i] = at(d)
+		}
+		u := makeUptimeReport("SG-1234BBBK5678", from, to, tt.connected, times, tt.topics)
+		if diff := u.Uptime - tt.uptime; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%s: uptime %f, want %f", tt.name, u.Uptime, tt.uptime)
+		}
+		if (len(u.Outages) > 0 || len(tt.outages) > 0) && !reflect.DeepEqual(u.Outages, tt.outages) {
+			t.Errorf("%s: outages %v, want %v", tt.name, u.Outages, tt.outages)
+		}
+		if u.Flaps != tt.flaps {
+			t.Errorf("%s: %d flaps, want %d", tt.name, u.Flaps, tt.flaps)
+		}
+	}
+}
+
+func TestUptimeReportDowntime(t *testing.T) {
+	from := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	u := &UptimeReport{Outages: []Interval{
+		{from, from.Add(time.Hour)},
+		{from.Add(2 * time.Hour), from.Add(150 * time.Minute)},
+	}}
+	if d := u.Downtime(); d != 90*time.Minute {
+		t.Errorf("downtime %s, want 1h30m", d)
+	}
+}
+
+func TestParseReportTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"2019-05-01", time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2019-05-01T12:30:00Z", time.Date(2019, 5, 1, 12, 30, 0, 0, time.UTC), true},
+		{"1556713800", time.Date(2019, 5, 1, 12, 30, 0, 0, time.UTC), true},
+		{"May 1", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseReportTime(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseReportTime(%q): error %v, want ok=%v", tt.s, err, tt.ok)
+			continue
+		}
+		if tt.ok && !got.Equal(tt.want) {
+			t.Errorf("parseReportTime(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestReportCSVInUTC(t *testing.T) {
+	// times from the database are in local time
+	local := time.FixedZone("ADT", -3*3600)
+	from := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	u := makeUptimeReport("SG-1234BBBK5678", from.In(local), to.In(local), true,
+		[]time.Time{from.Add(2 * time.Hour).In(local), from.Add(4 * time.Hour).In(local)}, []string{MsgSGDisconnect, MsgSGConnect})
+	var b strings.Builder
+	writeUptimeCSV(&b, []*UptimeReport{u})
+	if want := "serno,from,to,uptime_pct,outages,downtime_hours,flaps\nSG-1234BBBK5678,2019-05-01T00:00:00Z,2019-05-01T10:00:00Z,80.00,1,2.00,0\n"; b.String() != want {
+		t.Errorf("uptime CSV %q, want %q", b.String(), want)
+	}
+	b.Reset()
+	writeOutagesCSV(&b, []*UptimeReport{u})
+	if want := "serno,start,end,hours\nSG-1234BBBK5678,2019-05-01T02:00:00Z,2019-05-01T04:00:00Z,2.00\n"; b.String() != want {
+		t.Errorf("outages CSV %q, want %q", b.String(), want)
+	}
+}
+
+func TestUptimeReply(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testRegister(t, "SG-SG-1234BBBK5678", true)
+	testRegister(t, "SG-5678BBBK1234", true)
+	from := time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)
+	d := unixtime(from)
+	DB.AddMessages([]dbMsg{
+		{d + 3600, "SG-SG-1234BBBK5678", MsgSGConnect + " connected"},
+		{d + 7200, "SG-5678BBBK1234", MsgSGConnect + " connected"},
+		{d + 9000, "SG-5678BBBK1234", MsgSGDisconnect + " disconnected"},
+	})
+	const header = "serno,from,to,uptime_pct,outages,downtime_hours,flaps\n"
+	row := func(serno, uptime, outages, downtime string) string {
+		return serno + ",2019-05-01T00:00:00Z,2019-05-01T10:00:00Z," + uptime + "," + outages + "," + downtime + ",0\n"
+	}
+	all := UptimeReply([]string{"uptime", "2019-05-01T00:00:00Z", "2019-05-01T10:00:00Z"}, false)
+	if want := header + row("SG-5678BBBK1234", "5.00", "2", "9.50") + row("SG-SG-1234BBBK5678", "90.00", "1", "1.00"); all != want {
+		t.Errorf("uptime:\n%s\nwant:\n%s", all, want)
+	}
+	// a receiver registered under its legacy name is found by its
+	// serial number
+	one := UptimeReply([]string{"uptime", "2019-05-01T00:00:00Z", "2019-05-01T10:00:00Z", "SG-1234BBBK5678"}, false)
+	if want := header + row("SG-SG-1234BBBK5678", "90.00", "1", "1.00"); one != want {
+		t.Errorf("uptime of SG-1234BBBK5678:\n%s\nwant:\n%s", one, want)
+	}
+	outages := UptimeReply([]string{"outages", "2019-05-01T00:00:00Z", "2019-05-01T10:00:00Z", "5678BBBK1234"}, true)
+	if !strings.HasPrefix(outages, "serno,start,end,hours\nSG-5678BBBK1234,2019-05-01T00:00:00Z,2019-05-01T02:00:00Z,2.00\n") {
+		t.Errorf("outages: %q", outages)
+	}
+}
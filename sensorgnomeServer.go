@@ -1,15 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	cryptorand "crypto/rand"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"github.com/jbrzusto/mbus"
-	_ "github.com/mattn/go-sqlite3"
+	"html"
 	"html/template"
 	"io"
 	"io/ioutil"
@@ -21,33 +23,76 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 // customization constants
 const (
 	AddressRegServer      = "localhost:59026" // TCP interface: port on which registration exchanges happen
+	AddressRegRelay       = "localhost:59029" // TCP interface: port on which registration requests relayed by sshd's forced command arrive, after the receiver's SSH_CLIENT
 	AddressStatusServer   = "localhost:59025" // TCP interface:port on which status requests are answered
 	AddressTrustedDgram   = ":59023"          // UDP interface:port on which we receive unsigned messages from trusted sources (e.g. localhost)
 	TrustedStreamPort     = "59024"
 	AddressTrustedStream  = "localhost:" + TrustedStreamPort                                                   // TCP interface:port on which we receive messages from trusted sources (e.g. SGs connected via ssh)
 	AddressUntrustedDgram = ":59022"                                                                           // UDP interface:port on which we receive messages from untrusted sources
 	AddressRevProxy       = "localhost:59027"                                                                  // TCP interface:port for direct connections to SG web servers
+	AddressWebAPI         = "localhost:59028"                                                                  // TCP interface:port for the web API (live detections etc.); proxied by nginx
+	AlertCheckInterval    = time.Minute * 5                                                                    // how often to check for offline receivers
+	AlertEmailFrom        = "sensorgnome-alerts@sensorgnome.org"                                               // sender address for alert emails
+	AlertEmailTo          = ""                                                                                 // comma-separated addresses which receive all alerts; project members receive alerts for their project's receivers
+	AlertOfflineThreshold = time.Hour * 2                                                                      // how long a receiver must be disconnected or silent before an alert is sent
+	AlertProjectEmails    = ""                                                                                 // semicolon-separated PROJECTID:ADDR,ADDR,... lists of addresses which receive alerts for a motus project's receivers, whether or not they have logged in; e.g. "123:a@b.org,c@d.org;456:e@f.org"
+	AlertQuietHoursStart  = 22                                                                                 // hour (local time) at which quiet hours begin; alerts are held until they end
+	AlertQuietHoursEnd    = 7                                                                                  // hour (local time) at which quiet hours end; set equal to AlertQuietHoursStart for no quiet hours
+	AlertSMTPRelay        = "localhost:25"                                                                     // SMTP relay for alert emails; empty means don't send email
+	AlertWebhookURL       = ""                                                                                 // URL to which alerts are POSTed as JSON; empty means no webhook
+	ArchiveDir            = "/home/sg_remote/archive"                                                          // where expired messages are archived, as monthly gzipped CSV files
+	ArchiveInterval       = time.Hour * 24                                                                     // how often to archive expired messages
+	BackupDir             = "/home/sg_remote/backups"                                                          // where snapshots of the database are written
+	BackupInterval        = time.Hour * 6                                                                      // how often to snapshot the database
+	BackupKeep            = 28                                                                                 // number of database snapshots to keep; older ones are deleted
+	BootLoopCount         = 5                                                                                  // number of reboots within BootLoopWindow which counts as a boot loop
+	BootLoopWindow        = time.Hour * 6                                                                      // time window for counting reboots
+	ClockLockPrec         = 0.1                                                                                // receiver clock precision (seconds) at or below which we take its clock to be locked to GPS time
+	ClockMaxOffset        = 10                                                                                 // difference (seconds) between a receiver's clock and ours beyond which it is flagged as unsynchronised
 	ConnectionSemPath     = "/dev/shm"                                                                         // directory where sshd maintains semaphores indicating connected SGs
 	ConnectionSemRE       = "sem.(" + SernoBareRE + ")"                                                        // regular expression for matching SG semaphores (capture group is serno)
 	CryptoAuthKeysPath    = CryptoKeyPath + "/authorized_keys"                                                 // sshd authorized_keys file for remote SGs
 	CryptoKeyPath         = "/home/sg_remote/.ssh"                                                             // where crypto keys for remote SGs are stored
+	CryptoKeyType         = "rsa"                                                                              // type of key pair generated for new receivers: "rsa" or "ed25519" (needs OpenSSH >= 6.5 on the receiver)
+	CryptoRSABits         = 3072                                                                               // size of generated RSA keys
+	DBBatchInterval       = time.Second * 1                                                                    // maximum time messages wait before being written to the database
+	DBBatchSize           = 500                                                                                // maximum number of messages written to the database in one transaction
+	DBBufferMax           = 100000                                                                             // maximum number of messages waiting to be written to the database; beyond this, the oldest are dropped
+	DBRetryMaxWait        = time.Minute * 1                                                                    // maximum delay before retrying a failed database write
+	DetSilentThreshold    = time.Hour * 24                                                                     // how long a connected receiver can go without detecting any tags before it is flagged
+	DetStatsFlush         = time.Minute * 1                                                                    // how often accumulated detection counts are written to the database
+	DevFlapCount          = 4                                                                                  // number of device additions / removals on a USB port within DevFlapWindow which counts as flapping
+	DevFlapWindow         = time.Minute * 10                                                                   // time window for counting device additions / removals on a USB port
+	GPSMoveThreshold      = 100                                                                                // distance (metres) from where a receiver settled to its latest GPS fix which counts as it having moved
+	KeyRotationBatch      = 10                                                                                 // maximum number of scheduled key rotations started per KeyRotationInterval
+	KeyRotationGrace      = time.Hour * 24 * 30                                                                // how long a receiver has to connect with its new key before its key rotation is abandoned
+	KeyRotationInterval   = time.Hour * 24                                                                     // how often to abandon stale key rotations and start scheduled ones
+	KeyRotationMaxAge     = 0                                                                                  // age of key pair beyond which a receiver's key is rotated; 0 means only rotate on request
+	LiveTagBacklog        = 100                                                                                // maximum number of detections queued for a single live (SSE) client before they are dropped
+	LiveTagKeepAlive      = time.Second * 30                                                                   // interval between keep-alive comments on idle live (SSE) streams
+	LivenessCheckInterval = time.Minute * 1                                                                    // how often to check connected receivers for silence
+	MasterKeyEnv          = "SG_MASTER_KEY"                                                                    // environment variable holding the master key for encrypting private keys; if not set, MasterKeyFile is read
+	MasterKeyFile         = "/home/sg_remote/master.key"                                                       // file holding the master key for encrypting private keys (base64-encoded, 32 bytes)
+	MessageRetentionDays  = ""                                                                                 // comma-separated TOPIC=DAYS overrides of DefaultMessageRetention in archive.go, e.g. "p=365,G=30"; 0 days keeps a topic forever; overridden by -retention
 	MotusControlPath      = "/home/sg_remote/sgdata.ssh"                                                       // control path for multiplexing port mappings to sgdata.motus.org
 	MotusAuthUser         = `https://motus.org/api/user/validate?json={"date":"%s","login":"%s","pword":"%s"}` // URL to validate motus user and return authorizations
 	MotusGetProjectsUrlT  = `https://motus.org/api/projects?json={"date":"%s"}`                                // URL for motus info on projects
 	MotusGetReceiversUrlT = `https://motus.org/api/receivers/deployments?json={"date":"%s","status":2}`        // URL for motus info on receivers
 	MotusMinLatency       = 10                                                                                 // minimum time (minutes) between queries to the motus metadata server
+	MotusMismatchDist     = 1000                                                                               // distance (metres) between a receiver's GPS fix and its motus deployment location which counts as a mismatch
 	MotusSyncTemplate     = "/sgm_local/sync/method=%d,serno=%s"                                               // template for file touched on sgdata.motus.org to cause sync; %d=port, %s=serno
 	MotusSSHUserKey       = "/home/sg_remote/.ssh/id_ed25519_sgorg_sgdata"                                     // ssh key to use for sync on sgdata.motus.org
 	MotusSSHUser          = "sg@sgdata.motus.org"                                                              // user on sgdata.motus.org; this is who ssh makes us be
@@ -55,7 +100,9 @@ const (
 	SernoBareRE           = "(?i)(SG-)?[0-9A-Za-z]{12}(_[0-9])?"                                                  // regular expression matching SG serial number anywhere
 	SernoRE               = "^" + SernoBareRE                                                                  // regular expression matching SG serial number at start of target
 	SessionKeepAlive      = time.Minute * 1                                                                    // how long before an unused direct connection to an SG can be bumped by another user
+	SilentThreshold       = time.Minute * 30                                                                   // how long a connected receiver can go without sending a message before it is flagged as silent
 	SGDBFile              = "/home/sg_remote/sg_remote.sqlite"                                                 // sqlite database with receiver info
+	SGDBURL               = ""                                                                                 // if not empty, URL of a PostgreSQL database (postgres://...) to use instead of SGDBFile
 	SGUser                = "bone"                                                                             // username for logging into remote SG; trivial, but remote SG only allows login via ssh from its local domain
 	SGPassword            = "bone"                                                                             // password for logging into remote SG
 	ShortTimestampFormat  = "Jan 2 '06 15:04"                                                                     // timestamp format for sync times etc. on status page
@@ -64,13 +111,20 @@ const (
 	SyncTimeDir           = "/home/sg_remote/last_sync"                                                        // directory with one file per SG; mtime is last sync time
 	SyncWaitHi            = 90                                                                                 // maximum time between syncs of a receiver (minutes)
 	SyncWaitLo            = 30                                                                                 // minimum time between syncs of a receiver (minutes)
-	TrustedIPAddrRE       = `^209\.183\.24\.36:[0-9]+$`                                                        // hard-wired trusted network address for registration; public IP address of compudata.ca test bench
+	TrustedNetworks       = "209.183.24.36/32"                                                                 // comma-separated IPv4/IPv6 CIDR ranges from which receivers register without credentials; e.g. the compudata.ca test bench
 	TunnelPortMax         = 49999                                                                              // maximum SG tunnel port we assign
 	TunnelPortMin         = 40000                                                                              // minimum SG tunnel port we assign
+	UptimeFlapMaxSession  = time.Minute * 5                                                                    // connections shorter than this are counted as flapping in uptime reports
 )
 
-// regular expression matching a trusted net.Addr.String()
-var TrustedIPAddrRegexp = regexp.MustCompile(TrustedIPAddrRE)
+// networks from which receivers register without credentials
+var TrustedNets = mustParseNetworks(TrustedNetworks)
+
+// how long messages of each topic are kept; see archive.go
+var MessageRetention = mustParseRetention(MessageRetentionDays)
+
+// addresses which receive alerts for each motus project's receivers
+var AlertProjectTo = mustParseProjectEmails(AlertProjectEmails)
 
 // The type for messages.
 type SGMsg struct {
@@ -84,7 +138,8 @@ type MsgTopic string
 
 // Message Topics
 // These are typically the first character of the message from the SG,
-// but we add some synthetic ones generated by the system
+// but we add some synthetic ones generated by the system; these are
+// digits, and once we ran out of those, punctuation
 const (
 	MsgSGDisconnect  = "0" // connected via ssh
 	MsgSGConnect     = "1" // disconnected from ssh
@@ -92,6 +147,15 @@ const (
 	MsgSGSyncPending = "3" // data sync with motus.org has been scheduled for a future time
 	MsgSGActivate    = "4" // receiver has connected *and* had its info read from DB
 	MsgStatusChange  = "5"
+	MsgSGSilent      = "6" // receiver is connected but has sent no messages recently
+	MsgSGMoved       = "7" // receiver's GPS position has changed by more than GPSMoveThreshold
+	MsgSGMislocated  = "8" // receiver's GPS position is more than MotusMismatchDist from its motus deployment
+	MsgSGClockBad    = "9" // receiver's clock differs from ours by more than ClockMaxOffset
+	MsgSGReboot      = "!" // receiver's bootCount has increased
+	MsgSGBootLoop    = "#" // receiver has rebooted at least BootLoopCount times within BootLoopWindow
+	MsgSGNoTags      = "$" // receiver is connected but has made no tag detections on any port for DetSilentThreshold
+	MsgSGNewKey      = "%" // receiver has connected with the new key issued by a key rotation
+	MsgSGDeregister  = "&" // receiver has been deregistered
 	MsgGPS           = "G" // from SG: GPS fix
 	MsgMachineInfo   = "M" // from SG: machine information
 	MsgTimeSync      = "C" // from SG: time sync
@@ -122,6 +186,20 @@ type ActiveSG struct {
 	TunnelPort int                    // ssh tunnel port, if applicable
 	WebPort    int                    // web server port mapped on server back to SG's web server
 	WebUser    int                    // if non-zero, ID of the user directly connected to the SG's web server
+	LastMsg    map[string]time.Time   // time of most recent message from the SG, by topic
+	Silent     bool                   // connected, but no messages for at least SilentThreshold?
+	GPS        *GPSFix                // most recent GPS fix, if any
+	GPSStay    *GPSFix                // first GPS fix at the receiver's current location, from which moves are measured (see GPSTracker)
+	TsMoved    time.Time              // time at which receiver was last found to have moved (see GPSTracker)
+	DepDist    float64                // distance (metres) from latest GPS fix to motus deployment location, if both known
+	Mislocated bool                   // is DepDist greater than MotusMismatchDist?
+	Clock      *ClockStatus           // state of receiver's clock, as of its most recent time sync
+	Devices    map[int]*Device        // devices currently attached, by USB port
+	Flapping   map[int]bool           // USB ports on which devices are being repeatedly added and removed
+	Machine    *MachineInfo           // software version, boot count etc.
+	BootLoop   bool                   // has receiver rebooted at least BootLoopCount times within BootLoopWindow?
+	TsLastDet  time.Time              // time of most recent tag detection
+	NoTags     bool                   // connected, but no tag detections for at least DetSilentThreshold?
 	Proxy      *httputil.ReverseProxy `json:"-"` // if non-nil, reverse proxy to the SG's web server; don't export to json
 	Connected  bool                   // actually connected?  once we've seen a receiver, we keep this struct in memory,
 	// but set this field to false when it disconnects
@@ -290,48 +368,145 @@ func unixtime(ts time.Time) float64 {
 	return float64(ts.UnixNano()) / 1.0E9
 }
 
+// a message waiting to be written to the messages table
+type dbMsg struct {
+	ts     float64
+	sender string
+	text   string
+}
+
 // Goroutine that records (some) messages to a
 // table called "messages" in the global DB.
-func DBRecorder() {
-	// database pointer
-	DB := OpenDB(SGDBFile)
-
-	stmt, err := DB.Prepare("INSERT INTO messages (ts, sender, message) VALUES (?, ?, ?)")
-	if err != nil {
-		log.Fatal(err)
-	}
+//
+// Messages are buffered and written in batches, each in a single
+// transaction, whenever DBBatchSize messages are waiting or
+// DBBatchInterval has passed.  If a write fails because of a
+// transient error (e.g. the database is busy), the batch is kept and
+// retried after a delay which doubles with each failure, up to
+// DBRetryMaxWait.  If it fails for any other reason, its messages are
+// written one at a time, and any which still fail are logged and
+// skipped, so that one bad message can't stall recording.  At most
+// DBBufferMax messages are buffered; beyond that, the oldest are
+// dropped.
+//
+// When `ctx` is cancelled, waiting messages are written, retrying
+// transient errors for up to DBRetryMaxWait, and the returned channel
+// is closed.
+func DBRecorder(ctx context.Context) (done chan struct{}) {
 	// subscribe to topics of interest
 	evt := Bus.Sub("*")
+	done = make(chan struct{})
 	go func() {
-		// create closure that uses stmt, db
-		defer stmt.Close()
+		defer close(done)
 		defer evt.Unsub("*")
-		for msg := range evt.Msgs() {
-			if msg.Msg == nil {
-				continue
+		var (
+			buf     []dbMsg
+			wait    time.Duration // current delay before retrying a failed write
+			retryAt time.Time     // don't write before this time
+			dropped int           // number of messages dropped since last successful write
+		)
+		// back off after a transient error
+		backoff := func(now time.Time, n int, err error) {
+			if wait == 0 {
+				wait = time.Second
+			} else if wait *= 2; wait > DBRetryMaxWait {
+				wait = DBRetryMaxWait
 			}
-			m := msg.Msg.(SGMsg)
-			ts, sender, text := m.ts, m.sender, m.text
-			// fill in defaults
-			if ts.IsZero() {
-				ts = time.Now()
+			retryAt = now.Add(wait)
+			log.Printf("unable to record %d messages (%d waiting); retrying in %s: %s\n", n, len(buf), wait, err.Error())
+		}
+		flush := func(now time.Time) {
+			if len(buf) == 0 || now.Before(retryAt) {
+				return
 			}
-			if text == "" {
-				text = string(msg.Topic)
+			// write at most DBBatchSize messages per transaction
+			for len(buf) > 0 {
+				n := len(buf)
+				if n > DBBatchSize {
+					n = DBBatchSize
+				}
+				err := DB.AddMessages(buf[:n])
+				if err != nil && isTransientDBError(err) {
+					backoff(now, n, err)
+					return
+				}
+				if err != nil {
+					// find the bad messages
+					for i := 0; i < n; i++ {
+						if err = DB.AddMessages(buf[:1]); err != nil {
+							if isTransientDBError(err) {
+								backoff(now, n-i, err)
+								return
+							}
+							m := buf[0]
+							log.Printf("skipping message which can't be recorded: %f,%s,%q: %s\n", m.ts, m.sender, m.text, err.Error())
+						}
+						buf = buf[1:]
+					}
+					continue
+				}
+				buf = buf[n:]
 			}
-			// record timestamp in DB as double seconds;
-			_, err := stmt.Exec(unixtime(ts), sender, text)
-			if err != nil {
-				log.Fatal(err)
+			buf = nil
+			if dropped > 0 {
+				log.Printf("recording messages again; %d were dropped\n", dropped)
+			}
+			wait, dropped = 0, 0
+		}
+		tick := time.NewTicker(DBBatchInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// write what's waiting before exiting
+				for deadline := time.Now().Add(DBRetryMaxWait); len(buf) > 0 && time.Now().Before(deadline); {
+					if now := time.Now(); now.Before(retryAt) {
+						time.Sleep(retryAt.Sub(now))
+					}
+					flush(time.Now())
+				}
+				if len(buf) > 0 {
+					log.Printf("exiting with %d messages not recorded\n", len(buf))
+				}
+				return
+			case msg, ok := <-evt.Msgs():
+				if !ok {
+					flush(time.Now())
+					return
+				}
+				if msg.Msg == nil {
+					continue
+				}
+				m := msg.Msg.(SGMsg)
+				ts, sender, text := m.ts, m.sender, m.text
+				// fill in defaults
+				if ts.IsZero() {
+					ts = time.Now()
+				}
+				if text == "" {
+					text = string(msg.Topic)
+				}
+				if len(buf) >= DBBufferMax {
+					buf = buf[1:]
+					dropped++
+				}
+				// record timestamp in DB as double seconds;
+				buf = append(buf, dbMsg{unixtime(ts), sender, text})
+				if len(buf) >= DBBatchSize {
+					flush(time.Now())
+				}
+			case now := <-tick.C:
+				flush(now)
 			}
 		}
 	}()
+	return
 }
 
 // simple SQL query
 //
-// st is a prepared statement; pars are parameters to it, and res is
-// pointers to result values.  Attempts to run the statement with
+// q is a query on the global store DB; pars are parameters to it, and
+// res is pointers to result values.  Attempts to run the query with
 // the given parameters, and store the results from the *first* row
 // into the result values.
 //
@@ -341,28 +516,16 @@ func DBRecorder() {
 // returns true if len(res) == 0 and no errors were encountered,
 // or if len(res) != 0) and at least one row was returned
 
-func SQL(q dbQuery, pars []interface{}, res []interface{}) (rv bool) {
-	rv = false
-	if q >= DBQ_num_queries {
-		return false
-	}
-	st := dbQueries[q]
-	if len(res) > 0 {
-		rows, err := st.Query(pars...)
-		if err == nil {
-			if rows.Next() {
-				rows.Scan(res...)
-				rv = true
-			}
-			rows.Close()
-		}
-	} else {
-		_, err := st.Exec(pars...)
-		if err == nil {
-			rv = true
-		}
-	}
-	return
+func SQL(q dbQuery, pars []interface{}, res []interface{}) bool {
+	return DB.QueryRow(q, pars, res)
+}
+
+// multi-row SQL query
+//
+// q is a query on the global store DB; pars are parameters to it.  Returns
+// the rows, which the caller must close, or an error.
+func SQLRows(q dbQuery, pars []interface{}) (*sql.Rows, error) {
+	return DB.QueryRows(q, pars)
 }
 
 // wrap a variadic list of interface{} objects into a slice
@@ -394,10 +557,18 @@ func (sg *ActiveSG) FromDB() *ActiveSG {
 		t  int
 		ts float64
 	)
+	fix := LastGPSFix(sg.Serno)
+	devs := LoadDevices(sg.Serno)
+	mi := LoadMachineInfo(sg.Serno)
+	tsDet := LastDetection(sg.Serno)
+	sg.lock.Lock()
+	defer sg.lock.Unlock()
+	sg.GPS, sg.GPSStay = fix, fix
+	sg.Devices = devs
+	sg.Machine = mi
+	sg.TsLastDet = tsDet
 	if SQL(DBQGetTunnelPort, c{sg.Serno}, c{&t}) &&
 		SQL(DBQGetTsLastSync, c{sg.Serno}, c{&ts}) {
-		sg.lock.Lock()
-		defer sg.lock.Unlock()
 		sg.TunnelPort = t
 		sg.WebPort = webPortFromTunnelPort(t)
 		sg.TsLastSync = time.Unix(0, int64(ts*1E9))
@@ -441,6 +612,9 @@ func ConnectionWatcher(ctx context.Context, dir string, sgRE string) {
 						msg.Topic = mbus.Topic(MsgSGDisconnect)
 					}
 					Bus.Pub(msg)
+					if msg.Topic == MsgSGConnect {
+						checkNewKeySem(event.Name, parts[1], time.Now())
+					}
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
@@ -460,6 +634,7 @@ func ConnectionWatcher(ctx context.Context, dir string, sgRE string) {
 			parts := re.FindStringSubmatch(finfo.Name())
 			if parts != nil {
 				Bus.Pub(mbus.Msg{MsgSGConnect, SGMsg{sender: parts[1], ts: finfo.ModTime()}})
+				checkNewKeySem(finfo.Name(), parts[1], finfo.ModTime())
 			}
 		}
 	}
@@ -498,6 +673,7 @@ func SGMinder() {
 			case MsgSGDisconnect:
 				sg.TsDisConn = m.ts
 				sg.Connected = false
+				sg.Silent = false
 			case MsgSGSync:
 				sg.TsLastSync = m.ts
 			case MsgSGSyncPending:
@@ -572,13 +748,14 @@ SyncLoop:
 // - `SGActivate`: start a SyncWorker (receiver-specific goroutine) that periodically starts a sync job to send new data
 // to sgdata.motus.org.   Multiple `SGConnect` events for the same receiver are collapsed into the
 // first one.  We need metadata for the receiver (e.g. tunnel port) which is why we subscribe to this message
-// instead of to `SGConnect`
+// instead of to `SGConnect`.  Receivers which have not been verified are not synced.
 // - `SGDisconnect`: stop the asssociated SyncWorker
+// - `SGDeregister`: stop the associated SyncWorker, as the receiver's connection is about to be dropped
 //
 
 func SyncManager() {
 	syncCancels := make(map[Serno]context.CancelFunc)
-	evt := Bus.Sub(MsgSGActivate, MsgSGDisconnect)
+	evt := Bus.Sub(MsgSGActivate, MsgSGDisconnect, MsgSGDeregister)
 	go func() {
 		defer evt.Unsub("*")
 	MsgLoop:
@@ -591,10 +768,13 @@ func SyncManager() {
 				if have {
 					continue MsgLoop
 				}
+				if reg, ok := DB.GetRegistration(serno); !ok || !reg.verified {
+					continue MsgLoop
+				}
 				newctx, cf := context.WithCancel(context.Background())
 				syncCancels[serno] = cf
 				go SyncWorker(newctx, serno)
-			case MsgSGDisconnect:
+			case MsgSGDisconnect, MsgSGDeregister:
 				if !have {
 					continue MsgLoop
 				}
@@ -615,84 +795,116 @@ type dbQuery int
 
 // query indexes by name
 const (
-	DBQGetTunnelPort   dbQuery = iota // get tunnel port by serno from receivers
-	DBQGetTsLastSync                  // get last sync time by serno from messages
-	DBQGetRegistration                // get registration by serno (tunnelPort, pubKey, privKey)
-	DBQNewSG                          // insert a record with tunnelPort for new serno
-	DBQNewSGKeys                      // update keys for an SG
-	DBQ_num_queries                   // marks number of queries
+	DBQGetTunnelPort      dbQuery = iota // get tunnel port by serno from receivers
+	DBQGetTsLastSync                     // get last sync time by serno from messages
+	DBQGetRegistration                   // get registration by serno (tunnelPort, pubKey, privKey, verified)
+	DBQNewSG                             // insert a record with the lowest free tunnelPort for new serno
+	DBQNewSGKeys                         // update keys for an SG
+	DBQGetLastMsgTs                      // get time of most recent message by serno from messages
+	DBQGetLastMsgOfType                  // get most recent message of a given type by serno from messages
+	DBQGetMsgsOfType                     // get messages of a given type by serno from messages, most recent first
+	DBQGetSernos                         // get serial numbers of all registered receivers
+	DBQGetConnEvents                     // get connect / disconnect events in a time range from messages, by serno then time
+	DBQGetConnStateBefore                // get most recent connect / disconnect event before a time by serno from messages
+	DBQNewGPSFix                         // insert a GPS fix into gps_fixes
+	DBQGetLastGPSFix                     // get most recent GPS fix by serno from gps_fixes
+	DBQGetGPSFixes                       // get GPS fixes in a time range by serno from gps_fixes
+	DBQGetLatestGPSFixes                 // get most recent GPS fix of every receiver from gps_fixes
+	DBQNewDevice                         // insert a newly attached device into device_history
+	DBQRemoveDevice                      // mark the device attached to a port as removed in device_history
+	DBQGetDevices                        // get devices currently attached by serno from device_history
+	DBQGetAnyDevice                      // get any device by serno from device_history, to see whether there are any
+	DBQGetDeviceHistory                  // get all devices ever attached by serno from device_history
+	DBQSetMachineInfo                    // record the latest value of an item of machine info in machine_info
+	DBQGetMachineInfo                    // get latest values of all items of machine info by serno from machine_info
+	DBQAddDetCount                       // add to an hourly detection count in det_hourly
+	DBQGetDetCounts                      // get hourly detection counts in a time range by serno from det_hourly
+	DBQGetDetections                     // get tag detections in a time range by serno from messages
+	DBQGetOldestMsgOfType                // get time of oldest message of a given type from messages
+	DBQGetMsgsToArchive                  // get messages of a given type in a time range from messages, for archiving
+	DBQDeleteArchived                    // delete messages of a given type in a time range from messages, once archived
+	DBQNewSession                        // record a web session
+	DBQGetSession                        // get an unexpired web session by token
+	DBQDeleteSession                     // forget a web session
+	DBQSetMotusUser                      // record the email address and projects of a motus user who has logged in
+	DBQGetProjectEmails                  // get email addresses of motus users belonging to a project from motus_users
+	DBQStartRotation                     // record a new key pair for a receiver, starting a key rotation
+	DBQGetRotation                       // get the new key pair and start time of a receiver's key rotation
+	DBQGetRotations                      // get receivers with key rotations in progress
+	DBQFinishRotation                    // replace a receiver's key pair with its new one
+	DBQCancelRotation                    // forget a receiver's new key pair
+	DBQGetStaleKeys                      // get receivers with key pairs older than a given time
+	DBQArchiveSG                         // copy a receiver's registration to deleted_receivers
+	DBQDeleteSG                          // delete a receiver's registration
+	DBQGetAuthKeys                       // get the tunnel ports, public keys and verification of all receivers
+	DBQSetVerified                       // mark a receiver as verified
+	DBQGetUnverified                     // get registered receivers which have not been verified
+	DBQGetDeregistered                   // get when a receiver was deregistered, unless an admin has cleared it
+	DBQClearDeregistered                 // let a deregistered receiver register again
+	DBQ_num_queries                      // marks number of queries
 )
 
 // text of the queries; we use constants from above to make sure
 // queries are in correct slots of the array
 
 var dbQueryText = [DBQ_num_queries]string{
-	DBQGetTunnelPort:   "SELECT tunnelPort FROM receivers WHERE serno=?",
-	DBQGetTsLastSync:   "SELECT max(ts) FROM messages WHERE sender = ? AND SUBSTR(message, 1, 1) == '2'",
-	DBQGetRegistration: "SELECT tunnelPort, pubKey, privKey From receivers Where serno=?",
-	DBQNewSG:           "INSERT INTO receivers (serno, tunnelport) SELECT serno, tunnelPort FROM (SELECT ? AS serno, MIN(t1.tunnelport)+1 AS tunnelPort FROM receivers AS t1 LEFT JOIN receivers AS t2 ON t1.tunnelport=t2.tunnelport-1 WHERE t2.tunnelport IS NULL) where tunnelPort between " + strconv.Itoa(TunnelPortMin) + " and " + strconv.Itoa(TunnelPortMax),
-	DBQNewSGKeys:       "update receivers set creationdate=?, pubkey=?, privkey=?, verified=? where serno=?"}
-
-// global slice of prepared queries
-var dbQueries [DBQ_num_queries]*sql.Stmt
+	DBQGetTunnelPort:      "SELECT tunnelPort FROM receivers WHERE serno=?",
+	DBQGetTsLastSync:      "SELECT max(ts) FROM messages WHERE sender = ? AND SUBSTR(message, 1, 1) == '2'",
+	DBQGetRegistration:    "SELECT tunnelPort, pubKey, privKey, verified From receivers Where serno=?",
+	DBQNewSG:              "INSERT INTO receivers (serno, tunnelport) SELECT CAST(? AS TEXT), port FROM (SELECT MIN(port) AS port FROM (SELECT " + strconv.Itoa(TunnelPortMin) + " AS port WHERE NOT EXISTS (SELECT 1 FROM receivers WHERE tunnelport = " + strconv.Itoa(TunnelPortMin) + ") UNION ALL SELECT t1.tunnelport+1 AS port FROM receivers AS t1 LEFT JOIN receivers AS t2 ON t2.tunnelport = t1.tunnelport+1 WHERE t2.tunnelport IS NULL) AS free WHERE port BETWEEN " + strconv.Itoa(TunnelPortMin) + " AND " + strconv.Itoa(TunnelPortMax) + ") AS n WHERE port IS NOT NULL",
+	DBQNewSGKeys:          "update receivers set creationdate=?, pubkey=?, privkey=?, verified=? where serno=?",
+	DBQGetLastMsgTs:       "SELECT max(ts) FROM messages WHERE sender = ?",
+	DBQGetLastMsgOfType:   "SELECT ts, message FROM messages WHERE sender = ? AND SUBSTR(message, 1, 1) == ? ORDER BY ts DESC LIMIT 1",
+	DBQGetMsgsOfType:      "SELECT ts, message FROM messages WHERE sender = ? AND SUBSTR(message, 1, 1) == ? ORDER BY ts DESC LIMIT ?",
+	DBQGetSernos:          "SELECT serno FROM receivers ORDER BY serno",
+	DBQGetConnEvents:      "SELECT sender, ts, message FROM messages WHERE SUBSTR(message, 1, 1) IN ('0', '1') AND ts >= ? AND ts < ? ORDER BY sender, ts",
+	DBQGetConnStateBefore: "SELECT message FROM messages WHERE sender = ? AND SUBSTR(message, 1, 1) IN ('0', '1') AND ts < ? ORDER BY ts DESC LIMIT 1",
+	DBQNewGPSFix:          "INSERT INTO gps_fixes (serno, ts, lat, lon, alt) VALUES (?, ?, ?, ?, ?)",
+	DBQGetLastGPSFix:      "SELECT ts, lat, lon, alt FROM gps_fixes WHERE serno = ? ORDER BY ts DESC LIMIT 1",
+	DBQGetGPSFixes:        "SELECT ts, lat, lon, alt FROM gps_fixes WHERE serno = ? AND ts >= ? AND ts < ? ORDER BY ts",
+	DBQGetLatestGPSFixes:  "SELECT g.serno, g.ts, g.lat, g.lon, g.alt FROM gps_fixes AS g JOIN (SELECT serno, MAX(ts) AS ts FROM gps_fixes GROUP BY serno) AS m ON g.serno = m.serno AND g.ts = m.ts ORDER BY g.serno",
+	DBQNewDevice:          "INSERT INTO device_history (serno, port, type, attrs, added) VALUES (?, ?, ?, ?, ?)",
+	DBQRemoveDevice:       "UPDATE device_history SET removed = ? WHERE serno = ? AND port = ? AND removed IS NULL",
+	DBQGetDevices:         "SELECT port, type, attrs, added FROM device_history WHERE serno = ? AND removed IS NULL ORDER BY port",
+	DBQGetAnyDevice:       "SELECT 1 FROM device_history WHERE serno = ? LIMIT 1",
+	DBQGetDeviceHistory:   "SELECT port, type, attrs, added, removed FROM device_history WHERE serno = ? ORDER BY added",
+	DBQSetMachineInfo:     "INSERT OR REPLACE INTO machine_info (serno, ts, name, value) VALUES (?, ?, ?, ?)",
+	DBQGetMachineInfo:     "SELECT ts, name, value FROM machine_info WHERE serno = ? ORDER BY ts",
+	DBQAddDetCount:        "INSERT INTO det_hourly (serno, hour, port, tagid, n) VALUES (?, ?, ?, ?, ?) ON CONFLICT (serno, hour, port, tagid) DO UPDATE SET n = n + excluded.n",
+	DBQGetDetCounts:       "SELECT hour, port, tagid, n FROM det_hourly WHERE serno = ? AND hour >= ? AND hour < ? ORDER BY hour, port, tagid",
+	DBQGetDetections:      "SELECT ts, message FROM messages WHERE sender = ? AND detts >= ? AND detts < ? ORDER BY detts",
+	DBQGetOldestMsgOfType: "SELECT MIN(ts) FROM messages WHERE SUBSTR(message, 1, 1) == ?",
+	DBQGetMsgsToArchive:   "SELECT ts, sender, message FROM messages WHERE SUBSTR(message, 1, 1) == ? AND ts >= ? AND ts < ? ORDER BY ts",
+	DBQDeleteArchived:     "DELETE FROM messages WHERE SUBSTR(message, 1, 1) == ? AND ts >= ? AND ts < ?",
+	DBQNewSession:         "INSERT OR REPLACE INTO sessions (token, userid, expiry, email, isadmin, projects) VALUES (?, ?, ?, ?, ?, ?)",
+	DBQGetSession:         "SELECT userid, expiry, email, isadmin, projects FROM sessions WHERE token = ? AND expiry > ?",
+	DBQDeleteSession:      "DELETE FROM sessions WHERE token = ?",
+	DBQSetMotusUser:       "INSERT OR REPLACE INTO motus_users (userid, email, projects, ts) VALUES (?, ?, ?, ?)",
+	DBQGetProjectEmails:   "SELECT email FROM motus_users WHERE email != '' AND ',' || projects || ',' LIKE ? ORDER BY userid",
+	DBQStartRotation:      "UPDATE receivers SET newpubkey = ?, newprivkey = ?, rotationts = ? WHERE serno = ?",
+	DBQGetRotation:        "SELECT newpubkey, newprivkey, rotationts FROM receivers WHERE serno = ? AND newpubkey IS NOT NULL",
+	DBQGetRotations:       "SELECT serno, rotationts FROM receivers WHERE newpubkey IS NOT NULL ORDER BY rotationts",
+	DBQFinishRotation:     "UPDATE receivers SET creationdate = ?, pubkey = newpubkey, privkey = newprivkey, newpubkey = NULL, newprivkey = NULL, rotationts = NULL WHERE serno = ? AND newpubkey IS NOT NULL",
+	DBQCancelRotation:     "UPDATE receivers SET newpubkey = NULL, newprivkey = NULL, rotationts = NULL WHERE serno = ?",
+	DBQGetStaleKeys:       "SELECT serno FROM receivers WHERE pubkey IS NOT NULL AND newpubkey IS NULL AND COALESCE(creationdate, 0) < ? ORDER BY creationdate LIMIT ?",
+	DBQArchiveSG:          "INSERT INTO deleted_receivers (ts, serno, creationdate, tunnelport, pubkey, privkey, verified) SELECT ?, serno, creationdate, tunnelport, pubkey, privkey, verified FROM receivers WHERE serno = ?",
+	DBQDeleteSG:           "DELETE FROM receivers WHERE serno = ?",
+	DBQGetAuthKeys:        "SELECT serno, tunnelport, pubkey, newpubkey, verified FROM receivers ORDER BY serno",
+	DBQSetVerified:        "UPDATE receivers SET verified = 1 WHERE serno = ?",
+	DBQGetUnverified:      "SELECT serno, creationdate, tunnelport FROM receivers WHERE COALESCE(verified, 0) = 0 AND pubkey IS NOT NULL ORDER BY creationdate",
+	DBQGetDeregistered:    "SELECT ts FROM deleted_receivers WHERE serno = ? AND cleared IS NULL ORDER BY ts DESC LIMIT 1",
+	DBQClearDeregistered:  "UPDATE deleted_receivers SET cleared = ? WHERE serno = ? AND cleared IS NULL"}
 
 // open/create the main database
 //
-// also prepares all parameterized queries
-
-func OpenDB(path string) (db *sql.DB) {
-	var err error
-	db, err = sql.Open("sqlite3", SGDBFile)
+// `path` is an sqlite database file or a PostgreSQL URL, as for
+// OpenStore().  Exits on failure.
+func OpenDB(path string) Store {
+	db, err := OpenStore(path)
 	if err != nil {
 		log.Fatal(err)
 	}
-	stmts := [...]string{
-		`CREATE TABLE IF NOT EXISTS messages (
-                    ts DOUBLE,
-                    sender TEXT,
-                    message TEXT
-                )`,
-		`CREATE INDEX IF NOT EXISTS messages_ts ON messages(ts)`,
-		`CREATE INDEX IF NOT EXISTS messages_sender ON messages(sender)`,
-		`CREATE INDEX IF NOT EXISTS messages_sender_ts ON messages(sender, ts)`,
-		`CREATE INDEX IF NOT EXISTS messages_sender_type_ts ON messages(sender, substr(message, 1, 1), ts)`,
-		`CREATE TABLE IF NOT EXISTS receivers (
-                 serno        TEXT UNIQUE PRIMARY KEY, -- only one entry per receiver
-                 creationdate REAL,                    -- timestamp when this entry was created
-                 tunnelport   INTEGER UNIQUE,          -- port used on server for reverse tunnel back to sensorgnome
-                 pubkey       TEXT,                    -- unique public/private key pair used by sensorgnome to login to server
-                 privkey      TEXT,
-                 verified     INTEGER DEFAULT 0        -- has this SG been verified to belong to a real user?
-                 )`,
-		`CREATE INDEX IF NOT EXISTS receivers_tunnelport ON receivers(tunnelport)`,
-		`CREATE TABLE IF NOT EXISTS deleted_receivers (
-                 ts           REAL,                    -- deletion timestamp
-                 serno        TEXT,                    -- possibly multiple entries per receiver
-                 creationdate REAL,                    -- timestamp when this entry was created
-                 tunnelport   INTEGER,                 -- port used on server for reverse tunnel back to sensorgnome
-                 pubkey       TEXT,                    -- unique public/private key pair used by sensorgnome to login to server
-                 privkey      TEXT,
-                 verified     INTEGER DEFAULT 0        -- non-zero when verified
-                 )`,
-		`CREATE INDEX IF NOT EXISTS deleted_receivers_tunnelport ON deleted_receivers(tunnelport)`,
-		`PRAGMA busy_timeout = 60000`} // set a very generous 1-minute timeout for busy wait
-
-	for _, s := range stmts {
-		_, err = db.Exec(s)
-		if err != nil {
-			log.Printf("error: %s\n", s)
-			log.Fatal(err)
-		}
-	}
-
-	// prepare all statements we'll use
-	for i, q := range dbQueryText {
-		dbQueries[i], err = db.Prepare(q)
-		if err != nil {
-			panic("Unable to prepare query: " + q)
-		}
-	}
-	return
+	return db
 }
 
 const (
@@ -700,6 +912,15 @@ const (
 	CMD_PORT
 	CMD_SERNO
 	CMD_JSON
+	CMD_UPTIME
+	CMD_OUTAGES
+	CMD_DEVICES
+	CMD_VERSIONS
+	CMD_DETECTIONS
+	CMD_ROTATEKEY
+	CMD_DEREGISTER
+	CMD_RECONCILE
+	CMD_VERIFY
 	CMD_QUIT
 )
 
@@ -709,6 +930,28 @@ const (
 // Posssible formats:
 // - `json`: full summary of active receiver status; an object indexed
 //   by serial numbers
+// - `status SERNO`: detailed status of a single receiver, as a JSON object
+// - `uptime FROM TO [SERNO...]`: CSV connectivity summary of receivers over
+//   a time range, one line per receiver
+// - `outages FROM TO [SERNO...]`: CSV list of outages of receivers over a
+//   time range, one line per outage
+// - `devices SERNO`: CSV history of devices attached to a receiver, one
+//   line per device
+// - `versions [VERSION]`: CSV list of the software version, hardware type,
+//   boot count and last boot time of all registered receivers, or of only
+//   those running VERSION, one line per receiver
+// - `detections SERNO FROM TO`: CSV export of tag detections by a receiver
+//   over a time range, in the layout used by motus.org tools
+// - `rotatekey [SERNO | cancel SERNO]`: start or cancel rotating the key
+//   pair of a receiver; with no receiver, a CSV list of key rotations in
+//   progress
+// - `deregister [clear] SERNO`: deregister a receiver, revoking its keys
+//   and dropping its connection; with `clear`, let a deregistered
+//   receiver register again
+// - `reconcile [check]`: rewrite the receivers' lines in authorized_keys
+//   from the database, reporting any drift; with `check`, only report it
+// - `verify [SERNO]`: approve a newly registered receiver; with no
+//   receiver, a CSV list of those awaiting approval
 // - `port`: list of tunnelPorts of connected receivers, one per line
 // - `serno`: list of serial numbers of connected receivers, one per line
 
@@ -716,14 +959,23 @@ func handleStatusConn(conn net.Conn) {
 	buff := make([]byte, 4096)
 	var lr = NewLineReader(conn, &buff)
 	cmds := map[string]int8{
-		"who":    CMD_WHO,
-		"port":   CMD_PORT,
-		"ports":  CMD_PORT,
-		"serno":  CMD_SERNO,
-		"sernos": CMD_SERNO,
-		"status": CMD_JSON,
-		"json":   CMD_JSON,
-		"quit":   CMD_QUIT}
+		"who":        CMD_WHO,
+		"port":       CMD_PORT,
+		"ports":      CMD_PORT,
+		"serno":      CMD_SERNO,
+		"sernos":     CMD_SERNO,
+		"status":     CMD_JSON,
+		"json":       CMD_JSON,
+		"uptime":     CMD_UPTIME,
+		"outages":    CMD_OUTAGES,
+		"devices":    CMD_DEVICES,
+		"versions":   CMD_VERSIONS,
+		"detections": CMD_DETECTIONS,
+		"rotatekey":  CMD_ROTATEKEY,
+		"deregister": CMD_DEREGISTER,
+		"reconcile":  CMD_RECONCILE,
+		"verify":     CMD_VERIFY,
+		"quit":       CMD_QUIT}
 ConnLoop:
 	for {
 		err := lr.getLine()
@@ -731,7 +983,12 @@ ConnLoop:
 			break ConnLoop
 		}
 		var b string
-		cmd, ok := cmds[string(buff)]
+		words := strings.Fields(string(buff))
+		var cmd int8
+		ok := false
+		if len(words) > 0 {
+			cmd, ok = cmds[words[0]]
+		}
 		if !ok {
 			b = "Error: command must be one of: "
 			for c, _ := range cmds {
@@ -742,7 +999,31 @@ ConnLoop:
 			switch cmd {
 			case CMD_QUIT:
 				break ConnLoop
+			case CMD_UPTIME, CMD_OUTAGES:
+				b = UptimeReply(words, cmd == CMD_OUTAGES)
+			case CMD_DEVICES:
+				if len(words) < 2 {
+					b = "Error: usage is devices SERNO"
+					break
+				}
+				b = DeviceHistoryReply(words[1])
+			case CMD_VERSIONS:
+				b = VersionsReply(words)
+			case CMD_DETECTIONS:
+				b = DetectionsReply(words)
+			case CMD_ROTATEKEY:
+				b = KeyRotationReply(words)
+			case CMD_DEREGISTER:
+				b = DeregisterReply(words)
+			case CMD_RECONCILE:
+				b = ReconcileReply(words)
+			case CMD_VERIFY:
+				b = VerifyReply(words)
 			case CMD_JSON:
+				if len(words) > 1 {
+					b = ReceiverStatusReply(words[1])
+					break
+				}
 				bb := make([]byte, 0, 1000)
 				bb = append(bb, '{')
 				activeSGs.Range(func(serno interface{}, sgp interface{}) bool {
@@ -823,11 +1104,18 @@ func StatusServer(ctx context.Context, address string) {
 // In this case, as a side effect, the pointer is also stored in the
 // MotusInfo.Users with the userID as key
 func Authenticate(creds []string) *MotusUser {
+	if len(creds) < 3 {
+		return nil
+	}
 	switch creds[0] {
 	case "motus":
 		nows := time.Now().Format("20060102150405")
 		client := &http.Client{Timeout: 30 * time.Second}
 		res, err := client.Get(fmt.Sprintf(MotusAuthUser, nows, url.QueryEscape(creds[1]), url.QueryEscape(creds[2])))
+		if err != nil {
+			return nil
+		}
+		defer res.Body.Close()
 		var auth APIResAuth
 		dec := json.NewDecoder(res.Body)
 		err = dec.Decode(&auth)
@@ -843,7 +1131,7 @@ func Authenticate(creds []string) *MotusUser {
 			muser.ProjectIDs[n] = true
 			i++
 		}
-		MotusInfo.Users[muser.UserID] = muser
+		MotusInfo.AddUser(muser, true)
 		return muser
 	default:
 		// TODO: other authentication domains
@@ -857,13 +1145,21 @@ func Authenticate(creds []string) *MotusUser {
 func Authorized(userID int, serno Serno) bool {
 	// user is authorized if SG is deployed by a motus project to which the
 	// user belongs.
-	user := MotusInfo.Users[userID]
-	if dep, known := MotusInfo.RecvDeps[serno]; user != nil && (user.IsAdmin || (known && user.ProjectIDs[dep.ProjectID])) {
+	user := MotusInfo.User(userID)
+	if dep, known := MotusInfo.Dep(serno); user != nil && (user.IsAdmin || (known && user.ProjectIDs[dep.ProjectID])) {
 		return true
 	}
 	return false
 }
 
+// get the email address of a motus user who has logged in
+func userEmail(userID int) string {
+	if u := MotusInfo.User(userID); u != nil {
+		return u.Email
+	}
+	return "another user"
+}
+
 // check whether credentials are for a user who is authorized to use a device
 func AuthAuth(serno Serno, creds []string) bool {
 	if user := Authenticate(creds); user != nil && Authorized(user.UserID, serno) {
@@ -878,6 +1174,7 @@ type Registration struct {
 	tunnelPort int    // designated ssh tunnel port
 	pubKey     string // public encryption key
 	privKey    string // private encryption key
+	verified   bool   // has an admin or the receiver's project approved it?
 }
 
 // Handle registration requests.
@@ -902,13 +1199,22 @@ type Registration struct {
 //
 // For unsuccessful requests, we close the connection without replying.
 //
-// The request succeeds only in these cases:
+// A receiver which has been deregistered is refused until an admin
+// clears it (see DeregisterSG()); otherwise, the request succeeds only
+// in these cases:
+//
+//  - connection from a trusted network (tunnelPort, pubKey, privKey are generated
+//    from scratch if `SERNO` has not been seen before)
+//  - `SERNO` not seen before; connection from untrusted network; valid credentials of
+//    any motus user given
+//  - `SERNO` seen before; connection from untrusted network; valid credentials of a user
+//    authorized for the receiver given
 //
-//  - `SERNO` not seen before (tunnelPort, pubKey, privKey are then generated from scratch)
-//  - `SERNO` seen before; connection from trusted IP address
-//  - `SERNO` seen before; connection from untrusted IP address; valid credentials given
+// If `relayed` is true, the connection is to AddressRegRelay, and the
+// request must be preceded by a line `SSH_CLIENT=ADDR PORT LOCALPORT`
+// giving the address of the receiver; see regClientAddr().
 //
-func handleRegConn(conn net.Conn) {
+func handleRegConn(conn net.Conn, relayed bool) {
 	buff := make([]byte, 256)
 	var lr = NewLineReader(conn, &buff)
 	err := lr.getLine()
@@ -916,42 +1222,141 @@ func handleRegConn(conn net.Conn) {
 		if err != nil {
 			goto Done
 		}
-		serno := string(SernoRegexp.Find(buff))
+		// where is the receiver really connecting from?
+		client, hdr, err := regClientAddr(conn, string(buff), relayed)
+		if err != nil {
+			log.Printf("Attempt to register refused: %s\n", err.Error())
+			goto Done
+		}
+		if hdr {
+			if err = lr.getLine(); err != nil {
+				goto Done
+			}
+		}
+		serno := parseSerno(string(buff))
 		if serno == "" {
 			// invalid serno
 			goto Done
 		}
-		if serno[0:2] != "SG-" {
-			serno = "SG-" + serno;
+		// is this connection from a trusted network?  If not, the
+		// request must include credentials: those of a user authorized
+		// for the receiver if it has been seen before, or else those of
+		// any motus user.
+		trusted := isTrustedAddr(client)
+		var creds []string
+		if i := bytes.IndexByte(buff, ','); i >= 0 {
+			creds = strings.Split(string(buff[i+1:]), ",")
 		}
-		// is this connection from a trusted IP address?
-		// <JMB 2019-05-17>
-		//   trusted := TrustedIPAddrRegexp.MatchString(conn.RemoteAddr().String())
-		// // temporarily make *all* registrations succeed
-		trusted := true
-		// </JMB 2019-05-17>
 
 		// has this SG been seen before?
-		var reg Registration
-		known := SQL(DBQGetRegistration, c{serno}, c{&reg.tunnelPort, &reg.pubKey, &reg.privKey})
+		reg, known := DB.GetRegistration(serno)
 		if !known {
-			if err = RegisterSG(Serno(serno), &reg); err != nil {
-				log.Printf("Unable to register new receiver %s: %s", string(serno), err.Error())
+			// it may have registered with a serial number mangled as
+			// older versions of this server did
+			if old := legacySerno(string(buff)); old != serno {
+				if reg, known = DB.GetRegistration(old); known {
+					serno = old
+				}
+			}
+		}
+		// a deregistered receiver can't register again until an admin
+		// clears it
+		if !known {
+			if ts, dereg := deregisteredAt(serno); dereg {
+				log.Printf("Attempt to register %s from %v refused: deregistered at %s\n", serno, client, ts.Format(time.RFC3339))
 				goto Done
 			}
 		}
 		// see whether we need to authenticate request
-		if known && !trusted && (len(buff) == len(serno) || !AuthAuth(Serno(serno), strings.Split(string(buff[len(serno):]), ","))) {
-			log.Printf("Attempt to register failed at auth: %s\n", buff)
+		if !trusted && ((known && !AuthAuth(serno, creds)) || (!known && Authenticate(creds) == nil)) {
+			log.Printf("Attempt to register %s from %v failed at auth\n", serno, client)
 			goto Done
 		}
-		_, err = io.WriteString(conn, fmt.Sprintf("%d\n%s%s", reg.tunnelPort, reg.pubKey, reg.privKey))
+		if !known {
+			if err = RegisterSG(serno, &reg); err != nil {
+				log.Printf("Unable to register new receiver %s: %s", string(serno), err.Error())
+				goto Done
+			}
+			log.Printf("Registered new receiver %s from %v (trusted: %t)\n", serno, client, trusted)
+		}
+		// a receiver whose key is being rotated gets its new key
+		var (
+			newPub, newPriv string
+			rotationTs      float64
+		)
+		if known && SQL(DBQGetRotation, c{serno}, c{&newPub, &newPriv, &rotationTs}) {
+			reg.pubKey, reg.privKey = newPub, newPriv
+		}
+		var privKey string
+		if privKey, err = decryptKey(serno, reg.privKey); err != nil {
+			log.Printf("Unable to reply to registration: %s\n", err.Error())
+			goto Done
+		}
+		_, err = io.WriteString(conn, fmt.Sprintf("%d\n%s%s", reg.tunnelPort, reg.pubKey, privKey))
 	}
 Done:
 	log.Printf("Attempt to register bad serno: %s\n", buff)
 	conn.Close()
 }
 
+// normalize a serial number given in a request
+//
+// returns "" if `s` is not a valid serial number.
+func parseSerno(s string) Serno {
+	serno := strings.ToUpper(SernoRegexp.FindString(s))
+	if serno != "" && serno[0:3] != "SG-" {
+		serno = "SG-" + serno
+	}
+	return Serno(serno)
+}
+
+// get the serial number in a registration request as older versions
+// of this server did: as given, with "SG-" always prepended, so that
+// "SG-1234BBBK5678" became "SG-SG-1234BBBK5678"
+//
+// Receivers registered under such names keep them; parseSerno() is
+// used for all new registrations.
+func legacySerno(req string) Serno {
+	serno := SernoRegexp.FindString(req)
+	if serno == "" {
+		return ""
+	}
+	return Serno("SG-" + serno)
+}
+
+// normalize a serial number given in a request about a receiver which
+// may be registered under its legacy name (see legacySerno)
+//
+// `s` may be the serial number, in which case the legacy name is used
+// if a receiver is registered or deregistered under that but not
+// under the normal one, or it may be the legacy name itself.  Returns
+// "" if `s` is not a valid serial number.
+func lookupSerno(s string) Serno {
+	serno := parseSerno(s)
+	if serno != "" && knownSerno(serno) {
+		return serno
+	}
+	names := []Serno{legacySerno(s)}
+	if len(s) > 3 && strings.EqualFold(s[:3], "SG-") {
+		names = append(names, legacySerno(s[3:]))
+	}
+	for _, old := range names {
+		if old != "" && old != serno && knownSerno(old) {
+			return old
+		}
+	}
+	return serno
+}
+
+// whether a receiver is registered, or deregistered and not cleared
+func knownSerno(serno Serno) bool {
+	if _, ok := DB.GetRegistration(serno); ok {
+		return true
+	}
+	_, ok := deregisteredAt(serno)
+	return ok
+}
+
 // obtain the webPort for a given tunnelport
 func webPortFromTunnelPort(tp int) int {
 	// on the server, we reserve tp + 10000 for the local port mapped
@@ -963,16 +1368,11 @@ func webPortFromTunnelPort(tp int) int {
 //
 // return Error on failure, nil on success
 func RegisterSG(serno Serno, reg *Registration) error {
-	ok := SQL(DBQNewSG, c{string(serno)}, c{})
-	if !ok {
-		// unable to create new SG record (!) out of tunnel ports?  Obvious DOS attack vector here!
-		return fmt.Errorf("unable to register new SG: %s", serno)
-	}
-	reg.serno = serno
-	// read back the tunnelPort just generated
-	if !SQL(DBQGetRegistration, c{serno}, c{&reg.tunnelPort, &reg.pubKey, &reg.privKey}) {
-		return fmt.Errorf("unable to read registration record for %s", serno)
+	r, err := DB.NewRegistration(serno)
+	if err != nil {
+		return err
 	}
+	*reg = r
 
 	// FIXME: deal with keys having already been generated on sgdata.motus.org
 	// because data files were seen before the receiver was.
@@ -985,32 +1385,26 @@ func RegisterSG(serno Serno, reg *Registration) error {
 	//     os.rename(alt_keyfile_name + ".pub", keyfile_name + ".pub")
 	// else:
 	// 	# generate a pub/priv keypair
-	keyfile := path.Join(CryptoKeyPath, "id_rsa_"+string(serno))
-	err := exec.Command("ssh-keygen", "-t", "rsa", "-f", keyfile, "-N", "").Run()
+	keys, err := NewKeyPair(CryptoKeyType, serno)
 	if err != nil {
 		return err
 	}
 	// export an openssl-compatible version of the public key
 	// for use in signature verification
-	// sample command: openssl dsa -in ~sg_remote/.ssh/id_dsa_sg_2814BBBK4765 -pubout -out ~sg_remote/.ssh/id_dsa_sg_2814BBBK4765.openssl.pub
-	err = exec.Command("openssl", "rsa", "-in", keyfile, "-pubout", "-out", keyfile+".openssl.pub").Run()
-	if err != nil {
-		return err
-	}
-	privkey, err := ioutil.ReadFile(keyfile)
-	if err != nil {
+	if err = ioutil.WriteFile(pemPath(serno), []byte(keys.PublicPEM), 0644); err != nil {
 		return err
 	}
-	pubkey, err := ioutil.ReadFile(keyfile + ".pub")
+	encPrivkey, err := encryptKey(serno, keys.PrivatePEM)
 	if err != nil {
 		return err
 	}
 
-	if !SQL(DBQNewSGKeys, c{unixtime(time.Now()), pubkey, privkey, true, string(serno)}, c{}) {
-		return fmt.Errorf("Unable to record crypto keys for %s", serno)
+	// new receivers are unverified until approved; see VerifySG()
+	if err = DB.SetKeys(serno, keys.AuthorizedKey, encPrivkey, false); err != nil {
+		return err
 	}
-	reg.pubKey = string(pubkey)
-	reg.privKey = string(privkey)
+	reg.pubKey = keys.AuthorizedKey
+	reg.privKey = encPrivkey
 
 	//     auth_key_file = open(SSH_DIR + "authorized_keys", "a")
 	//     # restrict this key to running sg_remote and only mapping a single remote port
@@ -1020,18 +1414,13 @@ func RegisterSG(serno Serno, reg *Registration) error {
 	//     # fill up an sqlite database with junk, and can't connect to any services
 	//     # on the host.
 
-	f, err := os.OpenFile(CryptoAuthKeysPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	_, err = fmt.Fprintf(f, `command="/bin/true",no-pty,no-X11-forwarding,permitlisten="localhost:%d",permitlisten="localhost:%d",permitopen="localhost:%s",environment="SG_SERNO=%s",environment="SG_PORT=%d",connection-semname="%s" %s`,
-		reg.tunnelPort, webPortFromTunnelPort(reg.tunnelPort), TrustedStreamPort, string(serno), reg.tunnelPort, string(serno), pubkey)
-	f.Close()
-	return err
+	return appendAuthKey(authKeyLine(serno, reg.tunnelPort, false, keys.AuthorizedKey, string(serno)))
 }
 
 // listen for SG registration request connections and dispatch them to a handler
-func RegistrationServer(ctx context.Context, address string) {
+//
+// `relayed` is true for AddressRegRelay; see handleRegConn().
+func RegistrationServer(ctx context.Context, address string, relayed bool) {
 	addr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		print("failed to resolve address " + address)
@@ -1050,7 +1439,7 @@ func RegistrationServer(ctx context.Context, address string) {
 			print("problem accepting connection")
 			return
 		}
-		go handleRegConn(net.Conn(conn))
+		go handleRegConn(net.Conn(conn), relayed)
 	}
 	select {
 	case <-ctx.Done():
@@ -1094,6 +1483,14 @@ func StatusPageMaintainer(path string, latency time.Duration) {
 	}()
 }
 
+// escape text reported by a receiver for the status page
+//
+// The page is a markdown table of HTML, so markup and the column
+// separator are both escaped.
+func statusPageText(s string) string {
+	return strings.Replace(html.EscapeString(s), "|", "&#124;", -1)
+}
+
 func mkTime(t time.Time) string {
 	if t.IsZero() || t.Unix() == 0 {
 		return "?"
@@ -1111,19 +1508,27 @@ func MakeStatusPage(path string) {
 
 	fmt.Fprintln(f, mkTime(time.Now()))
 	fmt.Fprintln(f, "{{< bootstrap-table \"table table-striped table-bordered\" >}}")
-	fmt.Fprintln(f, "\nSerial Number (Port)|Site (Project)|Connected?|Last Con. / Discon.|motus.org Last Sync|motus.org Next Sync"+
-		"\n:------------------:|--------------|:--------:|-----------------|-------------------|-------------------")
+	fmt.Fprintln(f, "\nSerial Number (Port)|Site (Project)|Connected?|Last Con. / Discon.|Devices|Software|Last Boot|motus.org Last Sync|motus.org Next Sync"+
+		"\n:------------------:|--------------|:--------:|-----------------|-------|--------|---------|-------------------|-------------------")
 
 	var lines []string
 	activeSGs.Range(func(sno interface{}, sgp interface{}) bool {
 		serno := sno.(Serno)
 		sg := sgp.(*ActiveSG)
-		rdep := MotusInfo.RecvDeps[serno]
+		rdep, _ := MotusInfo.Dep(serno)
+		sg.lock.Lock()
+		defer sg.lock.Unlock()
 		var status string
 		var tcon time.Time
 		var liveLink string
 		if sg.Connected {
 			status = "Yes"
+			if sg.Silent {
+				status = "Yes, <b>silent</b> since " + mkTime(sg.lastHeard())
+			}
+			if sg.Clock != nil && sg.Clock.Unsynced {
+				status += fmt.Sprintf(", <b>clock off by %.0f s</b>", sg.Clock.Offset)
+			}
 			tcon = sg.TsConn
 			liveLink = fmt.Sprintf(`<a href="https://%s.sensorgnome.org">%s</a>`, serno, serno)
 		} else {
@@ -1131,7 +1536,26 @@ func MakeStatusPage(path string) {
 			tcon = sg.TsDisConn
 			liveLink = string(serno)
 		}
-		line := fmt.Sprintf(`%s (%d)|%s (%s)|%s|%s|<a href="https://sgdata.motus.org/status?jobsForSerno=%s&excludeSync=0" target="_blank">%s</a>|%s`, liveLink, sg.TunnelPort, rdep.SiteName, MotusInfo.Projects[rdep.ProjectID], status, mkTime(tcon), serno, mkTime(sg.TsLastSync), mkTime(sg.TsNextSync))
+		site := rdep.SiteName
+		if sg.Connected && sg.NoTags {
+			status += ", <b>no detections</b> since " + mkTime(sg.TsLastDet)
+		}
+		if sg.Mislocated {
+			site += fmt.Sprintf(" <b>GPS %.1f km from deployment</b>", sg.DepDist/1000)
+		}
+		devices := sg.deviceSummary()
+		version, tsBoot := "?", time.Time{}
+		if sg.Machine != nil {
+			if sg.Machine.Version != "" {
+				version = statusPageText(sg.Machine.Version)
+			}
+			tsBoot = sg.Machine.TsBoot
+		}
+		lastBoot := mkTime(tsBoot)
+		if sg.BootLoop {
+			lastBoot += " <b>boot loop</b>"
+		}
+		line := fmt.Sprintf(`%s (%d)|%s (%s)|%s|%s|%s|%s|%s|<a href="https://sgdata.motus.org/status?jobsForSerno=%s&excludeSync=0" target="_blank">%s</a>|%s`, liveLink, sg.TunnelPort, site, MotusInfo.Project(rdep.ProjectID), status, mkTime(tcon), devices, version, lastBoot, serno, mkTime(sg.TsLastSync), mkTime(sg.TsNextSync))
 		lines = append(lines, line)
 		return true
 	})
@@ -1141,8 +1565,11 @@ func MakeStatusPage(path string) {
 }
 
 type RecvDep struct {
-	ProjectID int
-	SiteName  string
+	ProjectID   int
+	SiteName    string
+	HasLocation bool    // were latitude and longitude given for the deployment?
+	Lat         float64 // deployment latitude (degrees N)
+	Lon         float64 // deployment longitude (degrees E)
 }
 
 // a Motus user
@@ -1153,7 +1580,13 @@ type MotusUser struct {
 	IsAdmin    bool // can look at any receiver
 }
 
+// metadata from motus.org, and the motus users who have logged in
+//
+// It is read by the HTTP handlers and by message consumers while
+// UpdateMotusCache and logins write it, so its maps are only used
+// through its methods, which hold lock.
 type MotusCache struct {
+	lock      sync.RWMutex
 	lastFetch time.Time // time motus data last fetched
 	Latency   time.Duration
 	Projects  map[int]string     // project names by id
@@ -1161,7 +1594,39 @@ type MotusCache struct {
 	Users     map[int]*MotusUser // motus users who have logged in, by id
 }
 
-var MotusInfo *MotusCache
+var MotusInfo = &MotusCache{Latency: MotusMinLatency * time.Minute, Projects: make(map[int]string), RecvDeps: make(map[Serno]RecvDep), Users: make(map[int]*MotusUser)}
+
+// get the motus deployment of a receiver
+func (mc *MotusCache) Dep(serno Serno) (dep RecvDep, known bool) {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	dep, known = mc.RecvDeps[serno]
+	return
+}
+
+// get the name of a motus project
+func (mc *MotusCache) Project(id int) string {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	return mc.Projects[id]
+}
+
+// get a motus user who has logged in; nil if none
+func (mc *MotusCache) User(id int) *MotusUser {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+	return mc.Users[id]
+}
+
+// record a motus user; unless `replace` is true, a user already
+// recorded is kept
+func (mc *MotusCache) AddUser(u *MotusUser, replace bool) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if replace || mc.Users[u.UserID] == nil {
+		mc.Users[u.UserID] = u
+	}
+}
 
 // result returned by the motus API projects/list
 type APIResProj struct {
@@ -1177,6 +1642,8 @@ type APIResRecv struct {
 		ReceiverID     string
 		DeploymentName string
 		RecvProjectID  int
+		Latitude       *float64
+		Longitude      *float64
 	}
 }
 
@@ -1190,38 +1657,58 @@ type APIResAuth struct {
 }
 
 // maintain the motus metadata cache
+//
+// New maps are built from what motus.org returns, and swapped in with
+// the lock held, so readers never see one being filled.
 func UpdateMotusCache() {
-	if MotusInfo == nil {
-		MotusInfo = &MotusCache{Latency: MotusMinLatency * time.Minute, Projects: make(map[int]string), RecvDeps: make(map[Serno]RecvDep), Users: make(map[int]*MotusUser)}
-	}
 	now := time.Now()
-	if now.Sub(MotusInfo.lastFetch) > MotusInfo.Latency {
+	MotusInfo.lock.RLock()
+	stale := now.Sub(MotusInfo.lastFetch) > MotusInfo.Latency
+	MotusInfo.lock.RUnlock()
+	if stale {
 		client := &http.Client{Timeout: 30 * time.Second}
 		nows := now.Format("20060102150405")
+		var (
+			projects map[int]string
+			deps     map[Serno]RecvDep
+		)
 		res, err := client.Get(fmt.Sprintf(MotusGetProjectsUrlT, nows))
-		got := 0
 		if err == nil {
 			var projs APIResProj
 			dec := json.NewDecoder(res.Body)
 			err = dec.Decode(&projs)
+			res.Body.Close()
+			projects = make(map[int]string)
 			for _, x := range projs.Data {
-				MotusInfo.Projects[x.Id] = x.Code
+				projects[x.Id] = x.Code
 			}
-			got++
 		}
 		res, err = client.Get(fmt.Sprintf(MotusGetReceiversUrlT, nows))
 		if err == nil {
 			var recvs APIResRecv
 			dec := json.NewDecoder(res.Body)
 			err = dec.Decode(&recvs)
+			res.Body.Close()
+			deps = make(map[Serno]RecvDep)
 			for _, x := range recvs.Data {
-				MotusInfo.RecvDeps[Serno(x.ReceiverID)] = RecvDep{ProjectID: x.RecvProjectID, SiteName: x.DeploymentName}
+				dep := RecvDep{ProjectID: x.RecvProjectID, SiteName: x.DeploymentName}
+				if x.Latitude != nil && x.Longitude != nil {
+					dep.HasLocation, dep.Lat, dep.Lon = true, *x.Latitude, *x.Longitude
+				}
+				deps[Serno(x.ReceiverID)] = dep
 			}
-			got++
 		}
-		if got == 2 {
+		MotusInfo.lock.Lock()
+		if projects != nil {
+			MotusInfo.Projects = projects
+		}
+		if deps != nil {
+			MotusInfo.RecvDeps = deps
+		}
+		if projects != nil && deps != nil {
 			MotusInfo.lastFetch = now
 		}
+		MotusInfo.lock.Unlock()
 	}
 }
 
@@ -1276,11 +1763,54 @@ type SGSession struct {
 	LastReq time.Time  // time of last request from client
 }
 
-// map from token string to user token
-var StringToToken map[string]*UserToken
+// map from token string to user token; guarded by tokenLock, since
+// both the reverse proxy and the web API look up tokens
+var StringToToken = make(map[string]*UserToken)
 
-// map from serno to SGSession
-var SernoToSess map[Serno]*SGSession
+// guards StringToToken
+var tokenLock sync.Mutex
+
+// get a user token by its string
+//
+// Tokens issued by this process are in StringToToken; others, issued
+// by a previous run of the server or another server sharing the
+// database, are restored from the sessions table, along with the
+// user's motus authorizations.  Returns nil if the token is unknown.
+func lookupToken(s string) *UserToken {
+	tokenLock.Lock()
+	t := StringToToken[s]
+	tokenLock.Unlock()
+	if t != nil {
+		return t
+	}
+	t, u := DB.GetSession(s)
+	if t == nil {
+		return nil
+	}
+	MotusInfo.AddUser(u, false)
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	// another request may have restored it meanwhile
+	if t0 := StringToToken[s]; t0 != nil {
+		return t0
+	}
+	StringToToken[s] = t
+	return t
+}
+
+// map from serno to SGSession; guarded by sessLock, since receivers
+// can be deregistered while web clients are using them
+var SernoToSess = make(map[Serno]*SGSession)
+
+// guards SernoToSess
+var sessLock sync.Mutex
+
+// get the web session with a receiver, if any
+func sgSession(serno Serno) *SGSession {
+	sessLock.Lock()
+	defer sessLock.Unlock()
+	return SernoToSess[serno]
+}
 
 /*
    handle requests as per: https://github.com/jbrzusto/sensorgnomeServer/issues/5#issuecomment-477696911
@@ -1339,6 +1869,33 @@ func MakeToken(n int) string {
 	return base64.RawStdEncoding.EncodeToString(buf)[:n]
 }
 
+// log in a motus user
+//
+// If the credentials are valid, set up a UserToken representing
+// this user, good for 1 week, and add a cookie holding it to the
+// response.  This cookie grants the web client access to sessions
+// with SGs, and to the web API.
+//
+// Returns the token on success, nil otherwise.
+func Login(w http.ResponseWriter, username, password string) *UserToken {
+	user := Authenticate([]string{"motus", username, password})
+	if user == nil {
+		return nil
+	}
+	token := UserToken{Token: MakeToken(32),
+		Expiry: time.Now().Add(time.Hour * 24 * 7),
+		UserID: user.UserID}
+	tokenLock.Lock()
+	StringToToken[token.Token] = &token
+	tokenLock.Unlock()
+	if err := DB.SaveSession(&token, user); err != nil {
+		log.Printf("%s\n", err.Error())
+	}
+	cookie := http.Cookie{Name: "sgsession", Value: token.Token, Expires: token.Expiry, Domain: ".sensorgnome.org"}
+	http.SetCookie(w, &cookie)
+	return &token
+}
+
 // serve web clients with pages from an ActiveSG, using cookies to
 // protect with credentials, and limiting to one user per SG
 // (The SG web server handles only one connection at a time).
@@ -1376,10 +1933,10 @@ func RevProxyHandler(w http.ResponseWriter, r *http.Request) {
 	// get any user token
 	var token *UserToken = nil
 	if cookie, err := r.Cookie("sgsession"); err == nil {
-		token = StringToToken[cookie.Value]
+		token = lookupToken(cookie.Value)
 	}
 	now := time.Now()
-	if sess := SernoToSess[serno]; sess != nil && sess.Token == token {
+	if sess := sgSession(serno); sess != nil && sess.Token == token {
 		// Most common case; this request is part of a session
 		// belonging to the user who owns the token.  As long
 		// as the authentication token hasn't expired we proxy
@@ -1392,8 +1949,13 @@ func RevProxyHandler(w http.ResponseWriter, r *http.Request) {
 			sess.SG.lock.Lock()
 			defer sess.SG.lock.Unlock()
 			sess.SG.WebUser = 0
+			sessLock.Lock()
 			delete(SernoToSess, serno)
+			sessLock.Unlock()
+			tokenLock.Lock()
 			delete(StringToToken, sess.Token.Token)
+			tokenLock.Unlock()
+			DB.DeleteSession(sess.Token.Token)
 			RequestLogin(w, &lpp)
 		}
 		return
@@ -1413,19 +1975,10 @@ func RevProxyHandler(w http.ResponseWriter, r *http.Request) {
 	if path == ProxyLoginPath && r.Method == "POST" {
 		// try validate user
 		if r.ParseForm() == nil {
-			user := Authenticate([]string{"motus", r.Form["username"][0], r.Form["password"][0]})
-			if user != nil {
-				// set up a UserToken representing this user, good for 1 week
-				token := UserToken{Token: MakeToken(32),
-					Expiry: time.Now().Add(time.Hour * 24 * 7),
-					UserID: user.UserID}
-				StringToToken[token.Token] = &token
-				// add cookie and redirect to the original path
+			if Login(w, r.Form.Get("username"), r.Form.Get("password")) != nil {
+				// redirect to the original path
 				// which is stored in the form's "target" item
-				// This cookie grants the web client access to the session with this SG
-				cookie := http.Cookie{Name: "sgsession", Value: token.Token, Expires: token.Expiry, Domain: ".sensorgnome.org"}
-				http.SetCookie(w, &cookie)
-				http.Redirect(w, r, r.Form["target"][0], http.StatusFound)
+				http.Redirect(w, r, r.Form.Get("target"), http.StatusFound)
 				return
 			}
 		}
@@ -1457,12 +2010,14 @@ func RevProxyHandler(w http.ResponseWriter, r *http.Request) {
 	if sg.WebUser != 0 && sg.WebUser != token.UserID {
 		// in use by other user - see if their session or token has expired;
 		// an expired token forces the session to expire
-		if oSess := SernoToSess[serno]; oSess != nil {
+		if oSess := sgSession(serno); oSess != nil {
 			if oSess.Token.Expiry.Before(now) || now.Sub(oSess.LastReq) > SessionKeepAlive {
 				// delete the other user's expired session
+				sessLock.Lock()
 				delete(SernoToSess, serno)
+				sessLock.Unlock()
 			} else {
-				http.Error(w, "This SG is in use by "+MotusInfo.Users[sg.WebUser].Email+" - try again later", http.StatusServiceUnavailable)
+				http.Error(w, "This SG is in use by "+userEmail(sg.WebUser)+" - try again later", http.StatusServiceUnavailable)
 				return
 			}
 		}
@@ -1474,14 +2029,14 @@ func RevProxyHandler(w http.ResponseWriter, r *http.Request) {
 	sg.lock.Unlock()
 	// set up an SGSession connecting this user to this SG
 	sess := SGSession{SG: sg, Token: token, LastReq: now}
+	sessLock.Lock()
 	SernoToSess[serno] = &sess
+	sessLock.Unlock()
 	sg.Proxy.ServeHTTP(w, r)
 }
 
 // server to connect web clients with credentials to SG web servers
 func MasterRevProxy(ctx context.Context, addr string) {
-	StringToToken = make(map[string]*UserToken)
-	SernoToSess = make(map[Serno]*SGSession)
 	srv := http.Server{Addr: addr, Handler: http.HandlerFunc(RevProxyHandler)}
 	srv.ListenAndServe()
 	defer srv.Shutdown(nil)
@@ -1510,9 +2065,50 @@ func InitProxy(sg *ActiveSG) {
 }
 
 func main() {
+	dryRun := flag.Bool("migrate-dry-run", false, "print pending database schema migrations, then exit without running them")
+	restore := flag.String("restore", "", "replace the database with this snapshot, after validating it, then exit; the server must be stopped")
+	retention := flag.String("retention", MessageRetentionDays, "comma-separated TOPIC=DAYS overrides of how long messages are kept before archiving; 0 days keeps a topic forever")
+	vacuum := flag.Bool("vacuum", false, "convert the database to incremental auto_vacuum mode, so archiving returns freed space, then exit; the server must be stopped")
+	flag.Parse()
+	MessageRetention = mustParseRetention(*retention)
+	dbPath := SGDBFile
+	if SGDBURL != "" {
+		dbPath = SGDBURL
+	}
+	if *restore != "" {
+		if SGDBURL != "" {
+			log.Fatal("snapshots can only be restored to an sqlite database")
+		}
+		if err := RestoreDB(*restore, dbPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *vacuum {
+		if SGDBURL != "" {
+			log.Fatal("only an sqlite database needs converting")
+		}
+		if err := ConvertAutoVacuum(dbPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *dryRun {
+		if err := PrintPendingMigrations(os.Stdout, dbPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	rand.Seed(time.Now().UnixNano())
 	Bus = mbus.NewMbus()
-	var ctx, _ = context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	// on SIGINT or SIGTERM, shut down once waiting messages are recorded
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
 
 	//
 	//         Message Consumers
@@ -1524,8 +2120,28 @@ func main() {
 	// receive messages on topics it has subscribed to. i.e. no messages will be missed,
 	// even if the new goroutine has not run yet.
 
+	// open the database, migrating its schema if necessary; this
+	// needs the master key to encrypt any unencrypted private keys
+	if err := LoadMasterKey(MasterKeyEnv, MasterKeyFile); err != nil {
+		log.Fatal(err)
+	}
+	DB = OpenDB(dbPath)
+
+	// make sure authorized_keys matches the database
+	if _, err := ReconcileAuthKeys(false); err != nil {
+		log.Printf("unable to reconcile %s: %s\n", authKeysPath, err.Error())
+	}
+
 	// record messages to a database
-	DBRecorder()
+	recorded := DBRecorder(ctx)
+
+	// archive and delete expired messages
+	MessageArchiver(ArchiveDir, ArchiveInterval)
+
+	// snapshot the database
+	if SGDBURL == "" {
+		DBBackup(BackupDir, BackupInterval, BackupKeep)
+	}
 
 	// maintain the list of active SGs
 	SGMinder()
@@ -1533,6 +2149,36 @@ func main() {
 	// manage sync jobs on attached SGs
 	SyncManager()
 
+	// relay tag detections to live web clients
+	LiveTagRelay()
+
+	// track receiver locations
+	GPSTracker(GPSMoveThreshold, MotusMismatchDist)
+
+	// flag receivers whose clocks are wrong
+	ClockMonitor(ClockMaxOffset, ClockLockPrec)
+
+	// keep track of receiver software versions, boot counts etc.
+	MachineInfoMonitor()
+
+	// flag receivers which keep rebooting
+	BootLoopMonitor(BootLoopCount, BootLoopWindow)
+
+	// keep detection statistics and flag receivers which stop detecting tags
+	DetectionStats(DetSilentThreshold, DetStatsFlush)
+
+	// keep track of devices attached to receivers
+	DeviceInventory(DevFlapCount, DevFlapWindow)
+
+	// flag connected receivers which stop sending messages
+	LivenessMonitor(SilentThreshold, LivenessCheckInterval)
+
+	// replace receivers' key pairs
+	KeyRotator(KeyRotationGrace, KeyRotationMaxAge, KeyRotationBatch, KeyRotationInterval)
+
+	// alert people about receivers which go offline
+	AlertManager(AlertOfflineThreshold, AlertCheckInterval)
+
 	// messageDump() // DEBUG
 
 	// maintain an up-to-date status page
@@ -1559,7 +2205,8 @@ func main() {
 	go DgramSource(ctx, AddressTrustedDgram, true)
 
 	// handle SG (re-)registrations
-	go RegistrationServer(ctx, AddressRegServer)
+	go RegistrationServer(ctx, AddressRegServer, false)
+	go RegistrationServer(ctx, AddressRegRelay, true)
 
 	//
 	//         non-Message servers
@@ -1573,6 +2220,10 @@ func main() {
 	// handle HTTP requests sent to sg-xxxxxxxxxxxx.sensorgnome.org
 	go MasterRevProxy(ctx, AddressRevProxy)
 
-	// wait until cancelled (nothing does this, though)
+	// serve the web API (live detections etc.)
+	go WebAPIServer(ctx, AddressWebAPI)
+
+	// wait until cancelled by a signal, and for the recorder to finish
 	<-ctx.Done()
+	<-recorded
 }
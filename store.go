@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage
+//
+// All persistent state goes through a Store: receivers and their
+// registrations, messages, and web sessions, as well as the tables
+// kept by the various monitors, which are reached through the
+// dbQuery constants and the SQL() and SQLRows() helpers.
+//
+// The store is either an sqlite database file, or a PostgreSQL
+// database, which lets several server processes and analysis jobs
+// share state without contending for sqlite's lock.  Both use the same
+// schema and queries, which are written for sqlite and rewritten for
+// PostgreSQL by pgDialect(); queries which can't be rewritten that
+// way have their own text in pgQueryText.  Each kind of database has
+// its own type, sqliteStore or pgStore, with the methods only it has,
+// such as Backup(); these are not part of Store, and callers find them
+// by type assertion.
+
+// the global store, opened by main()
+var DB Store
+
+// a place to keep the server's state
+type Store interface {
+	// run a query, storing the first row of results into res, as
+	// for SQL()
+	QueryRow(q dbQuery, pars []interface{}, res []interface{}) bool
+	// run a query, returning all rows of results, as for SQLRows()
+	QueryRows(q dbQuery, pars []interface{}) (*sql.Rows, error)
+
+	// get the registration of a receiver; returns false if it has
+	// none
+	GetRegistration(serno Serno) (reg Registration, ok bool)
+	// create a registration with a new tunnel port for a receiver;
+	// its keys are empty
+	NewRegistration(serno Serno) (reg Registration, err error)
+	// set the keys of a receiver's registration
+	SetKeys(serno Serno, pubKey, privKey string, verified bool) error
+	// move a receiver's registration to deleted_receivers, freeing
+	// its tunnel port
+	DeleteRegistration(serno Serno) error
+
+	// record a batch of messages in a single transaction
+	AddMessages(msgs []dbMsg) error
+
+	// record a web session: a user's token and what they are
+	// authorized for, which is also kept after the session ends
+	SaveSession(t *UserToken, u *MotusUser) error
+	// get a web session by token; returns nils if there is no
+	// unexpired session with that token
+	GetSession(token string) (*UserToken, *MotusUser)
+	// forget a web session
+	DeleteSession(token string) error
+	// get the email addresses of motus users who have logged in and
+	// belong to a project, as motus.org told us at their last login
+	ProjectEmails(projectID int) []string
+
+	Close() error
+}
+
+// things only some kinds of Store can do, found by type assertion
+
+// a Store which can write a consistent snapshot of itself to a new
+// file; see BackupDB()
+type snapshotStore interface {
+	Backup(path string) error
+}
+
+// a Store which must be told to return space freed by deleting rows
+// to the filesystem; see ArchiveExpiredMessages()
+type vacuumStore interface {
+	Vacuum() bool
+}
+
+// the parts of a Store common to sqlite and PostgreSQL databases, with
+// queries in the given dialect, "sqlite3" or "postgres"
+type sqlStore struct {
+	db        *sql.DB
+	dialect   string
+	queries   [DBQ_num_queries]*sql.Stmt
+	insertMsg *sql.Stmt
+}
+
+// a Store in an sqlite database file
+type sqliteStore struct {
+	*sqlStore
+}
+
+// a Store in a PostgreSQL database
+type pgStore struct {
+	*sqlStore
+}
+
+// queries whose PostgreSQL text is not just a rewrite of the sqlite
+// text
+var pgQueryText = map[dbQuery]string{
+	DBQGetMsgsOfType:  "SELECT ts, message FROM messages WHERE sender = $1 AND SUBSTR(message, 1, 1) = $2 ORDER BY ts DESC LIMIT NULLIF($3, -1)",
+	DBQSetMachineInfo: "INSERT INTO machine_info (serno, ts, name, value) VALUES ($1, $2, $3, $4) ON CONFLICT (serno, name) DO UPDATE SET ts = excluded.ts, value = excluded.value",
+	DBQAddDetCount:    "INSERT INTO det_hourly (serno, hour, port, tagid, n) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (serno, hour, port, tagid) DO UPDATE SET n = det_hourly.n + excluded.n",
+	DBQNewSession:     "INSERT INTO sessions (token, userid, expiry, email, isadmin, projects) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (token) DO UPDATE SET userid = excluded.userid, expiry = excluded.expiry, email = excluded.email, isadmin = excluded.isadmin, projects = excluded.projects",
+	DBQSetMotusUser:   "INSERT INTO motus_users (userid, email, projects, ts) VALUES ($1, $2, $3, $4) ON CONFLICT (userid) DO UPDATE SET email = excluded.email, projects = excluded.projects, ts = excluded.ts",
+}
+
+var (
+	pgPlaceholderRE = regexp.MustCompile(`\?`)
+	pgTypeTextIdxRE = regexp.MustCompile(`(?i)substr\(message, 1, 1\), ts\)`)
+	pgDoubleRE      = regexp.MustCompile(`\bDOUBLE\b`)
+)
+
+// rewrite an sqlite statement for PostgreSQL
+//
+// Placeholders become $1, $2, ...; `==` becomes `=`; DOUBLE becomes
+// DOUBLE PRECISION; and the expression in the messages type index gets
+// the parentheses PostgreSQL requires.
+func pgDialect(q string) string {
+	n := 0
+	q = pgPlaceholderRE.ReplaceAllStringFunc(q, func(string) string {
+		n++
+		return "$" + strconv.Itoa(n)
+	})
+	q = strings.Replace(q, " == ", " = ", -1)
+	q = pgDoubleRE.ReplaceAllString(q, "DOUBLE PRECISION")
+	return pgTypeTextIdxRE.ReplaceAllString(q, "(substr(message, 1, 1)), ts)")
+}
+
+// open an sqlite database file, or a PostgreSQL database, without
+// touching its schema
+func openSQLStore(path string) (*sqlStore, error) {
+	s := &sqlStore{dialect: "sqlite3"}
+	if strings.HasPrefix(path, "postgres://") || strings.HasPrefix(path, "postgresql://") {
+		s.dialect = "postgres"
+	} else {
+		// these are set on every connection: auto_vacuum only takes
+		// effect for a new database (see README), and the busy
+		// timeout is a very generous 1 minute
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "_auto_vacuum=incremental&_busy_timeout=60000"
+	}
+	db, err := sql.Open(s.dialect, path)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+	return s, nil
+}
+
+// open a store
+//
+// `path` is the path to an sqlite database file, or a PostgreSQL
+// connection URL beginning with postgres:// or postgresql://.  Pending
+// schema migrations are run, and all queries are prepared.
+func OpenStore(path string) (Store, error) {
+	s, err := openSQLStore(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.migrate(); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	for i, q := range dbQueryText {
+		if s.dialect == "postgres" {
+			if pq, have := pgQueryText[dbQuery(i)]; have {
+				q = pq
+			} else {
+				q = pgDialect(q)
+			}
+		}
+		if s.queries[i], err = s.db.Prepare(q); err != nil {
+			s.db.Close()
+			return nil, fmt.Errorf("unable to prepare query %s: %s", q, err.Error())
+		}
+	}
+	insert := "INSERT INTO messages (ts, sender, message, detts) VALUES (?, ?, ?, ?)"
+	if s.dialect == "postgres" {
+		insert = pgDialect(insert)
+	}
+	if s.insertMsg, err = s.db.Prepare(insert); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	if s.dialect == "postgres" {
+		return &pgStore{s}, nil
+	}
+	return &sqliteStore{s}, nil
+}
+
+func (s *sqlStore) QueryRow(q dbQuery, pars []interface{}, res []interface{}) (rv bool) {
+	if q >= DBQ_num_queries {
+		return false
+	}
+	st := s.queries[q]
+	if len(res) > 0 {
+		rows, err := st.Query(pars...)
+		if err == nil {
+			if rows.Next() {
+				rows.Scan(res...)
+				rv = true
+			}
+			rows.Close()
+		}
+	} else {
+		_, err := st.Exec(pars...)
+		rv = err == nil
+	}
+	return
+}
+
+func (s *sqlStore) QueryRows(q dbQuery, pars []interface{}) (*sql.Rows, error) {
+	if q >= DBQ_num_queries {
+		return nil, fmt.Errorf("invalid query: %d", q)
+	}
+	return s.queries[q].Query(pars...)
+}
+
+func (s *sqlStore) GetRegistration(serno Serno) (reg Registration, ok bool) {
+	var (
+		pubKey, privKey sql.NullString
+		verified        sql.NullInt64
+	)
+	if !s.QueryRow(DBQGetRegistration, c{serno}, c{&reg.tunnelPort, &pubKey, &privKey, &verified}) {
+		return
+	}
+	reg.serno, reg.pubKey, reg.privKey, reg.verified = serno, pubKey.String, privKey.String, verified.Int64 != 0
+	return reg, true
+}
+
+func (s *sqlStore) NewRegistration(serno Serno) (reg Registration, err error) {
+	if !s.QueryRow(DBQNewSG, c{string(serno)}, c{}) {
+		// unable to create new SG record (!) out of tunnel ports?  Obvious DOS attack vector here!
+		return reg, fmt.Errorf("unable to register new SG: %s", serno)
+	}
+	// read back the tunnelPort just generated
+	reg, ok := s.GetRegistration(serno)
+	if !ok {
+		return reg, fmt.Errorf("unable to read registration record for %s", serno)
+	}
+	return reg, nil
+}
+
+func (s *sqlStore) SetKeys(serno Serno, pubKey, privKey string, verified bool) error {
+	v := 0
+	if verified {
+		v = 1
+	}
+	if !s.QueryRow(DBQNewSGKeys, c{unixtime(time.Now()), pubKey, privKey, v, string(serno)}, c{}) {
+		return fmt.Errorf("unable to save keys for %s", serno)
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteRegistration(serno Serno) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Stmt(s.queries[DBQArchiveSG]).Exec(unixtime(time.Now()), string(serno))
+	if err == nil {
+		var n int64
+		if n, err = res.RowsAffected(); err == nil && n == 0 {
+			err = fmt.Errorf("%s is not registered", serno)
+		}
+	}
+	if err == nil {
+		_, err = tx.Stmt(s.queries[DBQDeleteSG]).Exec(string(serno))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AddMessages(msgs []dbMsg) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	st := tx.Stmt(s.insertMsg)
+	defer st.Close()
+	for _, m := range msgs {
+		if _, err = st.Exec(m.ts, m.sender, m.text, detectionTs(m.text)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) SaveSession(t *UserToken, u *MotusUser) error {
+	projects := make([]string, 0, len(u.ProjectIDs))
+	for pid := range u.ProjectIDs {
+		projects = append(projects, strconv.Itoa(pid))
+	}
+	admin := 0
+	if u.IsAdmin {
+		admin = 1
+	}
+	if !s.QueryRow(DBQNewSession, c{t.Token, t.UserID, unixtime(t.Expiry), u.Email, admin, strings.Join(projects, ",")}, c{}) {
+		return fmt.Errorf("unable to save session for user %d", t.UserID)
+	}
+	if !s.QueryRow(DBQSetMotusUser, c{t.UserID, u.Email, strings.Join(projects, ","), unixtime(time.Now())}, c{}) {
+		return fmt.Errorf("unable to save projects of user %d", t.UserID)
+	}
+	return nil
+}
+
+func (s *sqlStore) GetSession(token string) (*UserToken, *MotusUser) {
+	var (
+		t        = UserToken{Token: token}
+		u        = MotusUser{ProjectIDs: make(map[int]bool)}
+		expiry   float64
+		admin    int
+		projects string
+	)
+	if !s.QueryRow(DBQGetSession, c{token, unixtime(time.Now())}, c{&t.UserID, &expiry, &u.Email, &admin, &projects}) {
+		return nil, nil
+	}
+	t.Expiry = fromUnixtime(expiry)
+	u.UserID, u.IsAdmin = t.UserID, admin != 0
+	for _, p := range strings.Split(projects, ",") {
+		if pid, err := strconv.Atoi(p); err == nil {
+			u.ProjectIDs[pid] = true
+		}
+	}
+	return &t, &u
+}
+
+func (s *sqlStore) DeleteSession(token string) error {
+	if !s.QueryRow(DBQDeleteSession, c{token}, c{}) {
+		return fmt.Errorf("unable to delete session")
+	}
+	return nil
+}
+
+func (s *sqlStore) ProjectEmails(projectID int) (emails []string) {
+	rows, err := s.QueryRows(DBQGetProjectEmails, c{"%," + strconv.Itoa(projectID) + ",%"})
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var email string
+		if rows.Scan(&email) == nil {
+			emails = append(emails, email)
+		}
+	}
+	return
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// whether a database error may go away if the operation is retried
+//
+// Errors from a busy, locked, full or unreachable database are
+// transient; those caused by the data, such as constraint violations
+// or invalid encodings, are not.  Errors from neither driver, such as
+// a lost connection, are taken to be transient.
+func isTransientDBError(err error) bool {
+	var se sqlite3.Error
+	if errors.As(err, &se) {
+		switch se.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrIoErr, sqlite3.ErrFull, sqlite3.ErrCantOpen:
+			return true
+		}
+		return false
+	}
+	var pe *pq.Error
+	if errors.As(err, &pe) {
+		switch pe.Code.Class() {
+		case "08", "40", "53", "57", "58":
+			// connection, transaction rollback (e.g. deadlock),
+			// insufficient resources, operator intervention, system
+			return true
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"testing"
+)
+
+func TestPgDialect(t *testing.T) {
+	tests := []struct {
+		q, want string
+	}{
+		{"SELECT ts FROM messages WHERE sender = ? AND ts >= ?",
+			"SELECT ts FROM messages WHERE sender = $1 AND ts >= $2"},
+		{"SELECT 1 FROM messages WHERE SUBSTR(message, 1, 1) == ?",
+			"SELECT 1 FROM messages WHERE SUBSTR(message, 1, 1) = $1"},
+		{"ALTER TABLE receivers ADD COLUMN rotationts DOUBLE",
+			"ALTER TABLE receivers ADD COLUMN rotationts DOUBLE PRECISION"},
+		{"CREATE TABLE t (ts DOUBLE, doubled INTEGER)",
+			"CREATE TABLE t (ts DOUBLE PRECISION, doubled INTEGER)"},
+		{"CREATE INDEX IF NOT EXISTS messages_sender_type_ts ON messages(sender, substr(message, 1, 1), ts)",
+			"CREATE INDEX IF NOT EXISTS messages_sender_type_ts ON messages(sender, (substr(message, 1, 1)), ts)"},
+		{"SELECT COUNT(*) FROM receivers", "SELECT COUNT(*) FROM receivers"},
+	}
+	for _, tt := range tests {
+		if got := pgDialect(tt.q); got != tt.want {
+			t.Errorf("pgDialect(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestIsTransientDBError(t *testing.T) {
+	s, err := openSQLStore(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	s.db.Exec("CREATE TABLE t (a INTEGER NOT NULL)")
+	_, constraint := s.db.Exec("INSERT INTO t VALUES (NULL)")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"sqlite constraint", constraint, false},
+		{"sqlite busy", sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{"sqlite locked", fmt.Errorf("commit: %w", sqlite3.Error{Code: sqlite3.ErrLocked}), true},
+		{"sqlite disk full", sqlite3.Error{Code: sqlite3.ErrFull}, true},
+		{"sqlite too big", sqlite3.Error{Code: sqlite3.ErrTooBig}, false},
+		{"postgres connection", &pq.Error{Code: "08006"}, true},
+		{"postgres deadlock", &pq.Error{Code: "40P01"}, true},
+		{"postgres unique violation", &pq.Error{Code: "23505"}, false},
+		{"postgres bad encoding", &pq.Error{Code: "22021"}, false},
+		{"other", errors.New("connection reset by peer"), true},
+	}
+	for _, tt := range tests {
+		if tt.err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		if got := isTransientDBError(tt.err); got != tt.want {
+			t.Errorf("%s: isTransientDBError(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNewRegistrationTunnelPorts(t *testing.T) {
+	testDB(t)
+	register := func(serno Serno) int {
+		t.Helper()
+		reg, err := DB.NewRegistration(serno)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reg.tunnelPort
+	}
+	deregister := func(serno Serno) {
+		t.Helper()
+		if err := DB.DeleteRegistration(serno); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []struct {
+		dereg []Serno // receivers deregistered before this step
+		serno Serno   // receiver which then registers
+		port  int     // tunnel port it should get
+	}{
+		{nil, "SG-0001BBBK0001", TunnelPortMin},
+		{nil, "SG-0002BBBK0002", TunnelPortMin + 1},
+		{nil, "SG-0003BBBK0003", TunnelPortMin + 2},
+		// the port of the receiver holding the lowest one comes back
+		{[]Serno{"SG-0001BBBK0001"}, "SG-0004BBBK0004", TunnelPortMin},
+		// as does one in the middle
+		{[]Serno{"SG-0002BBBK0002"}, "SG-0005BBBK0005", TunnelPortMin + 1},
+		{nil, "SG-0006BBBK0006", TunnelPortMin + 3},
+		// and with no receivers left, the pool starts again
+		{[]Serno{"SG-0003BBBK0003", "SG-0004BBBK0004", "SG-0005BBBK0005", "SG-0006BBBK0006"}, "SG-0007BBBK0007", TunnelPortMin},
+	}
+	for i, s := range steps {
+		for _, d := range s.dereg {
+			deregister(d)
+		}
+		if port := register(s.serno); port != s.port {
+			t.Errorf("step %d: %s got tunnel port %d, want %d", i, s.serno, port, s.port)
+		}
+	}
+}
+
+func TestOpenStoreType(t *testing.T) {
+	s, err := OpenStore(filepath.Join(t.TempDir(), "sg_remote.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := s.(*sqliteStore); !ok {
+		t.Errorf("sqlite database opened as %T", s)
+	}
+	if _, ok := s.(snapshotStore); !ok {
+		t.Error("sqlite store can't be backed up")
+	}
+	if _, ok := s.(vacuumStore); !ok {
+		t.Error("sqlite store can't be vacuumed")
+	}
+	// a PostgreSQL store has neither
+	var pg Store = &pgStore{&sqlStore{dialect: "postgres"}}
+	if _, ok := pg.(snapshotStore); ok {
+		t.Error("PostgreSQL store has Backup")
+	}
+	if _, ok := pg.(vacuumStore); ok {
+		t.Error("PostgreSQL store has Vacuum")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/jbrzusto/mbus"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// open a new, empty database as DB for the rest of a test
+func testDB(t *testing.T) {
+	t.Helper()
+	s, err := OpenStore(filepath.Join(t.TempDir(), "sg_remote.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := DB
+	DB = s
+	t.Cleanup(func() {
+		s.Close()
+		DB = saved
+	})
+}
+
+// replace MotusInfo with one holding `deps`, for the rest of a test
+func testMotus(t *testing.T, deps map[Serno]RecvDep) {
+	t.Helper()
+	if deps == nil {
+		deps = make(map[Serno]RecvDep)
+	}
+	saved := MotusInfo
+	MotusInfo = &MotusCache{Projects: make(map[int]string), RecvDeps: deps, Users: make(map[int]*MotusUser)}
+	t.Cleanup(func() { MotusInfo = saved })
+}
+
+// log a motus user in, returning their session cookie
+func testLogin(t *testing.T, u *MotusUser) *http.Cookie {
+	t.Helper()
+	token := &UserToken{Token: "test-token-" + u.Email, Expiry: time.Now().Add(time.Hour), UserID: u.UserID}
+	MotusInfo.AddUser(u, true)
+	tokenLock.Lock()
+	StringToToken[token.Token] = token
+	tokenLock.Unlock()
+	t.Cleanup(func() {
+		tokenLock.Lock()
+		delete(StringToToken, token.Token)
+		tokenLock.Unlock()
+	})
+	return &http.Cookie{Name: "sgsession", Value: token.Token}
+}
+
+// keep receivers' public keys and authorized_keys in a new, empty
+// directory for the rest of a test, and publish messages on a new bus
+func testKeyDir(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	savedDir, savedPath, savedBus := keyDir, authKeysPath, Bus
+	keyDir, authKeysPath, Bus = dir, filepath.Join(dir, "authorized_keys"), mbus.NewMbus()
+	t.Cleanup(func() { keyDir, authKeysPath, Bus = savedDir, savedPath, savedBus })
+}
+
+// use a new master key for the rest of a test
+func testMasterKey(t *testing.T) {
+	t.Helper()
+	saved := masterKey
+	masterKey = make([]byte, 32)
+	t.Cleanup(func() { masterKey = saved })
+}
+
+// register a receiver with a new key pair, returning its public key
+func testRegister(t *testing.T, serno Serno, verified bool) string {
+	t.Helper()
+	reg, err := DB.NewRegistration(serno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyPair(CryptoKeyType, serno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = DB.SetKeys(serno, keys.AuthorizedKey, keys.PrivatePEM, verified); err != nil {
+		t.Fatal(err)
+	}
+	if err = appendAuthKey(authKeyLine(serno, reg.tunnelPort, verified, keys.AuthorizedKey, string(serno))); err != nil {
+		t.Fatal(err)
+	}
+	return keys.AuthorizedKey
+}
+
+// the lines of authorized_keys which hold `pubKey`
+func testAuthKeyLines(t *testing.T, pubKey string) (lines []string) {
+	t.Helper()
+	buf, err := ioutil.ReadFile(authKeysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if authKeyLineHasKey(line, pubKey) {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
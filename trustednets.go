@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Trusted networks
+//
+// Receivers registering from a network in TrustedNetworks, such as the
+// bench where new receivers are provisioned, need no credentials;
+// receivers registering from anywhere else, i.e. in the field, must
+// give a motus user's credentials.
+//
+// Registration requests reach the registration server through sshd's
+// forced command for the factory key, so they all come from localhost.
+// To learn the receiver's real address, the forced command prepends
+// the SSH_CLIENT sshd gives it, and sends the request to a dedicated
+// port, AddressRegRelay, rather than to AddressRegServer:
+//
+//	command="echo SSH_CLIENT=$SSH_CLIENT; exec nc localhost 59029",no-port-forwarding
+//
+// The receiver can't remove that line, so it can't pose as being on a
+// trusted network.  Trust fails closed: a request on AddressRegRelay
+// which doesn't start with a well-formed SSH_CLIENT line is refused,
+// and a header on AddressRegServer, where an old forced command of
+// plain `nc` would let a receiver write one itself, is never believed,
+// so requests there from localhost are untrusted.  The factory key
+// must not allow port forwarding, or a receiver could reach
+// AddressRegRelay directly.
+
+// parse a comma-separated list of CIDR ranges; a bare address is a
+// range of one
+func parseNetworks(s string) (nets []*net.IPNet, err error) {
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", f)
+			}
+			if ip.To4() != nil {
+				f += "/32"
+			} else {
+				f += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parse a comma-separated list of CIDR ranges, exiting if it is
+// invalid
+func mustParseNetworks(s string) []*net.IPNet {
+	nets, err := parseNetworks(s)
+	if err != nil {
+		log.Fatalf("invalid network list %q: %s", s, err.Error())
+	}
+	return nets
+}
+
+// whether an address is in a trusted network
+func isTrustedAddr(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range TrustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// get the address of the receiver making a registration request
+//
+// `line` is the first line of the request, and `relayed` is true if
+// the connection is to AddressRegRelay.  A relayed request must start
+// with the header `SSH_CLIENT=ADDR PORT LOCALPORT`, whose ADDR is
+// returned; anything else is an error.  Otherwise, the address is
+// that of the connection, unless that is the loopback address, when
+// it is unknown, and nil, whatever `line` says.  Returns whether
+// `line` was a header, in which case the request proper follows it.
+func regClientAddr(conn net.Conn, line string, relayed bool) (ip net.IP, hdr bool, err error) {
+	hdr = strings.HasPrefix(line, "SSH_CLIENT=")
+	if !relayed {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+			ip = addr.IP
+		}
+		return ip, hdr, nil
+	}
+	if ip = parseSSHClient(line); ip == nil {
+		return nil, hdr, fmt.Errorf("relayed request without a valid SSH_CLIENT header: %q", line)
+	}
+	return ip, true, nil
+}
+
+// parse a header line `SSH_CLIENT=ADDR PORT LOCALPORT`; returns the
+// address, or nil if the line isn't exactly that
+func parseSSHClient(line string) net.IP {
+	if !strings.HasPrefix(line, "SSH_CLIENT=") {
+		return nil
+	}
+	f := strings.Fields(strings.TrimPrefix(line, "SSH_CLIENT="))
+	if len(f) != 3 {
+		return nil
+	}
+	for _, p := range f[1:] {
+		if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+			return nil
+		}
+	}
+	return net.ParseIP(f[0])
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string // CIDR form of each network
+		ok   bool
+	}{
+		{"", nil, true},
+		{" , ", nil, true},
+		{"209.183.24.36/32", []string{"209.183.24.36/32"}, true},
+		{"10.1.2.3/8", []string{"10.0.0.0/8"}, true},
+		{"192.168.0.0/16, 2001:db8::/32", []string{"192.168.0.0/16", "2001:db8::/32"}, true},
+		{"209.183.24.36", []string{"209.183.24.36/32"}, true},
+		{"2001:db8::1", []string{"2001:db8::1/128"}, true},
+		{"::1/128", []string{"::1/128"}, true},
+		{"10.0.0.0/33", nil, false},
+		{"2001:db8::/129", nil, false},
+		{"10.0.0", nil, false},
+		{"example.com", nil, false},
+		{"10.0.0.0/8,bogus", nil, false},
+		{"10.0.0.0/", nil, false},
+	}
+	for _, tt := range tests {
+		nets, err := parseNetworks(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseNetworks(%q): error %v, want ok=%v", tt.s, err, tt.ok)
+			continue
+		}
+		if len(nets) != len(tt.want) {
+			t.Errorf("parseNetworks(%q) = %v, want %v", tt.s, nets, tt.want)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.want[i] {
+				t.Errorf("parseNetworks(%q)[%d] = %s, want %s", tt.s, i, n, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestIsTrustedAddr(t *testing.T) {
+	saved := TrustedNets
+	defer func() { TrustedNets = saved }()
+	TrustedNets = mustParseNetworks("209.183.24.36, 10.0.0.0/8, 2001:db8::/32")
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"209.183.24.36", true},
+		{"209.183.24.37", false},
+		{"10.200.1.1", true},
+		{"11.0.0.1", false},
+		{"2001:db8::5", true},
+		{"2001:db9::5", false},
+		{"::ffff:10.1.1.1", true},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isTrustedAddr(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isTrustedAddr(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if isTrustedAddr(nil) {
+		t.Errorf("isTrustedAddr(nil) = true, want false")
+	}
+}
+
+func TestParseSSHClient(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // "" for nil
+	}{
+		{"SSH_CLIENT=209.183.24.36 51234 22", "209.183.24.36"},
+		{"SSH_CLIENT=2001:db8::1 51234 22", "2001:db8::1"},
+		{"SSH_CLIENT=209.183.24.36 51234", ""},
+		{"SSH_CLIENT=209.183.24.36 51234 22 extra", ""},
+		{"SSH_CLIENT=209.183.24.36 0 22", ""},
+		{"SSH_CLIENT=209.183.24.36 51234 65536", ""},
+		{"SSH_CLIENT=209.183.24.36 port 22", ""},
+		{"SSH_CLIENT=not.an.address 51234 22", ""},
+		{"SSH_CLIENT=", ""},
+		{"SSH_CLIENT= 51234 22", ""},
+		{"ssh_client=209.183.24.36 51234 22", ""},
+		{"1234BBBK5678 ssh-ed25519 AAAA", ""},
+	}
+	for _, tt := range tests {
+		ip := parseSSHClient(tt.line)
+		switch {
+		case tt.want == "" && ip != nil:
+			t.Errorf("parseSSHClient(%q) = %s, want nil", tt.line, ip)
+		case tt.want != "" && !ip.Equal(net.ParseIP(tt.want)):
+			t.Errorf("parseSSHClient(%q) = %v, want %s", tt.line, ip, tt.want)
+		}
+	}
+}
+
+// a connection with a given remote address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestRegClientAddr(t *testing.T) {
+	loopback := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}
+	remote := &net.TCPAddr{IP: net.ParseIP("209.183.24.36"), Port: 50000}
+	const hdr = "SSH_CLIENT=209.183.24.36 51234 22"
+	tests := []struct {
+		name    string
+		addr    net.Addr
+		line    string
+		relayed bool
+		want    string // "" for nil
+		hdr     bool
+		ok      bool
+	}{
+		{"relayed header", loopback, hdr, true, "209.183.24.36", true, true},
+		{"relayed without header", loopback, "1234BBBK5678", true, "", false, false},
+		{"relayed malformed header", loopback, "SSH_CLIENT=209.183.24.36", true, "", true, false},
+		{"unrelayed header from loopback not believed", loopback, hdr, false, "", true, true},
+		{"unrelayed from loopback", loopback, "1234BBBK5678", false, "", false, true},
+		{"unrelayed direct", remote, "1234BBBK5678", false, "209.183.24.36", false, true},
+		{"unrelayed direct header ignored", remote, "SSH_CLIENT=10.0.0.1 51234 22", false, "209.183.24.36", true, true},
+	}
+	for _, tt := range tests {
+		ip, hdr, err := regClientAddr(addrConn{remote: tt.addr}, tt.line, tt.relayed)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if hdr != tt.hdr {
+			t.Errorf("%s: header %v, want %v", tt.name, hdr, tt.hdr)
+		}
+		switch {
+		case tt.want == "" && ip != nil:
+			t.Errorf("%s: address %s, want nil", tt.name, ip)
+		case tt.want != "" && !ip.Equal(net.ParseIP(tt.want)):
+			t.Errorf("%s: address %v, want %s", tt.name, ip, tt.want)
+		}
+	}
+}
+
+func TestParseSerno(t *testing.T) {
+	tests := []struct {
+		s, want, legacy string
+	}{
+		{"1234BBBK5678", "SG-1234BBBK5678", "SG-1234BBBK5678"},
+		{"SG-1234BBBK5678", "SG-1234BBBK5678", "SG-SG-1234BBBK5678"},
+		{"sg-1234bbbk5678", "SG-1234BBBK5678", "SG-sg-1234bbbk5678"},
+		{"1234BBBK5678_1 ssh-ed25519 AAAA", "SG-1234BBBK5678_1", "SG-1234BBBK5678_1"},
+		{"1234BBBK567", "", ""},
+		{" 1234BBBK5678", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := parseSerno(tt.s); got != Serno(tt.want) {
+			t.Errorf("parseSerno(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+		if got := legacySerno(tt.s); got != Serno(tt.legacy) {
+			t.Errorf("legacySerno(%q) = %q, want %q", tt.s, got, tt.legacy)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Verification
+//
+// Anyone with the factory keys can register a receiver by inventing a
+// serial number, so new registrations start out unverified: their
+// authorized_keys lines don't let them map their web port, and
+// SyncManager doesn't sync them.  A motus administrator, or a member
+// of the motus project which has deployed the receiver, approves it
+// through the web API at /receivers/verify, or the status server's
+// `verify` command.  Its authorized_keys lines are then rewritten with
+// the full options, and if it is connected, its connection is dropped,
+// so that it reconnects with them and is synced.
+
+// an unverified receiver
+type UnverifiedSG struct {
+	Serno      Serno     `json:"serno"`
+	Registered time.Time `json:"registered"`
+	TunnelPort int       `json:"tunnelPort"`
+}
+
+// get receivers awaiting verification, oldest first
+func GetUnverified() (sgs []UnverifiedSG) {
+	rows, err := SQLRows(DBQGetUnverified, c{})
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			serno string
+			ts    sql.NullFloat64
+			port  int
+		)
+		if rows.Scan(&serno, &ts, &port) == nil {
+			sgs = append(sgs, UnverifiedSG{Serno(serno), fromUnixtime(ts.Float64), port})
+		}
+	}
+	return
+}
+
+// approve a receiver, giving its keys full access
+func VerifySG(serno Serno) error {
+	reg, ok := DB.GetRegistration(serno)
+	if !ok || reg.pubKey == "" {
+		return fmt.Errorf("%s is not registered", serno)
+	}
+	if reg.verified {
+		return fmt.Errorf("%s is already verified", serno)
+	}
+	if !SQL(DBQSetVerified, c{serno}, c{}) {
+		return fmt.Errorf("unable to verify %s", serno)
+	}
+	// upgrade the options of its key, and of any new key from a key
+	// rotation
+	var (
+		newPub, newPriv string
+		ts              float64
+	)
+	SQL(DBQGetRotation, c{serno}, c{&newPub, &newPriv, &ts})
+	if _, err := editAuthKeys(func(line string) string {
+		switch {
+		case authKeyLineHasKey(line, reg.pubKey):
+			return strings.TrimSuffix(authKeyLine(serno, reg.tunnelPort, true, reg.pubKey, string(serno)), "\n")
+		case authKeyLineHasKey(line, newPub):
+			return strings.TrimSuffix(authKeyLine(serno, reg.tunnelPort, true, newPub, string(serno)+newKeySemSuffix), "\n")
+		}
+		return line
+	}); err != nil {
+		return err
+	}
+	// sshd only reads the new options when the receiver reconnects
+	killConnection(serno)
+	log.Printf("verified %s\n", serno)
+	return nil
+}
+
+// reply to a status server request about verification
+//
+// `words` are the words of the request: "verify" lists receivers
+// awaiting verification as CSV; "verify SERNO" approves one.
+func VerifyReply(words []string) string {
+	switch len(words) {
+	case 1:
+		var b strings.Builder
+		b.WriteString("serno,registered,tunnelport\n")
+		for _, u := range GetUnverified() {
+			fmt.Fprintf(&b, "%s,%s,%d\n", u.Serno, u.Registered.UTC().Format(time.RFC3339), u.TunnelPort)
+		}
+		return b.String()
+	case 2:
+		serno := lookupSerno(words[1])
+		if serno == "" {
+			return "Error: invalid serial number " + words[1]
+		}
+		if err := VerifySG(serno); err != nil {
+			return "Error: " + err.Error()
+		}
+		return "OK: " + string(serno) + " verified"
+	}
+	return "Error: usage: " + words[0] + " [SERNO]"
+}
+
+// list or approve unverified receivers through the web API
+//
+// A GET to /receivers/verify returns a JSON array of the unverified
+// receivers the user is authorized for; a POST with a `serno` form
+// field and the csrfHeader header approves one.  The user must be
+// authorized for the receiver, i.e. a motus administrator or a member
+// of the project which has deployed it.
+func VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	if token == nil {
+		http.Error(w, "401 - Motus login required", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		sgs := []UnverifiedSG{}
+		for _, u := range GetUnverified() {
+			if Authorized(token.UserID, u.Serno) {
+				sgs = append(sgs, u)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sgs)
+	case "POST":
+		if !checkCSRF(w, r) {
+			return
+		}
+		serno := lookupSerno(r.FormValue("serno"))
+		if serno == "" || !Authorized(token.UserID, serno) {
+			http.Error(w, "401 - not authorized for device", http.StatusUnauthorized)
+			return
+		}
+		if err := VerifySG(serno); err != nil {
+			http.Error(w, "409 - "+err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("%s verified by user %d\n", serno, token.UserID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "405 - GET or POST only", http.StatusMethodNotAllowed)
+	}
+}
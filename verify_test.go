@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerifySG(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMasterKey(t)
+	pub := testRegister(t, "SG-1234BBBK5678", false)
+	if err := StartKeyRotation("SG-1234BBBK5678"); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		newPub, newPriv string
+		ts              float64
+	)
+	if !SQL(DBQGetRotation, c{Serno("SG-1234BBBK5678")}, c{&newPub, &newPriv, &ts}) {
+		t.Fatal("no key rotation recorded")
+	}
+	reg, _ := DB.GetRegistration("SG-1234BBBK5678")
+	web := fmt.Sprintf(`permitlisten="localhost:%d"`, webPortFromTunnelPort(reg.tunnelPort))
+
+	for _, key := range []string{pub, newPub} {
+		lines := testAuthKeyLines(t, key)
+		if len(lines) != 1 || strings.Contains(lines[0], web) {
+			t.Fatalf("unverified receiver can map its web port: %q", lines)
+		}
+	}
+	if u := GetUnverified(); len(u) != 1 || u[0].Serno != "SG-1234BBBK5678" {
+		t.Errorf("unverified receivers %v, want SG-1234BBBK5678", u)
+	}
+
+	if r := VerifyReply([]string{"verify", "SG-1234BBBK5678"}); r != "OK: SG-1234BBBK5678 verified" {
+		t.Fatalf("verify: %q", r)
+	}
+	if reg, _ = DB.GetRegistration("SG-1234BBBK5678"); !reg.verified {
+		t.Error("not verified in the database")
+	}
+	if u := GetUnverified(); len(u) != 0 {
+		t.Errorf("unverified receivers %v, want none", u)
+	}
+	if lines := testAuthKeyLines(t, pub); len(lines) != 1 || lines[0]+"\n" != authKeyLine("SG-1234BBBK5678", reg.tunnelPort, true, pub, "SG-1234BBBK5678") {
+		t.Errorf("key not upgraded: %q", lines)
+	}
+	if lines := testAuthKeyLines(t, newPub); len(lines) != 1 || lines[0]+"\n" != authKeyLine("SG-1234BBBK5678", reg.tunnelPort, true, newPub, "SG-1234BBBK5678"+newKeySemSuffix) {
+		t.Errorf("new key not upgraded: %q", lines)
+	}
+	if r := VerifyReply([]string{"verify", "SG-1234BBBK5678"}); !strings.HasPrefix(r, "Error:") {
+		t.Errorf("verified twice: %q", r)
+	}
+}
+
+func TestVerifyHandler(t *testing.T) {
+	testDB(t)
+	testKeyDir(t)
+	testMotus(t, map[Serno]RecvDep{"SG-SG-1234BBBK5678": {ProjectID: 1}})
+	pub := testRegister(t, "SG-SG-1234BBBK5678", false)
+	testRegister(t, "SG-5678BBBK1234", false)
+	member := testLogin(t, &MotusUser{UserID: 1, Email: "member@example.org", ProjectIDs: map[int]bool{1: true}})
+	other := testLogin(t, &MotusUser{UserID: 2, Email: "other@example.org", ProjectIDs: map[int]bool{2: true}})
+
+	get := httptest.NewRequest("GET", "/receivers/verify", nil)
+	get.AddCookie(member)
+	w := httptest.NewRecorder()
+	VerifyHandler(w, get)
+	if body := w.Body.String(); !strings.Contains(body, `"SG-SG-1234BBBK5678"`) || strings.Contains(body, "SG-5678BBBK1234") {
+		t.Errorf("member sees %s, want only SG-SG-1234BBBK5678", body)
+	}
+
+	post := func(cookie *http.Cookie, serno string) int {
+		req := httptest.NewRequest("POST", "/receivers/verify", strings.NewReader(url.Values{"serno": {serno}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(csrfHeader, "1")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		VerifyHandler(w, req)
+		return w.Code
+	}
+	if code := post(other, "SG-1234BBBK5678"); code != http.StatusUnauthorized {
+		t.Errorf("by a member of another project: status %d, want 401", code)
+	}
+	if code := post(member, "SG-1234BBBK5678"); code != http.StatusNoContent {
+		t.Errorf("by a project member: status %d, want 204", code)
+	}
+	reg, _ := DB.GetRegistration("SG-SG-1234BBBK5678")
+	if !reg.verified {
+		t.Error("legacy receiver not verified")
+	}
+	if lines := testAuthKeyLines(t, pub); len(lines) != 1 || !strings.Contains(lines[0], fmt.Sprintf(`permitlisten="localhost:%d"`, webPortFromTunnelPort(reg.tunnelPort))) {
+		t.Errorf("key not upgraded: %q", lines)
+	}
+	if code := post(member, "SG-1234BBBK5678"); code != http.StatusConflict {
+		t.Errorf("verified twice: status %d, want 409", code)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The web API serves data about receivers to browsers and scripts.
+//
+// nginx proxies requests for https://api.sensorgnome.org/XXX to
+// http://localhost:59028/XXX. Users authenticate with the same
+// "sgsession" cookie issued by the login form of the reverse proxy
+// (see RevProxyHandler), and are subject to the same Authorized()
+// rules, so a user only sees data from receivers deployed by
+// projects they belong to.
+
+// get the token of the user making a request
+//
+// returns nil if there is no session cookie, or if the token
+// it refers to is unknown or has expired.
+func requestToken(r *http.Request) *UserToken {
+	cookie, err := r.Cookie("sgsession")
+	if err != nil {
+		return nil
+	}
+	token := lookupToken(cookie.Value)
+	if token == nil || token.Expiry.Before(time.Now()) {
+		return nil
+	}
+	return token
+}
+
+// header which requests that change state must carry
+//
+// The session cookie is sent with requests from any page under
+// .sensorgnome.org, including receivers' own web interfaces, so it
+// alone doesn't show that a request came from a page of ours.  A
+// browser only sends a custom header to another origin after a CORS
+// preflight, which this server never approves, so a request carrying
+// one was not forged by a page elsewhere.
+const csrfHeader = "X-Sensorgnome-Request"
+
+// check that a request which changes state was not forged by another
+// site; writes an error reply and returns false if it may have been
+func checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(csrfHeader) == "" {
+		http.Error(w, "403 - missing "+csrfHeader+" header", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// check whether a user is authorized to see data from all receivers
+// of a motus project
+func AuthorizedProject(userID int, projectID int) bool {
+	user := MotusInfo.User(userID)
+	return user != nil && (user.IsAdmin || user.ProjectIDs[projectID])
+}
+
+// check that the target of a redirect is a path on this site
+//
+// Browsers treat a backslash like a slash, so "/\evil.example" is as
+// much another site as "//evil.example".
+func localTarget(target string) bool {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return false
+	}
+	u, err := url.Parse(target)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+// log in to the web API
+//
+// A POST with `username` and `password` form fields sets the session
+// cookie, and redirects to the form's `target`, if any; the target
+// must be a path on this site (see localTarget).
+func apiLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ParseForm() != nil {
+		http.Error(w, "400 - login requires POST with username and password", http.StatusBadRequest)
+		return
+	}
+	if target := r.Form.Get("target"); target != "" && !localTarget(target) {
+		http.Error(w, "400 - login target must be a path on this site", http.StatusBadRequest)
+		return
+	}
+	token := Login(w, r.Form.Get("username"), r.Form.Get("password"))
+	if token == nil {
+		http.Error(w, "401 - Motus login failed", http.StatusUnauthorized)
+		return
+	}
+	if target := r.Form.Get("target"); target != "" {
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// server for the web API
+func WebAPIServer(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ProxyLoginPath, apiLoginHandler)
+	mux.HandleFunc("/detections/live", LiveTagHandler)
+	mux.HandleFunc("/detections/stats", DetectionStatsHandler)
+	mux.HandleFunc("/detections/export", DetectionExportHandler)
+	mux.HandleFunc("/report/uptime", UptimeHandler)
+	mux.HandleFunc("/report/outages", UptimeHandler)
+	mux.HandleFunc("/gps/latest.geojson", GPSLatestHandler)
+	mux.HandleFunc("/gps/history.geojson", GPSHistoryHandler)
+	mux.HandleFunc("/admin/deregister", DeregisterHandler)
+	mux.HandleFunc("/receivers/verify", VerifyHandler)
+	srv := http.Server{Addr: addr, Handler: mux}
+	go srv.ListenAndServe()
+	<-ctx.Done()
+	srv.Shutdown(context.Background())
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLocalTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"/", true},
+		{"/report/uptime?serno=SG-1234BBBK5678", true},
+		{"/detections/live#top", true},
+		{"//evil.example/", false},
+		{"/\\evil.example/", false},
+		{"https://evil.example/", false},
+		{"javascript:alert(1)", false},
+		{"evil.example", false},
+		{"report/uptime", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := localTarget(tt.target); got != tt.ok {
+			t.Errorf("localTarget(%q) = %v, want %v", tt.target, got, tt.ok)
+		}
+	}
+}
+
+func TestLoginRejectsOffsiteTarget(t *testing.T) {
+	form := url.Values{"username": {"user"}, "password": {"secret"}, "target": {"//evil.example/"}}
+	req := httptest.NewRequest("POST", ProxyLoginPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	apiLoginHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "" {
+		t.Errorf("redirected to %s", loc)
+	}
+}